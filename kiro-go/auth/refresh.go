@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"fmt"
+	"kiro-api-proxy/config"
+	"kiro-api-proxy/pool"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// 调度循环间隔
+	refreshTick = 30 * time.Second
+	// 在过期前 refreshLead 到 refreshLead+refreshJitter 之间主动刷新，随机抖动避免所有账号同时刷新
+	refreshLead   = 10 * time.Minute
+	refreshJitter = 5 * time.Minute
+	// 请求路径上 token 剩余有效期不足该值时同步刷新（与账号选择跳过即将过期账号的阈值一致）
+	refreshSkew = 5 * time.Minute
+	// 主动刷新失败后的重试间隔，连续失败时指数增长
+	refreshRetryBase = 30 * time.Second
+	refreshRetryMax  = 10 * time.Minute
+)
+
+// refreshCall 进行中的一次刷新，同一账号的并发刷新共享结果
+type refreshCall struct {
+	done         chan struct{}
+	accessToken  string
+	refreshToken string
+	expiresAt    int64
+	err          error
+}
+
+// refreshSchedule 账号的主动刷新计划
+type refreshSchedule struct {
+	jitter    time.Duration // 本轮刷新的提前量抖动
+	failures  int           // 连续失败次数
+	nextRetry time.Time     // 失败后下次重试时间
+	lastError string
+	lastOK    time.Time
+}
+
+// RefreshStatus 账号 token 刷新状态（管理 API 使用）
+type RefreshStatus struct {
+	NextRefresh int64  `json:"nextRefresh"`           // 计划的下次主动刷新时间
+	LastRefresh int64  `json:"lastRefresh,omitempty"` // 最近一次成功刷新时间
+	Failures    int    `json:"failures,omitempty"`    // 连续失败次数
+	LastError   string `json:"lastError,omitempty"`
+}
+
+// RefreshManager token 刷新管理：同一账号同时只有一个刷新请求，
+// 后台在过期前主动刷新，刷新结果同时写入配置与账号池
+type RefreshManager struct {
+	mu        sync.Mutex
+	inflight  map[string]*refreshCall
+	schedules map[string]*refreshSchedule
+}
+
+var (
+	refreshManager     *RefreshManager
+	refreshManagerOnce sync.Once
+)
+
+// GetRefreshManager 获取全局 token 刷新管理器单例
+func GetRefreshManager() *RefreshManager {
+	refreshManagerOnce.Do(func() {
+		refreshManager = &RefreshManager{
+			inflight:  make(map[string]*refreshCall),
+			schedules: make(map[string]*refreshSchedule),
+		}
+	})
+	return refreshManager
+}
+
+// EnsureValid token 即将过期时刷新，否则直接返回
+func (m *RefreshManager) EnsureValid(account *config.Account) error {
+	if tokenFresh(account, time.Now()) {
+		return nil
+	}
+	return m.refresh(account)
+}
+
+// Refresh 无论是否临近过期都刷新 token（用于认证失败后的恢复）
+// 调用方持有的账号副本已被其他请求刷新过时直接使用新 token，避免重复消耗 refresh token
+func (m *RefreshManager) Refresh(account *config.Account) error {
+	return m.refresh(account)
+}
+
+// refresh 合并同一账号的并发刷新，并将结果写回 account
+func (m *RefreshManager) refresh(account *config.Account) error {
+	// 配置中已有更新的 token（其他请求或后台已刷新）时直接使用
+	if latest, ok := currentAccount(account.ID); ok && latest.AccessToken != account.AccessToken && tokenFresh(&latest, time.Now()) {
+		applyToken(account, latest.AccessToken, latest.RefreshToken, latest.ExpiresAt)
+		return nil
+	}
+
+	m.mu.Lock()
+	call, ok := m.inflight[account.ID]
+	if !ok {
+		call = &refreshCall{done: make(chan struct{})}
+		m.inflight[account.ID] = call
+		m.mu.Unlock()
+		m.doRefresh(account, call)
+	} else {
+		m.mu.Unlock()
+		<-call.done
+	}
+
+	if call.err != nil {
+		return call.err
+	}
+	applyToken(account, call.accessToken, call.refreshToken, call.expiresAt)
+	return nil
+}
+
+// doRefresh 调用上游刷新 token 并发布结果
+func (m *RefreshManager) doRefresh(account *config.Account, call *refreshCall) {
+	// 使用配置中最新的 refresh token，调用方的副本可能已被轮换
+	source := *account
+	if latest, ok := currentAccount(account.ID); ok && latest.RefreshToken != "" {
+		source = latest
+	}
+	call.accessToken, call.refreshToken, call.expiresAt, call.err = RefreshToken(&source)
+	if call.err == nil {
+		config.UpdateAccountToken(account.ID, call.accessToken, call.refreshToken, call.expiresAt)
+		pool.GetPool().UpdateToken(account.ID, call.accessToken, call.refreshToken, call.expiresAt)
+	}
+
+	m.mu.Lock()
+	delete(m.inflight, account.ID)
+	s := m.schedule(account.ID)
+	if call.err != nil {
+		s.failures++
+		s.nextRetry = time.Now().Add(retryBackoff(s.failures))
+		s.lastError = call.err.Error()
+	} else {
+		*s = refreshSchedule{jitter: randomJitter(), lastOK: time.Now()}
+	}
+	m.mu.Unlock()
+	close(call.done)
+}
+
+// schedule 获取账号的刷新计划（需持有锁）
+func (m *RefreshManager) schedule(id string) *refreshSchedule {
+	s, ok := m.schedules[id]
+	if !ok {
+		s = &refreshSchedule{jitter: randomJitter()}
+		m.schedules[id] = s
+	}
+	return s
+}
+
+// nextRefresh 账号计划的主动刷新时间（需持有锁）
+func (m *RefreshManager) nextRefresh(account *config.Account) time.Time {
+	s := m.schedule(account.ID)
+	due := time.Unix(account.ExpiresAt, 0).Add(-refreshLead - s.jitter)
+	if s.nextRetry.After(due) {
+		return s.nextRetry
+	}
+	return due
+}
+
+// Run 后台主动刷新循环，stop 关闭时退出
+func (m *RefreshManager) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(refreshTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.refreshDue()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// refreshDue 刷新已到计划时间的启用账号
+func (m *RefreshManager) refreshDue() {
+	now := time.Now()
+	for _, account := range config.GetEnabledAccounts() {
+		account := account
+		if account.RefreshToken == "" || account.ExpiresAt == 0 {
+			continue
+		}
+		m.mu.Lock()
+		due := !now.Before(m.nextRefresh(&account))
+		m.mu.Unlock()
+		if !due {
+			continue
+		}
+		if err := m.refresh(&account); err != nil {
+			fmt.Printf("[TokenRefresh] Failed to refresh %s: %v\n", account.Email, err)
+			continue
+		}
+		fmt.Printf("[TokenRefresh] Refreshed %s, expires at %s\n", account.Email, time.Unix(account.ExpiresAt, 0).Format(time.RFC3339))
+	}
+}
+
+// Status 返回启用账号的 token 刷新状态
+func (m *RefreshManager) Status() map[string]RefreshStatus {
+	accounts := config.GetEnabledAccounts()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make(map[string]RefreshStatus)
+	for i := range accounts {
+		account := &accounts[i]
+		if account.RefreshToken == "" || account.ExpiresAt == 0 {
+			continue
+		}
+		s := m.schedule(account.ID)
+		status := RefreshStatus{
+			NextRefresh: m.nextRefresh(account).Unix(),
+			Failures:    s.failures,
+			LastError:   s.lastError,
+		}
+		if !s.lastOK.IsZero() {
+			status.LastRefresh = s.lastOK.Unix()
+		}
+		result[account.ID] = status
+	}
+	return result
+}
+
+// tokenFresh token 未设置过期时间或剩余有效期超过 refreshSkew
+func tokenFresh(account *config.Account, now time.Time) bool {
+	return account.ExpiresAt == 0 || now.Add(refreshSkew).Unix() < account.ExpiresAt
+}
+
+// currentAccount 从配置读取账号的最新副本
+func currentAccount(id string) (config.Account, bool) {
+	if id == "" {
+		return config.Account{}, false
+	}
+	for _, a := range config.GetAccounts() {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return config.Account{}, false
+}
+
+// applyToken 将刷新结果写回调用方的账号副本
+func applyToken(account *config.Account, accessToken, refreshToken string, expiresAt int64) {
+	account.AccessToken = accessToken
+	if refreshToken != "" {
+		account.RefreshToken = refreshToken
+	}
+	account.ExpiresAt = expiresAt
+}
+
+func randomJitter() time.Duration {
+	return time.Duration(rand.Int63n(int64(refreshJitter)))
+}
+
+// retryBackoff 第 n 次连续失败后的重试间隔
+func retryBackoff(n int) time.Duration {
+	d := refreshRetryBase
+	for i := 1; i < n && d < refreshRetryMax; i++ {
+		d *= 2
+	}
+	return min(d, refreshRetryMax)
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"kiro-api-proxy/config"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 0, want: 30 * time.Second},
+		{failures: 1, want: 30 * time.Second},
+		{failures: 2, want: time.Minute},
+		{failures: 3, want: 2 * time.Minute},
+		{failures: 5, want: 8 * time.Minute},
+		{failures: 6, want: 10 * time.Minute},
+		{failures: 100, want: 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.failures); got != tt.want {
+			t.Errorf("retryBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestTokenFresh(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name      string
+		expiresAt int64
+		want      bool
+	}{
+		{name: "no expiry", expiresAt: 0, want: true},
+		{name: "well before expiry", expiresAt: now.Add(time.Hour).Unix(), want: true},
+		{name: "inside skew", expiresAt: now.Add(refreshSkew - time.Second).Unix(), want: false},
+		{name: "at skew", expiresAt: now.Add(refreshSkew).Unix(), want: false},
+		{name: "expired", expiresAt: now.Add(-time.Minute).Unix(), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenFresh(&config.Account{ExpiresAt: tt.expiresAt}, now); got != tt.want {
+				t.Fatalf("tokenFresh = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextRefreshHonorsRetry(t *testing.T) {
+	m := &RefreshManager{inflight: map[string]*refreshCall{}, schedules: map[string]*refreshSchedule{}}
+	expires := time.Now().Add(time.Hour)
+	account := &config.Account{ID: "a", ExpiresAt: expires.Unix()}
+
+	m.schedules["a"] = &refreshSchedule{jitter: 2 * time.Minute}
+	if got, want := m.nextRefresh(account), expires.Add(-refreshLead-2*time.Minute); !got.Equal(time.Unix(want.Unix(), 0)) {
+		t.Fatalf("nextRefresh = %v, want %v", got, want)
+	}
+
+	retry := expires.Add(-time.Minute)
+	m.schedules["a"].nextRetry = retry
+	if got := m.nextRefresh(account); !got.Equal(retry) {
+		t.Fatalf("nextRefresh after failure = %v, want %v", got, retry)
+	}
+}
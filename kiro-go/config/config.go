@@ -5,6 +5,7 @@
 //   - Server settings (port, host, API keys)
 //   - Usage statistics and metrics
 //   - Thinking mode configuration for AI responses
+//   - Model alias and routing table
 //
 // All configuration is stored in a JSON file with thread-safe access
 // via read-write mutex protection.
@@ -12,10 +13,17 @@ package config
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
 // GenerateMachineId generates a UUID v4 format machine identifier.
@@ -30,11 +38,41 @@ func GenerateMachineId() string {
 		bytes[0:4], bytes[4:6], bytes[6:8], bytes[8:10], bytes[10:16])
 }
 
+// Persisted account lifecycle states. Cooldown states (cooling_down, quota_exhausted)
+// are runtime-only and tracked by the account pool.
+const (
+	StateActive          = "active"
+	StateAuthFailed      = "auth_failed"
+	StateSuspended       = "suspended"
+	StateDisabledByAdmin = "disabled_by_admin"
+)
+
 // normalizeAccountDefaults fills backward-compatible defaults.
 func normalizeAccountDefaults(a *Account) {
 	if a.Weight <= 0 {
 		a.Weight = 100
 	}
+	if a.State == "" {
+		// Derive the lifecycle state of accounts saved before it existed
+		switch {
+		case a.Enabled:
+			a.State = StateActive
+		case a.BanStatus == "BANNED" && strings.HasPrefix(a.BanReason, "Authentication failed"):
+			a.State, a.StateReason, a.BanStatus = StateAuthFailed, a.BanReason, ""
+		case a.BanStatus == "BANNED" || a.BanStatus == "SUSPENDED":
+			a.State, a.StateReason, a.BanStatus = StateSuspended, a.BanReason, "SUSPENDED"
+		default:
+			a.State = StateDisabledByAdmin
+		}
+		a.StateSince = a.BanTime
+	}
+	// Only active accounts are enabled; keep the two in sync when Enabled is edited directly
+	if a.Enabled != (a.State == StateActive) {
+		a.State, a.StateReason, a.StateSince = StateDisabledByAdmin, "", time.Now().Unix()
+		if a.Enabled {
+			a.State = StateActive
+		}
+	}
 }
 
 // Account represents a Kiro API account with authentication credentials and usage statistics.
@@ -46,6 +84,12 @@ type Account struct {
 	Nickname string `json:"nickname,omitempty"` // Display name for admin panel
 	Weight   int    `json:"weight,omitempty"`   // Selection weight in weighted random (default: 100)
 
+	// Maximum concurrent in-flight requests (0: use maxConcurrentPerAccount)
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+	// Rate limits (0: use requestsPerMinutePerAccount / tokensPerMinutePerAccount)
+	RequestsPerMinute int `json:"requestsPerMinute,omitempty"` // Maximum requests per minute
+	TokensPerMinute   int `json:"tokensPerMinute,omitempty"`   // Maximum output tokens per minute
+
 	// Authentication credentials
 	AccessToken  string `json:"accessToken"`            // OAuth access token for API calls
 	RefreshToken string `json:"refreshToken"`           // OAuth refresh token for token renewal
@@ -64,6 +108,12 @@ type Account struct {
 	BanReason string `json:"banReason,omitempty"` // Reason for ban/suspension
 	BanTime   int64  `json:"banTime,omitempty"`   // Timestamp when ban was detected
 
+	// Lifecycle state: "active", "auth_failed", "suspended", or "disabled_by_admin".
+	// Set through SetAccountState, which keeps Enabled and BanStatus in sync.
+	State       string `json:"state,omitempty"`
+	StateReason string `json:"stateReason,omitempty"` // Why the account entered the state
+	StateSince  int64  `json:"stateSince,omitempty"`  // When the account entered the state (Unix seconds)
+
 	// Subscription information
 	SubscriptionType  string `json:"subscriptionType,omitempty"`  // Tier: FREE, PRO, PRO_PLUS, or POWER
 	SubscriptionTitle string `json:"subscriptionTitle,omitempty"` // Human-readable subscription name
@@ -91,24 +141,176 @@ type Account struct {
 	TotalCredits float64 `json:"totalCredits,omitempty"` // Cumulative credits consumed
 }
 
+// Model alias match modes.
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchRegex  = "regex"
+)
+
+// ErrModelAliasNotFound is returned when updating or deleting an unknown alias.
+var ErrModelAliasNotFound = errors.New("model alias not found")
+
+// ModelAlias maps client-facing model names to a Kiro model.
+// Aliases are matched case-insensitively in descending Priority order;
+// aliases with equal priority keep their configured order.
+type ModelAlias struct {
+	ID       string `json:"id"`                 // Unique alias identifier (UUID)
+	Match    string `json:"match"`              // Match mode: "exact", "prefix", or "regex"
+	Pattern  string `json:"pattern"`            // Model name, name prefix, or regular expression
+	Target   string `json:"target"`             // Kiro model ID the request is routed to
+	Priority int    `json:"priority,omitempty"` // Higher priority aliases are matched first
+	Disabled bool   `json:"disabled,omitempty"` // Skip this alias during matching
+
+	// Defaults applied when the request omits the parameter
+	Temperature    *float64 `json:"temperature,omitempty"`    // Sampling temperature
+	MaxTokens      int      `json:"maxTokens,omitempty"`      // Maximum output tokens
+	ThinkingBudget int      `json:"thinkingBudget,omitempty"` // Enables thinking with this budget
+}
+
+// API key endpoint scopes.
+const (
+	ApiKeyEndpointClaude = "claude" // /v1/messages and /v1/messages/count_tokens
+	ApiKeyEndpointOpenAI = "openai" // /v1/chat/completions
+	ApiKeyEndpointStats  = "stats"  // /v1/stats
+)
+
+// ErrApiKeyNotFound is returned when updating or deleting an unknown API key.
+var ErrApiKeyNotFound = errors.New("api key not found")
+
+// ApiKey is a named client API key. Only the SHA-256 hash of the secret is stored;
+// the secret itself is shown once when the key is created.
+type ApiKey struct {
+	ID         string `json:"id"`                  // Unique key identifier (UUID)
+	Name       string `json:"name"`                // Who or what uses the key, e.g. a teammate or CI job
+	Prefix     string `json:"prefix"`              // Leading characters of the secret, for recognizing the key
+	SecretHash string `json:"secretHash"`          // Hex-encoded SHA-256 of the secret
+	CreatedAt  int64  `json:"createdAt"`           // Unix seconds
+	ExpiresAt  int64  `json:"expiresAt,omitempty"` // Unix seconds, 0 = never expires
+	Enabled    bool   `json:"enabled"`
+
+	// Empty lists allow everything
+	AllowedModels    []string `json:"allowedModels,omitempty"`    // Model names; a trailing "*" matches a prefix
+	AllowedEndpoints []string `json:"allowedEndpoints,omitempty"` // "claude", "openai", and/or "stats"
+}
+
+// Expired reports whether the key has passed its expiry time.
+func (k *ApiKey) Expired(now time.Time) bool {
+	return k.ExpiresAt > 0 && now.Unix() >= k.ExpiresAt
+}
+
+// AllowsEndpoint reports whether the key may call the given endpoint scope.
+func (k *ApiKey) AllowsEndpoint(endpoint string) bool {
+	if len(k.AllowedEndpoints) == 0 {
+		return true
+	}
+	for _, e := range k.AllowedEndpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsModel reports whether the key may request the given model (case-insensitive).
+func (k *ApiKey) AllowsModel(model string) bool {
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	model = strings.ToLower(model)
+	for _, m := range k.AllowedModels {
+		m = strings.ToLower(m)
+		if m == model || (strings.HasSuffix(m, "*") && strings.HasPrefix(model, strings.TrimSuffix(m, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// HashApiKey returns the hex-encoded SHA-256 hash stored for an API key secret.
+func HashApiKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateApiKeySecret returns a new random API key secret.
+func GenerateApiKeySecret() string {
+	bytes := make([]byte, 24)
+	rand.Read(bytes)
+	return "sk-kiro-" + hex.EncodeToString(bytes)
+}
+
+// DefaultModelAliases returns the built-in alias table used for new configurations.
+func DefaultModelAliases() []ModelAlias {
+	alias := func(id, match, pattern, target string, priority int) ModelAlias {
+		return ModelAlias{ID: id, Match: match, Pattern: pattern, Target: target, Priority: priority}
+	}
+	return []ModelAlias{
+		alias("default-sonnet-4.6", MatchRegex, `^claude-sonnet-4[-.]6`, "claude-sonnet-4.6", 100),
+		alias("default-sonnet-4.5", MatchRegex, `^claude-sonnet-4[-.]5`, "claude-sonnet-4.5", 100),
+		alias("default-haiku-4.5", MatchRegex, `^claude-haiku-4[-.]5`, "claude-haiku-4.5", 100),
+		alias("default-opus-4.6", MatchRegex, `^claude-opus-4[-.]6`, "claude-opus-4.6", 100),
+		alias("default-opus-4.5", MatchRegex, `^claude-opus-4[-.]5`, "claude-opus-4.5", 100),
+		alias("default-sonnet-4", MatchPrefix, "claude-sonnet-4", "claude-sonnet-4", 50),
+		alias("default-claude-3-5-sonnet", MatchPrefix, "claude-3-5-sonnet", "claude-sonnet-4.5", 50),
+		alias("default-claude-3-opus", MatchPrefix, "claude-3-opus", "claude-sonnet-4.5", 50),
+		alias("default-claude-3-sonnet", MatchPrefix, "claude-3-sonnet", "claude-sonnet-4", 50),
+		alias("default-claude-3-haiku", MatchPrefix, "claude-3-haiku", "claude-haiku-4.5", 50),
+		alias("default-gpt-4o", MatchExact, "gpt-4o", "claude-sonnet-4.5", 20),
+		alias("default-gpt-4", MatchExact, "gpt-4", "claude-sonnet-4.5", 20),
+		alias("default-gpt", MatchRegex, `^gpt-(4|3\.5)`, "claude-sonnet-4.5", 10),
+		alias("default-auto", MatchExact, "auto", "claude-sonnet-4.5", 10),
+	}
+}
+
 // Config represents the global application configuration.
 type Config struct {
 	// Server settings
-	Password      string    `json:"password"`      // Admin panel password
-	Port          int       `json:"port"`          // HTTP server port (default: 8080)
-	Host          string    `json:"host"`          // HTTP server bind address (default: 0.0.0.0)
-	ApiKey        string    `json:"apiKey,omitempty"`        // API key for client authentication
-	RequireApiKey bool      `json:"requireApiKey"` // Whether to enforce API key validation
-	Accounts      []Account `json:"accounts"`      // Registered Kiro accounts
+	Password      string    `json:"password"`          // Admin panel password
+	Port          int       `json:"port"`              // HTTP server port (default: 8080)
+	Host          string    `json:"host"`              // HTTP server bind address (default: 0.0.0.0)
+	ApiKey        string    `json:"apiKey,omitempty"`  // API key for client authentication
+	RequireApiKey bool      `json:"requireApiKey"`     // Whether to enforce API key validation
+	ApiKeys       []ApiKey  `json:"apiKeys,omitempty"` // Named client API keys, accepted alongside ApiKey
+	Accounts      []Account `json:"accounts"`          // Registered Kiro accounts
 
 	// Thinking mode configuration for extended reasoning output
 	ThinkingSuffix       string `json:"thinkingSuffix,omitempty"`       // Model suffix to trigger thinking mode (default: "-thinking")
 	OpenAIThinkingFormat string `json:"openaiThinkingFormat,omitempty"` // OpenAI output format: "reasoning_content", "thinking", or "think"
-	ClaudeThinkingFormat string `json:"claudeThinkingFormat,omitempty"` // Claude output format: "reasoning_content", "thinking", or "think"
+	ClaudeThinkingFormat string `json:"claudeThinkingFormat,omitempty"` // Claude output format: "native", "reasoning_content", "thinking", or "think"
 
 	// Endpoint configuration: "auto", "codewhisperer", or "amazonq"
 	PreferredEndpoint string `json:"preferredEndpoint,omitempty"`
 
+	// Failover: maximum upstream attempts per request across accounts (default: 4)
+	FailoverMaxAttempts int `json:"failoverMaxAttempts,omitempty"`
+
+	// Concurrency: default per-account limit on in-flight requests (0: unlimited) and how long
+	// a request waits in the queue when every account is saturated (default: 30)
+	MaxConcurrentPerAccount int `json:"maxConcurrentPerAccount,omitempty"`
+	QueueTimeoutSeconds     int `json:"queueTimeoutSeconds,omitempty"`
+
+	// Rate limits: default per-account requests and output tokens per minute (0: unlimited)
+	RequestsPerMinutePerAccount int `json:"requestsPerMinutePerAccount,omitempty"`
+	TokensPerMinutePerAccount   int `json:"tokensPerMinutePerAccount,omitempty"`
+
+	// Health probe: periodically re-check cooled-down and auto-banned accounts and restore them once they pass
+	DisableHealthProbe bool `json:"disableHealthProbe,omitempty"`
+
+	// Account selection strategy: "drain-first" (default), "round-robin", "least-recently-used",
+	// "least-in-flight", "usage-balancing", or "weighted-random"
+	SelectionStrategy string `json:"selectionStrategy,omitempty"`
+
+	// Model routing: alias table and handling of models that match no alias
+	ModelAliases        []ModelAlias `json:"modelAliases"`                  // Alias table (seeded with DefaultModelAliases)
+	RejectUnknownModels bool         `json:"rejectUnknownModels,omitempty"` // Return 404 model_not_found instead of the default model
+
+	// Model fallback chains: Kiro model ID -> models tried in order once every account fails
+	ModelFallbacks map[string][]string `json:"modelFallbacks,omitempty"`
+
+	// Session affinity: minutes a session keeps its account and conversationId after the last request (default: 60)
+	SessionTTLMinutes int `json:"sessionTtlMinutes,omitempty"`
+
 	// Global statistics (persisted across restarts)
 	TotalRequests         int     `json:"totalRequests,omitempty"`         // Total API requests received
 	SuccessRequests       int     `json:"successRequests,omitempty"`       // Successful requests count
@@ -170,6 +372,7 @@ func Load() error {
 				Host:          "0.0.0.0",
 				RequireApiKey: false,
 				Accounts:      []Account{},
+				ModelAliases:  DefaultModelAliases(),
 			}
 			return Save()
 		}
@@ -182,12 +385,16 @@ func Load() error {
 	}
 	changed := false
 	for i := range c.Accounts {
-		old := c.Accounts[i].Weight
+		oldWeight, oldState := c.Accounts[i].Weight, c.Accounts[i].State
 		normalizeAccountDefaults(&c.Accounts[i])
-		if old != c.Accounts[i].Weight {
+		if oldWeight != c.Accounts[i].Weight || oldState != c.Accounts[i].State {
 			changed = true
 		}
 	}
+	if c.ModelAliases == nil {
+		c.ModelAliases = DefaultModelAliases()
+		changed = true
+	}
 	cfg = &c
 	if changed {
 		return Save()
@@ -205,6 +412,15 @@ func Save() error {
 	return os.WriteFile(cfgPath, data, 0600)
 }
 
+// DataPath returns the path of a state file stored next to the config file.
+// Returns "" before Init is called.
+func DataPath(name string) string {
+	if cfgPath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(cfgPath), name)
+}
+
 // SetPassword updates the admin password.
 // Primarily used for environment variable override in containerized deployments.
 func SetPassword(password string) {
@@ -288,6 +504,28 @@ func UpdateAccount(id string, account Account) error {
 	return nil
 }
 
+// SetAccountState persists an account's lifecycle state and keeps Enabled and BanStatus in sync:
+// only active accounts are enabled, and suspended accounts keep the legacy "SUSPENDED" ban status.
+func SetAccountState(id, state, reason string) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	for i, a := range cfg.Accounts {
+		if a.ID != id {
+			continue
+		}
+		now := time.Now().Unix()
+		a.State, a.StateReason, a.StateSince = state, reason, now
+		a.Enabled = state == StateActive
+		a.BanStatus, a.BanReason, a.BanTime = "", "", 0
+		if state == StateSuspended {
+			a.BanStatus, a.BanReason, a.BanTime = "SUSPENDED", reason, now
+		}
+		cfg.Accounts[i] = a
+		return Save()
+	}
+	return nil
+}
+
 func DeleteAccount(id string) error {
 	cfgLock.Lock()
 	defer cfgLock.Unlock()
@@ -328,6 +566,70 @@ func IsApiKeyRequired() bool {
 	return cfg.RequireApiKey
 }
 
+// GetApiKeys returns a copy of the named API keys.
+func GetApiKeys() []ApiKey {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	keys := make([]ApiKey, len(cfg.ApiKeys))
+	copy(keys, cfg.ApiKeys)
+	return keys
+}
+
+// FindApiKey returns the named API key whose secret matches, regardless of whether it is enabled or expired.
+func FindApiKey(secret string) (ApiKey, bool) {
+	hash := HashApiKey(secret)
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	for _, k := range cfg.ApiKeys {
+		if subtle.ConstantTimeCompare([]byte(k.SecretHash), []byte(hash)) == 1 {
+			return k, true
+		}
+	}
+	return ApiKey{}, false
+}
+
+// AddApiKey appends a named API key.
+func AddApiKey(key ApiKey) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfg.ApiKeys = append(cfg.ApiKeys, key)
+	return Save()
+}
+
+// UpdateApiKey applies update to a copy of the API key with the given ID and stores the result.
+// Nothing is saved if update returns an error. The ID, secret hash, prefix and creation time are kept.
+func UpdateApiKey(id string, update func(*ApiKey) error) (ApiKey, error) {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	for i, k := range cfg.ApiKeys {
+		if k.ID == id {
+			key := k
+			key.AllowedModels = append([]string(nil), k.AllowedModels...)
+			key.AllowedEndpoints = append([]string(nil), k.AllowedEndpoints...)
+			if err := update(&key); err != nil {
+				return k, err
+			}
+			key.ID, key.Prefix, key.SecretHash, key.CreatedAt = k.ID, k.Prefix, k.SecretHash, k.CreatedAt
+			cfg.ApiKeys[i] = key
+			return key, Save()
+		}
+	}
+	return ApiKey{}, ErrApiKeyNotFound
+}
+
+// DeleteApiKey removes the API key with the given ID.
+func DeleteApiKey(id string) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	for i, k := range cfg.ApiKeys {
+		if k.ID == id {
+			cfg.ApiKeys = append(cfg.ApiKeys[:i], cfg.ApiKeys[i+1:]...)
+			return Save()
+		}
+	}
+	return ErrApiKeyNotFound
+}
+
 func UpdateSettings(apiKey string, requireApiKey bool, password string) error {
 	cfgLock.Lock()
 	defer cfgLock.Unlock()
@@ -466,3 +768,195 @@ func UpdatePreferredEndpoint(endpoint string) error {
 	cfg.PreferredEndpoint = endpoint
 	return Save()
 }
+
+// GetFailoverMaxAttempts 获取单个请求跨账号重试的最大尝试次数
+func GetFailoverMaxAttempts() int {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	if cfg.FailoverMaxAttempts <= 0 {
+		return 4
+	}
+	return cfg.FailoverMaxAttempts
+}
+
+// UpdateFailoverMaxAttempts 更新跨账号重试的最大尝试次数
+func UpdateFailoverMaxAttempts(maxAttempts int) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfg.FailoverMaxAttempts = maxAttempts
+	return Save()
+}
+
+// GetConcurrencyConfig 获取账号默认并发上限（0 为不限制）与排队超时
+func GetConcurrencyConfig() (maxConcurrent int, queueTimeout time.Duration) {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	queueTimeout = 30 * time.Second
+	if cfg.QueueTimeoutSeconds > 0 {
+		queueTimeout = time.Duration(cfg.QueueTimeoutSeconds) * time.Second
+	}
+	return cfg.MaxConcurrentPerAccount, queueTimeout
+}
+
+// UpdateConcurrencyConfig 更新账号默认并发上限与排队超时（秒）
+func UpdateConcurrencyConfig(maxConcurrent, queueTimeoutSeconds int) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfg.MaxConcurrentPerAccount = maxConcurrent
+	cfg.QueueTimeoutSeconds = queueTimeoutSeconds
+	return Save()
+}
+
+// GetRateLimitConfig 获取账号默认每分钟请求数与输出 token 数上限（0 为不限制）
+func GetRateLimitConfig() (requestsPerMinute, tokensPerMinute int) {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.RequestsPerMinutePerAccount, cfg.TokensPerMinutePerAccount
+}
+
+// UpdateRateLimitConfig 更新账号默认每分钟请求数与输出 token 数上限
+func UpdateRateLimitConfig(requestsPerMinute, tokensPerMinute int) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfg.RequestsPerMinutePerAccount = requestsPerMinute
+	cfg.TokensPerMinutePerAccount = tokensPerMinute
+	return Save()
+}
+
+// IsHealthProbeEnabled 是否启用后台健康探测
+func IsHealthProbeEnabled() bool {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return !cfg.DisableHealthProbe
+}
+
+// UpdateHealthProbe 启用或关闭后台健康探测
+func UpdateHealthProbe(enabled bool) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfg.DisableHealthProbe = !enabled
+	return Save()
+}
+
+// GetSelectionStrategy 获取账号选择策略，未配置时返回空字符串（由账号池使用默认策略）
+func GetSelectionStrategy() string {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.SelectionStrategy
+}
+
+// UpdateSelectionStrategy 更新账号选择策略
+func UpdateSelectionStrategy(strategy string) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfg.SelectionStrategy = strategy
+	return Save()
+}
+
+// GetModelAliases returns a copy of the model alias table.
+func GetModelAliases() []ModelAlias {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	aliases := make([]ModelAlias, len(cfg.ModelAliases))
+	copy(aliases, cfg.ModelAliases)
+	return aliases
+}
+
+// AddModelAlias appends an alias to the table.
+func AddModelAlias(alias ModelAlias) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfg.ModelAliases = append(cfg.ModelAliases, alias)
+	return Save()
+}
+
+// UpdateModelAlias replaces the alias with the given ID.
+func UpdateModelAlias(id string, alias ModelAlias) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	for i, a := range cfg.ModelAliases {
+		if a.ID == id {
+			alias.ID = id
+			cfg.ModelAliases[i] = alias
+			return Save()
+		}
+	}
+	return ErrModelAliasNotFound
+}
+
+// DeleteModelAlias removes the alias with the given ID.
+func DeleteModelAlias(id string) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	for i, a := range cfg.ModelAliases {
+		if a.ID == id {
+			cfg.ModelAliases = append(cfg.ModelAliases[:i], cfg.ModelAliases[i+1:]...)
+			return Save()
+		}
+	}
+	return ErrModelAliasNotFound
+}
+
+// IsRejectUnknownModels 未匹配别名的模型是否返回 404
+func IsRejectUnknownModels() bool {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.RejectUnknownModels
+}
+
+// UpdateRejectUnknownModels 更新未知模型的处理方式
+func UpdateRejectUnknownModels(reject bool) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfg.RejectUnknownModels = reject
+	return Save()
+}
+
+// GetModelFallbacks returns the fallback chain configured for a Kiro model.
+func GetModelFallbacks(model string) []string {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	for k, chain := range cfg.ModelFallbacks {
+		if strings.EqualFold(k, model) {
+			return append([]string(nil), chain...)
+		}
+	}
+	return nil
+}
+
+// GetAllModelFallbacks returns a copy of all configured fallback chains.
+func GetAllModelFallbacks() map[string][]string {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	result := make(map[string][]string, len(cfg.ModelFallbacks))
+	for k, chain := range cfg.ModelFallbacks {
+		result[k] = append([]string(nil), chain...)
+	}
+	return result
+}
+
+// UpdateModelFallbacks replaces all fallback chains.
+func UpdateModelFallbacks(fallbacks map[string][]string) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfg.ModelFallbacks = fallbacks
+	return Save()
+}
+
+// GetSessionTTL 获取会话粘性绑定的过期时间
+func GetSessionTTL() time.Duration {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	if cfg.SessionTTLMinutes <= 0 {
+		return time.Hour
+	}
+	return time.Duration(cfg.SessionTTLMinutes) * time.Minute
+}
+
+// UpdateSessionTTL 更新会话粘性绑定的过期时间（分钟）
+func UpdateSessionTTL(minutes int) error {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfg.SessionTTLMinutes = minutes
+	return Save()
+}
@@ -1,26 +1,36 @@
 // Package pool 账号池管理
-// 实现随机负载均衡、错误冷却、Token 刷新
+// 实现可切换的账号选择策略、错误冷却、Token 刷新、按模型可用性路由
 package pool
 
 import (
 	"kiro-api-proxy/config"
-	"math/rand"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
-const (
-	primaryUsageThreshold = 10
-	topCandidateLimit     = 3
-)
-
 // AccountPool 账号池
 type AccountPool struct {
 	mu          sync.RWMutex
 	accounts    []config.Account
-	cooldowns   map[string]time.Time // 账号冷却时间
-	errorCounts map[string]int       // 连续错误计数
+	cooldowns   map[string]Cooldown        // 账号冷却状态
+	errorCounts map[string]int             // 连续错误计数
+	lastErrors  map[string]time.Time       // 最近一次错误时间
+	models      map[string]map[string]bool // 账号可用模型（小写 modelId），未缓存的账号视为支持所有模型
+	modelNames  map[string]string          // 小写 modelId -> 上游返回的原始 modelId
+	states      map[string]StateInfo       // 所有账号（含未启用）的生命周期状态
+	transitions map[string][]Transition    // 账号最近的状态变更
+
+	inFlight     map[string]int             // 账号正在处理的请求数
+	slotFreed    chan struct{}              // 有并发槽位释放时关闭并替换，唤醒排队的请求
+	limiters     map[string]*accountLimiter // 账号限速令牌桶
+	queue        queueStats                 // 排队统计
+	lastSelected map[string]time.Time       // 账号最近一次被选中的时间
+	strategies   map[string]Strategy        // 选择策略实例（保存策略内部状态，如轮询位置）
+
+	saveTimer *time.Timer // 待执行的状态写入
+	saveMu    sync.Mutex  // 串行化状态文件写入
 }
 
 var (
@@ -31,61 +41,136 @@ var (
 // GetPool 获取全局账号池单例
 func GetPool() *AccountPool {
 	poolOnce.Do(func() {
-		pool = &AccountPool{
-			cooldowns:   make(map[string]time.Time),
-			errorCounts: make(map[string]int),
-		}
+		pool = newAccountPool()
 		pool.Reload()
+		pool.loadState()
 	})
 	return pool
 }
 
+// newAccountPool 创建空的账号池
+func newAccountPool() *AccountPool {
+	return &AccountPool{
+		cooldowns:   make(map[string]Cooldown),
+		errorCounts: make(map[string]int),
+		lastErrors:  make(map[string]time.Time),
+		models:      make(map[string]map[string]bool),
+		modelNames:  make(map[string]string),
+		states:      make(map[string]StateInfo),
+		transitions: make(map[string][]Transition),
+
+		inFlight:     make(map[string]int),
+		slotFreed:    make(chan struct{}),
+		limiters:     make(map[string]*accountLimiter),
+		lastSelected: make(map[string]time.Time),
+		strategies:   newStrategies(),
+	}
+}
+
 // Reload 从配置重新加载账号
 func (p *AccountPool) Reload() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.accounts = config.GetEnabledAccounts()
+	p.releaseRecoveredQuota()
+	p.syncStatesLocked(config.GetAccounts(), time.Now())
+	// 并发上限可能已调整，唤醒排队的请求重新选择
+	p.notifySlotFreed()
 }
 
-// GetNext 获取一个可用账号：主池/兜底池 +（排序优先后的）组内加权随机
+// GetNext 按当前选择策略获取一个可用账号
 func (p *AccountPool) GetNext() *config.Account {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
+	return p.Select(SelectOptions{})
+}
+
+// SelectOptions 账号选择条件
+type SelectOptions struct {
+	Model   string          // 只选择支持该模型的账号，为空时不过滤
+	Exclude map[string]bool // 跳过的账号（已尝试过）
+	// Preferred 可用且未满载时优先使用的账号（会话粘性）
+	Preferred string
+	// Gateway 网关模式：Token 由网关刷新，不跳过即将过期的账号，但要求账号有 RefreshToken
+	Gateway bool
+}
+
+// Select 过滤出可用账号后交给当前选择策略挑选，不占用并发槽位
+// 没有可用账号时返回冷却时间最短的账号，所有账号都被排除或满载时返回 nil
+func (p *AccountPool) Select(opts SelectOptions) *config.Account {
+	strategy := p.strategy()
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	acc, _, _ := p.selectLocked(strategy, opts, time.Now())
+	return acc
+}
+
+// selectLocked 选择账号（需持有写锁）
+// 有符合条件的账号但都已满载或被限速时返回 busy=true，调用方可排队等待；
+// retryIn 为被限速账号中最早恢复可用的时间，没有被限速的账号时为 0
+func (p *AccountPool) selectLocked(strategy Strategy, opts SelectOptions, now time.Time) (acc *config.Account, busy bool, retryIn time.Duration) {
 	if len(p.accounts) == 0 {
-		return nil
+		return nil, false, 0
 	}
+	p.syncExpiredLocked(now)
 
-	now := time.Now()
-	primary := make([]*config.Account, 0, len(p.accounts))
-	fallback := make([]*config.Account, 0, len(p.accounts))
+	defaultLimit, _ := config.GetConcurrencyConfig()
+	defaultRPM, defaultTPM := config.GetRateLimitConfig()
+	candidates := make([]Candidate, 0, len(p.accounts))
+	eligible := func(acc *config.Account) bool {
+		if opts.Exclude[acc.ID] || !p.supportsModel(acc.ID, opts.Model) {
+			return false
+		}
+		return !opts.Gateway || acc.RefreshToken != ""
+	}
 
 	for i := range p.accounts {
 		acc := &p.accounts[i]
+		if !eligible(acc) {
+			continue
+		}
 
 		// 跳过冷却中的账号
-		if cooldown, ok := p.cooldowns[acc.ID]; ok && now.Before(cooldown) {
+		if p.coolingDown(acc.ID, now) {
 			continue
 		}
 
 		// 跳过即将过期的 Token
-		if acc.ExpiresAt > 0 && now.Unix() > acc.ExpiresAt-300 {
+		if !opts.Gateway && acc.ExpiresAt > 0 && now.Unix() > acc.ExpiresAt-300 {
 			continue
 		}
 
-		if acc.UsageCurrent >= primaryUsageThreshold {
-			primary = append(primary, acc)
-		} else {
-			fallback = append(fallback, acc)
+		// 跳过已达并发上限的账号
+		if p.saturated(acc, defaultLimit) {
+			busy = true
+			continue
+		}
+
+		// 跳过被限速的账号
+		if wait := p.rateLimitWait(acc, defaultRPM, defaultTPM, now); wait > 0 {
+			if !busy || retryIn == 0 || wait < retryIn {
+				retryIn = wait
+			}
+			busy = true
+			continue
+		}
+
+		if acc.ID == opts.Preferred {
+			p.lastSelected[acc.ID] = now
+			return acc, false, 0
 		}
+		candidates = append(candidates, Candidate{
+			Account:      acc,
+			InFlight:     p.inFlight[acc.ID],
+			LastSelected: p.lastSelected[acc.ID],
+		})
 	}
 
-	picked := pickWeightedWithRanking(primary)
-	if picked == nil {
-		picked = pickWeightedWithRanking(fallback)
+	if picked := strategy.Pick(candidates); picked != nil {
+		p.lastSelected[picked.ID] = now
+		return picked, false, 0
 	}
-	if picked != nil {
-		return picked
+	if busy {
+		return nil, true, retryIn
 	}
 
 	// 无可用账号，返回冷却时间最短的
@@ -93,63 +178,74 @@ func (p *AccountPool) GetNext() *config.Account {
 	var earliest time.Time
 	for i := range p.accounts {
 		acc := &p.accounts[i]
+		if !eligible(acc) {
+			continue
+		}
 		if cooldown, ok := p.cooldowns[acc.ID]; ok {
-			if best == nil || cooldown.Before(earliest) {
+			if best == nil || cooldown.Until.Before(earliest) {
 				best = acc
-				earliest = cooldown
+				earliest = cooldown.Until
 			}
 		} else {
-			return acc
+			return acc, false, 0
 		}
 	}
-	return best
+	return best, false, 0
 }
 
-func pickWeightedWithRanking(candidates []*config.Account) *config.Account {
-	if len(candidates) == 0 {
-		return nil
+// supportsModel 账号是否可以服务 model（需持有读锁）
+func (p *AccountPool) supportsModel(id, model string) bool {
+	if model == "" {
+		return true
 	}
+	models, ok := p.models[id]
+	return !ok || models[strings.ToLower(model)]
+}
 
-	// 先按积分(usageCurrent) / 更新时间(lastRefresh)排序
-	sort.SliceStable(candidates, func(i, j int) bool {
-		if candidates[i].UsageCurrent == candidates[j].UsageCurrent {
-			return candidates[i].LastRefresh > candidates[j].LastRefresh
-		}
-		return candidates[i].UsageCurrent > candidates[j].UsageCurrent
-	})
-
-	// 只在前N个候选里按权重随机，兼顾“优先”与“分流”
-	limit := topCandidateLimit
-	if len(candidates) < limit {
-		limit = len(candidates)
+// SetAccountModels 缓存账号的可用模型列表
+func (p *AccountPool) SetAccountModels(id string, models []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	set := make(map[string]bool, len(models))
+	for _, m := range models {
+		key := strings.ToLower(m)
+		set[key] = true
+		p.modelNames[key] = m
 	}
-	top := candidates[:limit]
+	p.models[id] = set
+}
 
-	totalWeight := 0
-	for _, a := range top {
-		w := a.Weight
-		if w <= 0 {
-			w = 100
+// HasModel 池中是否有账号可以服务 model
+func (p *AccountPool) HasModel(model string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, acc := range p.accounts {
+		if p.supportsModel(acc.ID, model) {
+			return true
 		}
-		totalWeight += w
-	}
-
-	if totalWeight <= 0 {
-		return top[rand.Intn(len(top))]
 	}
+	return false
+}
 
-	r := rand.Intn(totalWeight)
-	for _, a := range top {
-		w := a.Weight
-		if w <= 0 {
-			w = 100
-		}
-		r -= w
-		if r < 0 {
-			return a
+// Models 返回池中账号可用模型的并集（按 modelId 排序），没有任何账号缓存模型列表时返回 nil
+func (p *AccountPool) Models() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	union := map[string]bool{}
+	for _, acc := range p.accounts {
+		for m := range p.models[acc.ID] {
+			union[m] = true
 		}
 	}
-	return top[len(top)-1]
+	if len(union) == 0 {
+		return nil
+	}
+	result := make([]string, 0, len(union))
+	for m := range union {
+		result = append(result, p.modelNames[m])
+	}
+	sort.Strings(result)
+	return result
 }
 
 // GetByID 根据 ID 获取账号
@@ -166,26 +262,7 @@ func (p *AccountPool) GetByID(id string) *config.Account {
 
 // RecordSuccess 记录请求成功，清除冷却
 func (p *AccountPool) RecordSuccess(id string) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	delete(p.cooldowns, id)
-	p.errorCounts[id] = 0
-}
-
-// RecordError 记录请求错误，设置冷却
-func (p *AccountPool) RecordError(id string, isQuotaError bool) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	p.errorCounts[id]++
-
-	if isQuotaError {
-		// 配额错误，冷却 1 小时
-		p.cooldowns[id] = time.Now().Add(time.Hour)
-	} else if p.errorCounts[id] >= 3 {
-		// 连续 3 次错误，冷却 1 分钟
-		p.cooldowns[id] = time.Now().Add(time.Minute)
-	}
+	p.ClearCooldown(id, "request succeeded")
 }
 
 // UpdateToken 更新账号 Token
@@ -218,7 +295,7 @@ func (p *AccountPool) AvailableCount() int {
 	now := time.Now()
 	count := 0
 	for _, acc := range p.accounts {
-		if cooldown, ok := p.cooldowns[acc.ID]; ok && now.Before(cooldown) {
+		if p.coolingDown(acc.ID, now) {
 			continue
 		}
 		count++
@@ -0,0 +1,188 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"kiro-api-proxy/config"
+	"time"
+)
+
+// ErrQueueTimeout 所有账号都已满载或被限速，排队超时
+var ErrQueueTimeout = errors.New("all accounts are at their concurrency or rate limit, timed out waiting in queue")
+
+// queueStats 排队统计
+type queueStats struct {
+	depth     int           // 当前排队请求数
+	served    int           // 排队后拿到账号的请求数
+	timedOut  int           // 排队超时的请求数
+	totalWait time.Duration // 排队后拿到账号的累计等待时间
+	maxWait   time.Duration // 最长等待时间
+}
+
+// QueueStats 排队统计（管理 API 使用）
+type QueueStats struct {
+	Depth     int   `json:"depth"`
+	Served    int   `json:"served"`
+	TimedOut  int   `json:"timedOut"`
+	AvgWaitMs int64 `json:"avgWaitMs"`
+	MaxWaitMs int64 `json:"maxWaitMs"`
+}
+
+// concurrencyLimit 账号并发上限，账号未设置时使用默认值，0 为不限制
+func concurrencyLimit(acc *config.Account, defaultLimit int) int {
+	if acc.MaxConcurrent > 0 {
+		return acc.MaxConcurrent
+	}
+	return defaultLimit
+}
+
+// saturated 账号是否已达并发上限（需持有读锁）
+func (p *AccountPool) saturated(acc *config.Account, defaultLimit int) bool {
+	limit := concurrencyLimit(acc, defaultLimit)
+	return limit > 0 && p.inFlight[acc.ID] >= limit
+}
+
+// notifySlotFreed 唤醒所有排队的请求（需持有写锁）
+func (p *AccountPool) notifySlotFreed() {
+	close(p.slotFreed)
+	p.slotFreed = make(chan struct{})
+}
+
+// Acquire 按选择条件选择账号、占用一个并发槽位并扣除一次请求限速，返回的 release 用于请求结束时释放
+// 符合条件的账号都已满载或被限速时排队等待，直到 ctx 取消或超过排队超时（返回 ErrQueueTimeout）
+// 没有符合条件的账号时返回 nil 账号与 nil 错误
+func (p *AccountPool) Acquire(ctx context.Context, opts SelectOptions) (*config.Account, func(), error) {
+	_, queueTimeout := config.GetConcurrencyConfig()
+	var (
+		timer   *time.Timer
+		refill  *time.Timer // 被限速账号的恢复定时器，整个等待过程复用
+		waiting bool
+		start   time.Time
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		if refill != nil {
+			refill.Stop()
+		}
+	}()
+
+	for {
+		strategy := p.strategy()
+		p.mu.Lock()
+		now := time.Now()
+		acc, busy, retryIn := p.selectLocked(strategy, opts, now)
+		if acc != nil || !busy {
+			if waiting {
+				p.queue.depth--
+				if acc != nil {
+					wait := now.Sub(start)
+					p.queue.served++
+					p.queue.totalWait += wait
+					p.queue.maxWait = max(p.queue.maxWait, wait)
+				}
+			}
+			if acc == nil {
+				p.mu.Unlock()
+				return nil, func() {}, nil
+			}
+			p.inFlight[acc.ID]++
+			p.consumeRequest(acc.ID)
+			p.mu.Unlock()
+			return acc, p.releaser(acc.ID), nil
+		}
+
+		if !waiting {
+			waiting, start = true, now
+			p.queue.depth++
+			timer = time.NewTimer(queueTimeout)
+		}
+		freed := p.slotFreed
+		p.mu.Unlock()
+
+		// 被限速的账号没有释放事件，到恢复时间后重新选择
+		var refilled <-chan time.Time
+		if retryIn > 0 {
+			if refill == nil {
+				refill = time.NewTimer(retryIn)
+			} else {
+				resetTimer(refill, retryIn)
+			}
+			refilled = refill.C
+		}
+
+		select {
+		case <-freed:
+		case <-refilled:
+		case <-timer.C:
+			p.mu.Lock()
+			p.queue.depth--
+			p.queue.timedOut++
+			p.mu.Unlock()
+			return nil, func() {}, ErrQueueTimeout
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.queue.depth--
+			p.mu.Unlock()
+			return nil, func() {}, ctx.Err()
+		}
+	}
+}
+
+// resetTimer 停止定时器并清空未读取的触发，再按 d 重新计时
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// releaser 返回释放账号并发槽位的函数，多次调用只释放一次
+func (p *AccountPool) releaser(id string) func() {
+	released := false
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if released {
+			return
+		}
+		released = true
+		if p.inFlight[id] > 0 {
+			p.inFlight[id]--
+		}
+		p.notifySlotFreed()
+	}
+}
+
+// InFlight 返回各账号正在处理的请求数
+func (p *AccountPool) InFlight() map[string]int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	result := make(map[string]int, len(p.inFlight))
+	for id, n := range p.inFlight {
+		if n > 0 {
+			result[id] = n
+		}
+	}
+	return result
+}
+
+// GetQueueStats 返回排队统计
+func (p *AccountPool) GetQueueStats() QueueStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	stats := QueueStats{
+		Depth:     p.queue.depth,
+		Served:    p.queue.served,
+		TimedOut:  p.queue.timedOut,
+		MaxWaitMs: p.queue.maxWait.Milliseconds(),
+	}
+	if p.queue.served > 0 {
+		stats.AvgWaitMs = (p.queue.totalWait / time.Duration(p.queue.served)).Milliseconds()
+	}
+	return stats
+}
@@ -0,0 +1,182 @@
+package pool
+
+import (
+	"kiro-api-proxy/config"
+	"time"
+)
+
+// ErrorKind 请求失败类型，决定冷却策略
+type ErrorKind int
+
+const (
+	ErrorTransient      ErrorKind = iota // 网络错误、5xx 等临时错误
+	ErrorRateLimited                     // 上游限流（429 throttling）
+	ErrorQuotaExhausted                  // 账号额度用尽
+)
+
+// 冷却原因
+const (
+	CooldownTransient      = "transient_errors"
+	CooldownRateLimited    = "rate_limited"
+	CooldownQuotaExhausted = "quota_exhausted"
+)
+
+const (
+	// 连续临时错误达到该次数后开始冷却，冷却时间从 transientBaseCooldown 起指数增长
+	transientErrorThreshold = 2
+	transientBaseCooldown   = 5 * time.Second
+	transientMaxCooldown    = 5 * time.Minute
+
+	// 限流未给出 Retry-After 时的冷却时间，连续限流时指数增长
+	rateLimitBaseCooldown = 30 * time.Second
+	rateLimitMaxCooldown  = 10 * time.Minute
+
+	// 额度用尽但无法确定重置时间时的冷却时间
+	quotaFallbackCooldown = time.Hour
+)
+
+// Cooldown 账号冷却状态
+type Cooldown struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+// coolingDown 账号是否在冷却中（需持有读锁）
+func (p *AccountPool) coolingDown(id string, now time.Time) bool {
+	cooldown, ok := p.cooldowns[id]
+	return ok && now.Before(cooldown.Until)
+}
+
+// RecordError 记录请求错误并按错误类型设置冷却
+// retryAfter 为上游给出的重试等待时间（Retry-After），未给出时为 0
+func (p *AccountPool) RecordError(id string, kind ErrorKind, retryAfter time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.errorCounts[id]++
+	count := p.errorCounts[id]
+	now := time.Now()
+	p.lastErrors[id] = now
+	p.markDirty()
+
+	var acc *config.Account
+	for i := range p.accounts {
+		if p.accounts[i].ID == id {
+			acc = &p.accounts[i]
+			break
+		}
+	}
+	// 429 且账号已知额度用尽时按额度用尽处理
+	if kind == ErrorRateLimited && acc != nil && quotaExhausted(acc) {
+		kind = ErrorQuotaExhausted
+	}
+
+	cooldown := Cooldown{Since: now}
+	switch kind {
+	case ErrorQuotaExhausted:
+		cooldown.Reason = CooldownQuotaExhausted
+		cooldown.Until = now.Add(max(retryAfter, quotaFallbackCooldown))
+		if acc != nil {
+			if reset, ok := quotaResetTime(acc, now); ok {
+				cooldown.Until = reset
+			}
+		}
+	case ErrorRateLimited:
+		cooldown.Reason = CooldownRateLimited
+		if retryAfter > 0 {
+			cooldown.Until = now.Add(retryAfter)
+		} else {
+			cooldown.Until = now.Add(backoff(rateLimitBaseCooldown, rateLimitMaxCooldown, count-1))
+		}
+	default:
+		if count < transientErrorThreshold {
+			return
+		}
+		cooldown.Reason = CooldownTransient
+		cooldown.Until = now.Add(backoff(transientBaseCooldown, transientMaxCooldown, count-transientErrorThreshold))
+	}
+
+	// 不缩短已有的更长冷却（如额度冷却期间的并发请求又收到限流）
+	if existing, ok := p.cooldowns[id]; ok && existing.Until.After(cooldown.Until) {
+		return
+	}
+	p.cooldowns[id] = cooldown
+	state, reason := cooldownState(cooldown)
+	p.transitionLocked(id, state, reason, now)
+}
+
+// ClearCooldown 清除账号冷却与错误计数，账号回到 active
+func (p *AccountPool) ClearCooldown(id, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.cooldowns[id]; ok || p.errorCounts[id] > 0 {
+		delete(p.cooldowns, id)
+		p.errorCounts[id] = 0
+		p.markDirty()
+	}
+	p.leaveCooldownLocked(id, reason, time.Now())
+}
+
+// GetCooldowns 返回所有冷却中的账号状态
+func (p *AccountPool) GetCooldowns() map[string]Cooldown {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	now := time.Now()
+	result := make(map[string]Cooldown)
+	for id, cooldown := range p.cooldowns {
+		if now.Before(cooldown.Until) {
+			result[id] = cooldown
+		}
+	}
+	return result
+}
+
+// releaseRecoveredQuota 刷新后的账号信息显示额度已恢复时解除额度冷却（需持有写锁）
+func (p *AccountPool) releaseRecoveredQuota() {
+	for i := range p.accounts {
+		acc := &p.accounts[i]
+		cooldown, ok := p.cooldowns[acc.ID]
+		if !ok || cooldown.Reason != CooldownQuotaExhausted {
+			continue
+		}
+		// 只信任冷却开始之后刷新的账号信息
+		if acc.LastRefresh > cooldown.Since.Unix() && acc.UsageLimit > 0 && !quotaExhausted(acc) {
+			delete(p.cooldowns, acc.ID)
+			p.errorCounts[acc.ID] = 0
+			p.markDirty()
+			p.leaveCooldownLocked(acc.ID, "quota available again", time.Now())
+		}
+	}
+}
+
+// quotaExhausted 账号信息显示额度已用尽（试用额度有效时计入试用额度）
+func quotaExhausted(acc *config.Account) bool {
+	used, limit := acc.UsageCurrent, acc.UsageLimit
+	if acc.TrialStatus == "ACTIVE" {
+		used += acc.TrialUsageCurrent
+		limit += acc.TrialUsageLimit
+	}
+	return limit > 0 && used >= limit
+}
+
+// quotaResetTime 解析额度重置日期（YYYY-MM-DD，本地时间零点），已过期或无法解析时返回 false
+func quotaResetTime(acc *config.Account, now time.Time) (time.Time, bool) {
+	if acc.NextResetDate == "" {
+		return time.Time{}, false
+	}
+	reset, err := time.ParseInLocation("2006-01-02", acc.NextResetDate, time.Local)
+	if err != nil || !reset.After(now) {
+		return time.Time{}, false
+	}
+	return reset, true
+}
+
+// backoff 返回 base * 2^n，不超过 limit
+func backoff(base, limit time.Duration, n int) time.Duration {
+	d := base
+	for i := 0; i < n && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
@@ -0,0 +1,77 @@
+package pool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name        string
+		base, limit time.Duration
+		n           int
+		want        time.Duration
+	}{
+		{name: "first", base: 5 * time.Second, limit: 5 * time.Minute, n: 0, want: 5 * time.Second},
+		{name: "doubles", base: 5 * time.Second, limit: 5 * time.Minute, n: 3, want: 40 * time.Second},
+		{name: "capped", base: 5 * time.Second, limit: 5 * time.Minute, n: 6, want: 5 * time.Minute},
+		{name: "large n stays capped", base: 30 * time.Second, limit: 10 * time.Minute, n: 1000, want: 10 * time.Minute},
+		{name: "negative n", base: 30 * time.Second, limit: 10 * time.Minute, n: -1, want: 30 * time.Second},
+		{name: "base above limit", base: time.Hour, limit: time.Minute, n: 0, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backoff(tt.base, tt.limit, tt.n); got != tt.want {
+				t.Fatalf("backoff(%v, %v, %d) = %v, want %v", tt.base, tt.limit, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordErrorCooldown(t *testing.T) {
+	tests := []struct {
+		name       string
+		kind       ErrorKind
+		retryAfter time.Duration
+		errors     int
+		wantReason string
+		wantMin    time.Duration
+		wantMax    time.Duration
+	}{
+		{name: "single transient error", kind: ErrorTransient, errors: 1},
+		{name: "transient threshold", kind: ErrorTransient, errors: 2, wantReason: CooldownTransient, wantMin: 5 * time.Second, wantMax: 5 * time.Second},
+		{name: "transient backoff", kind: ErrorTransient, errors: 4, wantReason: CooldownTransient, wantMin: 20 * time.Second, wantMax: 20 * time.Second},
+		{name: "rate limited", kind: ErrorRateLimited, errors: 1, wantReason: CooldownRateLimited, wantMin: 30 * time.Second, wantMax: 30 * time.Second},
+		{name: "rate limited backoff", kind: ErrorRateLimited, errors: 3, wantReason: CooldownRateLimited, wantMin: 2 * time.Minute, wantMax: 2 * time.Minute},
+		{name: "retry-after wins", kind: ErrorRateLimited, retryAfter: 7 * time.Second, errors: 1, wantReason: CooldownRateLimited, wantMin: 7 * time.Second, wantMax: 7 * time.Second},
+		{name: "quota fallback", kind: ErrorQuotaExhausted, errors: 1, wantReason: CooldownQuotaExhausted, wantMin: time.Hour, wantMax: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := newTestAccount(t)
+			p := newAccountPool()
+			p.Reload()
+			for i := 0; i < tt.errors; i++ {
+				p.RecordError(id, tt.kind, tt.retryAfter)
+			}
+
+			cooldown, ok := p.GetCooldowns()[id]
+			if tt.wantReason == "" {
+				if ok {
+					t.Fatalf("unexpected cooldown %+v", cooldown)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("expected a cooldown")
+			}
+			if cooldown.Reason != tt.wantReason {
+				t.Fatalf("reason = %s, want %s", cooldown.Reason, tt.wantReason)
+			}
+			// Since 为最后一次错误时间，冷却时长按其计算
+			if d := cooldown.Until.Sub(cooldown.Since); d < tt.wantMin || d > tt.wantMax {
+				t.Fatalf("cooldown = %v, want between %v and %v", d, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package pool
+
+import (
+	"fmt"
+	"kiro-api-proxy/config"
+	"sort"
+	"time"
+)
+
+// AccountState 账号生命周期状态
+type AccountState string
+
+const (
+	StateActive          AccountState = config.StateActive          // 正常可用
+	StateCoolingDown     AccountState = "cooling_down"              // 请求错误或上游限流导致的临时冷却
+	StateQuotaExhausted  AccountState = "quota_exhausted"           // 额度用尽，等待额度重置
+	StateAuthFailed      AccountState = config.StateAuthFailed      // Token 失效且无法刷新，需要重新登录
+	StateSuspended       AccountState = config.StateSuspended       // 被上游暂停
+	StateDisabledByAdmin AccountState = config.StateDisabledByAdmin // 被管理员禁用
+)
+
+// 每个账号保留的状态变更记录数
+const maxTransitions = 50
+
+// allowedTransitions 允许的状态变更
+// 冷却状态只由账号池根据请求结果进入和退出；管理员禁用的账号只能由管理员重新启用
+var allowedTransitions = map[AccountState][]AccountState{
+	StateActive:          {StateCoolingDown, StateQuotaExhausted, StateAuthFailed, StateSuspended, StateDisabledByAdmin},
+	StateCoolingDown:     {StateActive, StateQuotaExhausted, StateAuthFailed, StateSuspended, StateDisabledByAdmin},
+	StateQuotaExhausted:  {StateActive, StateAuthFailed, StateSuspended, StateDisabledByAdmin},
+	StateAuthFailed:      {StateActive, StateSuspended, StateDisabledByAdmin},
+	StateSuspended:       {StateActive, StateAuthFailed, StateDisabledByAdmin},
+	StateDisabledByAdmin: {StateActive},
+}
+
+// CanTransition 是否允许从 from 变更为 to
+func CanTransition(from, to AccountState) bool {
+	for _, s := range allowedTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StateInfo 账号当前状态
+type StateInfo struct {
+	State  AccountState `json:"state"`
+	Reason string       `json:"reason,omitempty"`
+	Since  time.Time    `json:"since"`
+}
+
+// Transition 一次状态变更
+type Transition struct {
+	AccountID string       `json:"accountId"`
+	Time      time.Time    `json:"time"`
+	From      AccountState `json:"from"`
+	To        AccountState `json:"to"`
+	Reason    string       `json:"reason,omitempty"`
+}
+
+// isCooldownState 是否为由冷却决定的运行时状态
+func isCooldownState(s AccountState) bool {
+	return s == StateCoolingDown || s == StateQuotaExhausted
+}
+
+// cooldownState 冷却对应的状态与原因
+func cooldownState(cooldown Cooldown) (AccountState, string) {
+	state := StateCoolingDown
+	if cooldown.Reason == CooldownQuotaExhausted {
+		state = StateQuotaExhausted
+	}
+	return state, fmt.Sprintf("%s until %s", cooldown.Reason, cooldown.Until.Format(time.RFC3339))
+}
+
+// persistedState 配置中保存的账号状态，Enabled 优先
+func persistedState(acc *config.Account) AccountState {
+	switch {
+	case acc.Enabled:
+		return StateActive
+	case acc.State != "" && acc.State != config.StateActive:
+		return AccountState(acc.State)
+	default:
+		return StateDisabledByAdmin
+	}
+}
+
+// recordStateLocked 设置账号状态并记录变更（需持有写锁）
+// 首次出现的账号只设置初始状态，不记录变更
+func (p *AccountPool) recordStateLocked(id string, to AccountState, reason string, at time.Time) {
+	current, ok := p.states[id]
+	if ok && current.State == to {
+		return
+	}
+	p.states[id] = StateInfo{State: to, Reason: reason, Since: at}
+	if !ok {
+		return
+	}
+	history := append(p.transitions[id], Transition{AccountID: id, Time: at, From: current.State, To: to, Reason: reason})
+	if len(history) > maxTransitions {
+		history = history[len(history)-maxTransitions:]
+	}
+	p.transitions[id] = history
+	p.markDirty()
+	fmt.Printf("[Pool] Account %s: %s -> %s (%s)\n", id, current.State, to, reason)
+}
+
+// transitionLocked 按允许的状态变更设置账号状态，不允许时忽略（需持有写锁）
+func (p *AccountPool) transitionLocked(id string, to AccountState, reason string, at time.Time) bool {
+	current, ok := p.states[id]
+	if !ok || (current.State != to && !CanTransition(current.State, to)) {
+		return false
+	}
+	p.recordStateLocked(id, to, reason, at)
+	return true
+}
+
+// leaveCooldownLocked 冷却结束后回到 active（需持有写锁）
+func (p *AccountPool) leaveCooldownLocked(id, reason string, at time.Time) {
+	if isCooldownState(p.states[id].State) {
+		p.recordStateLocked(id, StateActive, reason, at)
+	}
+}
+
+// syncExpiredLocked 将冷却已到期的账号变更为 active（需持有写锁）
+func (p *AccountPool) syncExpiredLocked(now time.Time) {
+	for id, info := range p.states {
+		if !isCooldownState(info.State) || p.coolingDown(id, now) {
+			continue
+		}
+		at := now
+		if cooldown, ok := p.cooldowns[id]; ok && cooldown.Until.After(info.Since) {
+			at = cooldown.Until
+		}
+		p.recordStateLocked(id, StateActive, "cooldown expired", at)
+	}
+}
+
+// syncStatesLocked 按配置同步账号状态，移除已删除账号的状态（需持有写锁）
+func (p *AccountPool) syncStatesLocked(accounts []config.Account, now time.Time) {
+	p.syncExpiredLocked(now)
+	seen := make(map[string]bool, len(accounts))
+	for i := range accounts {
+		acc := &accounts[i]
+		seen[acc.ID] = true
+		to := persistedState(acc)
+		if to == StateActive {
+			// 启用的账号保留仍有效的冷却状态
+			if cooldown, ok := p.cooldowns[acc.ID]; ok && now.Before(cooldown.Until) {
+				if current, ok := p.states[acc.ID]; ok && isCooldownState(current.State) {
+					continue
+				}
+				to, reason := cooldownState(cooldown)
+				p.recordStateLocked(acc.ID, to, reason, cooldown.Since)
+				continue
+			}
+		}
+		at := now
+		if acc.StateSince > 0 {
+			at = time.Unix(acc.StateSince, 0)
+		}
+		p.recordStateLocked(acc.ID, to, acc.StateReason, at)
+	}
+	for id := range p.states {
+		if !seen[id] {
+			delete(p.states, id)
+			delete(p.transitions, id)
+			p.markDirty()
+		}
+	}
+}
+
+// SetState 将账号变更为持久化状态（active、auth_failed、suspended、disabled_by_admin）并保存到配置
+// 冷却状态由账号池管理，不能直接设置；不允许的状态变更返回错误
+func (p *AccountPool) SetState(id string, to AccountState, reason string) error {
+	if _, ok := allowedTransitions[to]; !ok || isCooldownState(to) {
+		return fmt.Errorf("cannot set account state to %q", to)
+	}
+
+	p.mu.Lock()
+	current, ok := p.states[id]
+	if !ok {
+		p.mu.Unlock()
+		return fmt.Errorf("account %s not found", id)
+	}
+	if current.State == to {
+		p.mu.Unlock()
+		return nil
+	}
+	if !CanTransition(current.State, to) {
+		p.mu.Unlock()
+		return fmt.Errorf("cannot change account state from %s to %s", current.State, to)
+	}
+	p.recordStateLocked(id, to, reason, time.Now())
+	// 重新启用的账号不沿用之前的冷却
+	if to == StateActive {
+		delete(p.cooldowns, id)
+		p.errorCounts[id] = 0
+	}
+	p.mu.Unlock()
+
+	if err := config.SetAccountState(id, string(to), reason); err != nil {
+		return err
+	}
+	p.Reload()
+	return nil
+}
+
+// States 返回所有账号的当前状态
+func (p *AccountPool) States() map[string]StateInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.syncExpiredLocked(time.Now())
+	result := make(map[string]StateInfo, len(p.states))
+	for id, info := range p.states {
+		result[id] = info
+	}
+	return result
+}
+
+// State 返回账号当前状态
+func (p *AccountPool) State(id string) (StateInfo, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.syncExpiredLocked(time.Now())
+	info, ok := p.states[id]
+	return info, ok
+}
+
+// Transitions 返回最近的状态变更（按时间倒序），id 为空时返回所有账号，limit <= 0 时不限制条数
+func (p *AccountPool) Transitions(id string, limit int) []Transition {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.syncExpiredLocked(time.Now())
+	var result []Transition
+	for accID, history := range p.transitions {
+		if id == "" || accID == id {
+			result = append(result, history...)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.After(result[j].Time)
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
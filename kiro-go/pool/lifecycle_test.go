@@ -0,0 +1,166 @@
+package pool
+
+import (
+	"fmt"
+	"kiro-api-proxy/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "kiro-pool-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := config.Init(filepath.Join(dir, "config.json")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestAccount 在配置中添加一个启用的账号，测试结束时删除
+func newTestAccount(t *testing.T) string {
+	t.Helper()
+	id := fmt.Sprintf("acc-%s", t.Name())
+	if err := config.AddAccount(config.Account{ID: id, Email: id + "@example.com", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { config.DeleteAccount(id) })
+	return id
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to AccountState
+		want     bool
+	}{
+		{StateActive, StateCoolingDown, true},
+		{StateActive, StateQuotaExhausted, true},
+		{StateActive, StateAuthFailed, true},
+		{StateActive, StateDisabledByAdmin, true},
+		{StateCoolingDown, StateActive, true},
+		{StateCoolingDown, StateQuotaExhausted, true},
+		{StateQuotaExhausted, StateCoolingDown, false},
+		{StateQuotaExhausted, StateActive, true},
+		{StateAuthFailed, StateActive, true},
+		{StateAuthFailed, StateQuotaExhausted, false},
+		{StateSuspended, StateAuthFailed, true},
+		{StateSuspended, StateCoolingDown, false},
+		{StateDisabledByAdmin, StateActive, true},
+		{StateDisabledByAdmin, StateSuspended, false},
+		{StateDisabledByAdmin, StateAuthFailed, false},
+		{StateActive, StateActive, false},
+		{AccountState("unknown"), StateActive, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s->%s", tt.from, tt.to), func(t *testing.T) {
+			if got := CanTransition(tt.from, tt.to); got != tt.want {
+				t.Fatalf("CanTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedTransitionsTargetsAreStates(t *testing.T) {
+	for from, targets := range allowedTransitions {
+		for _, to := range targets {
+			if _, ok := allowedTransitions[to]; !ok {
+				t.Errorf("%s -> %s: target state has no transitions defined", from, to)
+			}
+			if to == from {
+				t.Errorf("%s lists itself as a transition target", from)
+			}
+		}
+	}
+}
+
+func TestSetState(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    AccountState
+		to      AccountState
+		wantErr bool
+		want    AccountState
+		enabled bool
+	}{
+		{name: "disable active", from: StateActive, to: StateDisabledByAdmin, want: StateDisabledByAdmin},
+		{name: "enable disabled", from: StateDisabledByAdmin, to: StateActive, want: StateActive, enabled: true},
+		{name: "auth failure", from: StateActive, to: StateAuthFailed, want: StateAuthFailed},
+		{name: "recover suspended", from: StateSuspended, to: StateActive, want: StateActive, enabled: true},
+		{name: "clear cooldown by enabling", from: StateCoolingDown, to: StateActive, want: StateActive, enabled: true},
+		{name: "same state is a no-op", from: StateActive, to: StateActive, want: StateActive, enabled: true},
+		{name: "disabled cannot be suspended", from: StateDisabledByAdmin, to: StateSuspended, wantErr: true, want: StateDisabledByAdmin},
+		{name: "cooldown states are pool managed", from: StateActive, to: StateCoolingDown, wantErr: true, want: StateActive, enabled: true},
+		{name: "unknown state", from: StateActive, to: AccountState("paused"), wantErr: true, want: StateActive, enabled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := newTestAccount(t)
+			p := newAccountPool()
+			p.Reload()
+			if tt.from != StateActive {
+				if tt.from == StateCoolingDown {
+					p.RecordError(id, ErrorRateLimited, time.Minute)
+				} else if err := p.SetState(id, tt.from, "setup"); err != nil {
+					t.Fatalf("setup: %v", err)
+				}
+			}
+			if info, _ := p.State(id); info.State != tt.from {
+				t.Fatalf("setup: state = %s, want %s", info.State, tt.from)
+			}
+
+			err := p.SetState(id, tt.to, "test")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetState error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if info, _ := p.State(id); info.State != tt.want {
+				t.Fatalf("state = %s, want %s", info.State, tt.want)
+			}
+			for _, a := range config.GetAccounts() {
+				if a.ID == id && a.Enabled != tt.enabled {
+					t.Fatalf("config enabled = %v, want %v", a.Enabled, tt.enabled)
+				}
+			}
+		})
+	}
+}
+
+func TestSetStateRecordsTransitions(t *testing.T) {
+	id := newTestAccount(t)
+	p := newAccountPool()
+	p.Reload()
+
+	for _, to := range []AccountState{StateAuthFailed, StateActive, StateDisabledByAdmin} {
+		if err := p.SetState(id, to, "step "+string(to)); err != nil {
+			t.Fatalf("SetState(%s): %v", to, err)
+		}
+	}
+	if err := p.SetState("missing", StateActive, ""); err == nil {
+		t.Fatal("expected error for unknown account")
+	}
+
+	got := p.transitions[id]
+	want := []struct{ from, to AccountState }{
+		{StateActive, StateAuthFailed},
+		{StateAuthFailed, StateActive},
+		{StateActive, StateDisabledByAdmin},
+	}
+	if n := len(p.Transitions(id, 2)); n != 2 {
+		t.Fatalf("Transitions limit: got %d, want 2", n)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d transitions, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].From != w.from || got[i].To != w.to {
+			t.Errorf("transition %d = %s -> %s, want %s -> %s", i, got[i].From, got[i].To, w.from, w.to)
+		}
+	}
+}
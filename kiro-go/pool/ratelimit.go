@@ -0,0 +1,138 @@
+package pool
+
+import (
+	"kiro-api-proxy/config"
+	"math"
+	"time"
+)
+
+// tokenBucket 令牌桶，容量为每分钟上限，按每分钟上限匀速补充
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill 补充令牌，首次使用时为满桶
+func (b *tokenBucket) refill(perMinute int, now time.Time) {
+	capacity := float64(perMinute)
+	if b.updated.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Minutes()*capacity)
+	}
+	b.updated = now
+}
+
+// waitFor 补充到 need 个令牌所需的时间
+func (b *tokenBucket) waitFor(perMinute int, need float64) time.Duration {
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / float64(perMinute) * float64(time.Minute))
+}
+
+// accountLimiter 单个账号的请求数与输出 token 令牌桶
+type accountLimiter struct {
+	requests tokenBucket
+	tokens   tokenBucket
+}
+
+// RateLimitStatus 账号限速状态（管理 API 使用），未限速的维度为 0
+type RateLimitStatus struct {
+	RequestsPerMinute int `json:"requestsPerMinute"`
+	RequestsAvailable int `json:"requestsAvailable"`
+	TokensPerMinute   int `json:"tokensPerMinute"`
+	TokensAvailable   int `json:"tokensAvailable"`
+}
+
+// rateLimits 账号每分钟请求数与输出 token 上限，账号未设置时使用默认值
+func rateLimits(acc *config.Account, defaultRPM, defaultTPM int) (rpm, tpm int) {
+	rpm, tpm = defaultRPM, defaultTPM
+	if acc.RequestsPerMinute > 0 {
+		rpm = acc.RequestsPerMinute
+	}
+	if acc.TokensPerMinute > 0 {
+		tpm = acc.TokensPerMinute
+	}
+	return rpm, tpm
+}
+
+// limiter 获取账号令牌桶并按当前上限补充（需持有写锁）
+func (p *AccountPool) limiter(acc *config.Account, rpm, tpm int, now time.Time) *accountLimiter {
+	l, ok := p.limiters[acc.ID]
+	if !ok {
+		l = &accountLimiter{}
+		p.limiters[acc.ID] = l
+	}
+	if rpm > 0 {
+		l.requests.refill(rpm, now)
+	}
+	if tpm > 0 {
+		l.tokens.refill(tpm, now)
+	}
+	return l
+}
+
+// rateLimitWait 账号被限速时返回恢复可用所需的时间，未限速时返回 0（需持有写锁）
+// 输出 token 在请求结束后才扣除，令牌桶可以为负，恢复为正后账号才可用
+func (p *AccountPool) rateLimitWait(acc *config.Account, defaultRPM, defaultTPM int, now time.Time) time.Duration {
+	rpm, tpm := rateLimits(acc, defaultRPM, defaultTPM)
+	if rpm <= 0 && tpm <= 0 {
+		return 0
+	}
+	l := p.limiter(acc, rpm, tpm, now)
+	var wait time.Duration
+	if rpm > 0 {
+		wait = l.requests.waitFor(rpm, 1)
+	}
+	if tpm > 0 && l.tokens.tokens <= 0 {
+		wait = max(wait, l.tokens.waitFor(tpm, 1))
+	}
+	return wait
+}
+
+// consumeRequest 扣除一次请求（需持有写锁，须在 rateLimitWait 之后调用）
+func (p *AccountPool) consumeRequest(id string) {
+	if l, ok := p.limiters[id]; ok && !l.requests.updated.IsZero() {
+		l.requests.tokens--
+	}
+}
+
+// RecordOutputTokens 请求结束后扣除输出 token
+func (p *AccountPool) RecordOutputTokens(id string, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l, ok := p.limiters[id]; ok && !l.tokens.updated.IsZero() {
+		l.tokens.tokens -= float64(tokens)
+	}
+}
+
+// GetRateLimits 返回已配置限速的账号当前令牌桶水位
+func (p *AccountPool) GetRateLimits() map[string]RateLimitStatus {
+	defaultRPM, defaultTPM := config.GetRateLimitConfig()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	result := make(map[string]RateLimitStatus)
+	for i := range p.accounts {
+		acc := &p.accounts[i]
+		rpm, tpm := rateLimits(acc, defaultRPM, defaultTPM)
+		if rpm <= 0 && tpm <= 0 {
+			continue
+		}
+		l := p.limiter(acc, rpm, tpm, now)
+		status := RateLimitStatus{RequestsPerMinute: rpm, TokensPerMinute: tpm}
+		if rpm > 0 {
+			status.RequestsAvailable = int(math.Floor(l.requests.tokens))
+		}
+		if tpm > 0 {
+			status.TokensAvailable = int(math.Floor(l.tokens.tokens))
+		}
+		result[acc.ID] = status
+	}
+	return result
+}
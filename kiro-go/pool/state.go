@@ -0,0 +1,147 @@
+package pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"kiro-api-proxy/config"
+	"os"
+	"time"
+)
+
+const (
+	// 冷却、错误计数与状态变更记录持久化文件，与配置文件同目录
+	stateFileName = "pool_state.json"
+	// 状态变化后延迟写入，合并短时间内的多次变化
+	stateSaveDelay = time.Second
+	// 连续错误计数的有效期，超过后重启不再恢复
+	errorCountTTL = 10 * time.Minute
+)
+
+// accountState 单个账号持久化的健康状态
+type accountState struct {
+	Cooldown    *Cooldown `json:"cooldown,omitempty"`
+	ErrorCount  int       `json:"errorCount,omitempty"`
+	LastErrorAt int64     `json:"lastErrorAt,omitempty"`
+
+	Transitions []Transition `json:"transitions,omitempty"`
+}
+
+// poolState 持久化的账号池状态
+type poolState struct {
+	SavedAt  int64                   `json:"savedAt"`
+	Accounts map[string]accountState `json:"accounts"`
+}
+
+// markDirty 标记状态已变化，延迟写入磁盘（需持有写锁）
+func (p *AccountPool) markDirty() {
+	if p.saveTimer == nil {
+		p.saveTimer = time.AfterFunc(stateSaveDelay, p.saveState)
+	}
+}
+
+// snapshotState 收集未过期的冷却、错误计数与状态变更记录（需持有读锁）
+func (p *AccountPool) snapshotState(now time.Time) poolState {
+	state := poolState{SavedAt: now.Unix(), Accounts: map[string]accountState{}}
+	for id, cooldown := range p.cooldowns {
+		if now.Before(cooldown.Until) {
+			c := cooldown
+			s := state.Accounts[id]
+			s.Cooldown = &c
+			state.Accounts[id] = s
+		}
+	}
+	for id, count := range p.errorCounts {
+		if count > 0 && now.Sub(p.lastErrors[id]) < errorCountTTL {
+			s := state.Accounts[id]
+			s.ErrorCount = count
+			s.LastErrorAt = p.lastErrors[id].Unix()
+			state.Accounts[id] = s
+		}
+	}
+	for id, history := range p.transitions {
+		s := state.Accounts[id]
+		s.Transitions = history
+		state.Accounts[id] = s
+	}
+	return state
+}
+
+// saveState 将冷却与错误计数写入状态文件
+func (p *AccountPool) saveState() {
+	path := config.DataPath(stateFileName)
+
+	p.mu.Lock()
+	p.saveTimer = nil
+	state := p.snapshotState(time.Now())
+	p.mu.Unlock()
+
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return
+	}
+
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+	// 先写临时文件再替换，避免中途退出留下损坏的文件
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		fmt.Printf("[Pool] Failed to save state: %v\n", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		fmt.Printf("[Pool] Failed to save state: %v\n", err)
+	}
+}
+
+// loadState 启动时恢复未过期的冷却、错误计数与状态变更记录（需在 Reload 之后调用）
+func (p *AccountPool) loadState() {
+	path := config.DataPath(stateFileName)
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("[Pool] Failed to load state: %v\n", err)
+		}
+		return
+	}
+	var state poolState
+	if err := json.Unmarshal(data, &state); err != nil {
+		fmt.Printf("[Pool] Failed to parse state: %v\n", err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	restored := 0
+	for id, s := range state.Accounts {
+		info, known := p.states[id]
+		if !known {
+			continue
+		}
+		p.transitions[id] = s.Transitions
+		if s.Cooldown != nil && now.Before(s.Cooldown.Until) {
+			p.cooldowns[id] = *s.Cooldown
+			restored++
+			// 恢复冷却状态，不记录新的变更
+			if info.State == StateActive {
+				state, reason := cooldownState(*s.Cooldown)
+				p.states[id] = StateInfo{State: state, Reason: reason, Since: s.Cooldown.Since}
+			}
+		} else if n := len(s.Transitions); n > 0 && isCooldownState(s.Transitions[n-1].To) && info.State == StateActive {
+			p.transitions[id] = append(s.Transitions, Transition{AccountID: id, Time: now, From: s.Transitions[n-1].To, To: StateActive, Reason: "cooldown expired while stopped"})
+		}
+		if lastError := time.Unix(s.LastErrorAt, 0); s.ErrorCount > 0 && now.Sub(lastError) < errorCountTTL {
+			p.errorCounts[id] = s.ErrorCount
+			p.lastErrors[id] = lastError
+		}
+	}
+	if restored > 0 {
+		fmt.Printf("[Pool] Restored %d account cooldowns\n", restored)
+	}
+}
@@ -0,0 +1,254 @@
+package pool
+
+import (
+	"kiro-api-proxy/config"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 选择策略名称
+const (
+	StrategyDrainFirst        = "drain-first"
+	StrategyRoundRobin        = "round-robin"
+	StrategyLeastRecentlyUsed = "least-recently-used"
+	StrategyLeastInFlight     = "least-in-flight"
+	StrategyUsageBalancing    = "usage-balancing"
+	StrategyWeightedRandom    = "weighted-random"
+)
+
+// DefaultStrategy 未配置时使用的策略
+const DefaultStrategy = StrategyDrainFirst
+
+const (
+	primaryUsageThreshold = 10
+	topCandidateLimit     = 3
+)
+
+// Candidate 参与选择的账号及其运行时状态
+type Candidate struct {
+	Account      *config.Account
+	InFlight     int       // 正在处理的请求数
+	LastSelected time.Time // 最近一次被选中的时间，从未选中时为零值
+}
+
+// Strategy 账号选择策略
+// Pick 从已过滤（未冷却、未排除、支持模型）的候选中选择一个，候选为空时返回 nil
+type Strategy interface {
+	Name() string
+	Pick(candidates []Candidate) *config.Account
+}
+
+func newStrategies() map[string]Strategy {
+	strategies := map[string]Strategy{}
+	for _, s := range []Strategy{
+		drainFirst{},
+		&roundRobin{},
+		leastRecentlyUsed{},
+		leastInFlight{},
+		usageBalancing{},
+		weightedRandom{},
+	} {
+		strategies[s.Name()] = s
+	}
+	return strategies
+}
+
+// StrategyNames 返回所有可用策略名称
+func StrategyNames() []string {
+	return []string{
+		StrategyDrainFirst,
+		StrategyRoundRobin,
+		StrategyLeastRecentlyUsed,
+		StrategyLeastInFlight,
+		StrategyUsageBalancing,
+		StrategyWeightedRandom,
+	}
+}
+
+// IsValidStrategy 策略名称是否有效
+func IsValidStrategy(name string) bool {
+	for _, n := range StrategyNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// strategy 返回配置中的当前策略，未知名称时使用默认策略
+func (p *AccountPool) strategy() Strategy {
+	if s, ok := p.strategies[config.GetSelectionStrategy()]; ok {
+		return s
+	}
+	return p.strategies[DefaultStrategy]
+}
+
+func accountWeight(a *config.Account) int {
+	if a.Weight <= 0 {
+		return 100
+	}
+	return a.Weight
+}
+
+// pickWeighted 在候选中按权重随机
+func pickWeighted(candidates []*config.Account) *config.Account {
+	if len(candidates) == 0 {
+		return nil
+	}
+	totalWeight := 0
+	for _, a := range candidates {
+		totalWeight += accountWeight(a)
+	}
+	r := rand.Intn(totalWeight)
+	for _, a := range candidates {
+		r -= accountWeight(a)
+		if r < 0 {
+			return a
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// pickMin 选择 less 意义下最小的候选，并列时按权重随机
+func pickMin(candidates []Candidate, less func(a, b Candidate) bool) *config.Account {
+	var best []*config.Account
+	var lowest Candidate
+	for i, c := range candidates {
+		switch {
+		case i == 0 || less(c, lowest):
+			lowest = c
+			best = append(best[:0], c.Account)
+		case !less(lowest, c):
+			best = append(best, c.Account)
+		}
+	}
+	return pickWeighted(best)
+}
+
+func accounts(candidates []Candidate) []*config.Account {
+	result := make([]*config.Account, len(candidates))
+	for i, c := range candidates {
+		result[i] = c.Account
+	}
+	return result
+}
+
+// drainFirst 主池/兜底池 +（排序优先后的）组内加权随机：
+// 已用额度达到阈值的账号优先，按已用额度降序取前 N 个加权随机，集中消耗同一批账号
+type drainFirst struct{}
+
+func (drainFirst) Name() string { return StrategyDrainFirst }
+
+func (drainFirst) Pick(candidates []Candidate) *config.Account {
+	primary := make([]*config.Account, 0, len(candidates))
+	fallback := make([]*config.Account, 0, len(candidates))
+	for _, c := range candidates {
+		if c.Account.UsageCurrent >= primaryUsageThreshold {
+			primary = append(primary, c.Account)
+		} else {
+			fallback = append(fallback, c.Account)
+		}
+	}
+	if picked := pickWeightedWithRanking(primary); picked != nil {
+		return picked
+	}
+	return pickWeightedWithRanking(fallback)
+}
+
+func pickWeightedWithRanking(candidates []*config.Account) *config.Account {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// 先按积分(usageCurrent) / 更新时间(lastRefresh)排序
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].UsageCurrent == candidates[j].UsageCurrent {
+			return candidates[i].LastRefresh > candidates[j].LastRefresh
+		}
+		return candidates[i].UsageCurrent > candidates[j].UsageCurrent
+	})
+
+	// 只在前N个候选里按权重随机，兼顾“优先”与“分流”
+	limit := topCandidateLimit
+	if len(candidates) < limit {
+		limit = len(candidates)
+	}
+	return pickWeighted(candidates[:limit])
+}
+
+// roundRobin 按池中顺序轮流选择
+type roundRobin struct {
+	mu     sync.Mutex
+	lastID string
+}
+
+func (*roundRobin) Name() string { return StrategyRoundRobin }
+
+func (r *roundRobin) Pick(candidates []Candidate) *config.Account {
+	if len(candidates) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// 选择上次选中账号之后的下一个候选
+	next := 0
+	for i, c := range candidates {
+		if c.Account.ID == r.lastID {
+			next = (i + 1) % len(candidates)
+			break
+		}
+	}
+	r.lastID = candidates[next].Account.ID
+	return candidates[next].Account
+}
+
+// leastRecentlyUsed 选择最久未被选中的账号
+type leastRecentlyUsed struct{}
+
+func (leastRecentlyUsed) Name() string { return StrategyLeastRecentlyUsed }
+
+func (leastRecentlyUsed) Pick(candidates []Candidate) *config.Account {
+	return pickMin(candidates, func(a, b Candidate) bool {
+		return a.LastSelected.Before(b.LastSelected)
+	})
+}
+
+// leastInFlight 选择正在处理请求最少的账号
+type leastInFlight struct{}
+
+func (leastInFlight) Name() string { return StrategyLeastInFlight }
+
+func (leastInFlight) Pick(candidates []Candidate) *config.Account {
+	return pickMin(candidates, func(a, b Candidate) bool {
+		return a.InFlight < b.InFlight
+	})
+}
+
+// usageBalancing 选择额度使用比例最低的账号，使各账号用量趋于均衡
+type usageBalancing struct{}
+
+func (usageBalancing) Name() string { return StrategyUsageBalancing }
+
+func (usageBalancing) Pick(candidates []Candidate) *config.Account {
+	return pickMin(candidates, func(a, b Candidate) bool {
+		return usageRatio(a.Account) < usageRatio(b.Account)
+	})
+}
+
+func usageRatio(a *config.Account) float64 {
+	if a.UsageLimit > 0 {
+		return a.UsageCurrent / a.UsageLimit
+	}
+	return a.UsagePercent
+}
+
+// weightedRandom 在所有候选中按权重随机
+type weightedRandom struct{}
+
+func (weightedRandom) Name() string { return StrategyWeightedRandom }
+
+func (weightedRandom) Pick(candidates []Candidate) *config.Account {
+	return pickWeighted(accounts(candidates))
+}
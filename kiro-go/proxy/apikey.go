@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"kiro-api-proxy/config"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// legacyApiKeyID 旧版单一 API Key（Config.ApiKey）在请求日志中的标识
+const legacyApiKeyID = "legacy"
+
+type apiKeyContextKey struct{}
+
+// apiKeyError API Key 校验失败
+type apiKeyError struct {
+	status  int
+	errType string
+	message string
+}
+
+// apiKeyFromContext 返回请求使用的 API Key 记录，未要求 API Key 时为 nil
+func apiKeyFromContext(ctx context.Context) *config.ApiKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*config.ApiKey)
+	return key
+}
+
+// providedApiKey 从 Authorization 头或 X-Api-Key 头获取客户端提供的 API Key
+func providedApiKey(r *http.Request) string {
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	return r.Header.Get("X-Api-Key")
+}
+
+// validateApiKey 验证 API Key 并检查端点权限，通过后将 API Key 记录附加到请求 context
+// 同时接受旧版单一 API Key 与命名 API Key；未要求 API Key 或未配置任何 API Key 时直接放行
+func (h *Handler) validateApiKey(r *http.Request, endpoint string) (*http.Request, *apiKeyError) {
+	if !config.IsApiKeyRequired() {
+		return r, nil
+	}
+	legacyKey := config.GetApiKey()
+	if legacyKey == "" && len(config.GetApiKeys()) == 0 {
+		return r, nil
+	}
+
+	invalid := &apiKeyError{status: 401, errType: "authentication_error", message: "Invalid or missing API key"}
+	provided := providedApiKey(r)
+	if provided == "" {
+		return r, invalid
+	}
+
+	var key config.ApiKey
+	if legacyKey != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(legacyKey)) == 1 {
+		key = config.ApiKey{ID: legacyApiKeyID, Name: legacyApiKeyID, Enabled: true}
+	} else {
+		found, ok := config.FindApiKey(provided)
+		if !ok || !found.Enabled {
+			return r, invalid
+		}
+		if found.Expired(time.Now()) {
+			return r, &apiKeyError{status: 401, errType: "authentication_error", message: "API key has expired"}
+		}
+		key = found
+	}
+
+	if !key.AllowsEndpoint(endpoint) {
+		return r, &apiKeyError{status: 403, errType: "permission_error", message: fmt.Sprintf("API key is not allowed to access the %s endpoint", endpoint)}
+	}
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, &key)), nil
+}
+
+// checkApiKeyModel 检查请求使用的 API Key 是否允许访问 model
+// 原生模式传入别名解析后的 Kiro 模型 ID；model 为空（无法确定请求模型）时限制了模型的 API Key 一律拒绝
+func checkApiKeyModel(r *http.Request, model string) *apiKeyError {
+	key := apiKeyFromContext(r.Context())
+	if key == nil || len(key.AllowedModels) == 0 {
+		return nil
+	}
+	if model == "" {
+		return &apiKeyError{status: 403, errType: "permission_error", message: "API key is restricted to specific models and the request model could not be determined"}
+	}
+	if !key.AllowsModel(model) {
+		return &apiKeyError{status: 403, errType: "permission_error", message: fmt.Sprintf("API key is not allowed to use model %s", model)}
+	}
+	return nil
+}
+
+// sendApiKeyError 按请求路径对应的 API 格式返回 API Key 错误
+func (h *Handler) sendApiKeyError(w http.ResponseWriter, r *http.Request, e *apiKeyError) {
+	switch path := r.URL.Path; {
+	case strings.HasSuffix(path, "/chat/completions"):
+		h.sendOpenAIError(w, e.status, e.errType, e.message)
+	case strings.HasSuffix(path, "/messages") || strings.HasSuffix(path, "/count_tokens"):
+		h.sendClaudeError(w, e.status, e.errType, e.message)
+	default:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(e.status)
+		json.NewEncoder(w).Encode(map[string]string{"error": e.message})
+	}
+}
+
+// apiKeyView 管理 API 返回的 API Key 信息（不含哈希）
+func apiKeyView(k config.ApiKey) map[string]interface{} {
+	return map[string]interface{}{
+		"id":               k.ID,
+		"name":             k.Name,
+		"prefix":           k.Prefix,
+		"createdAt":        k.CreatedAt,
+		"expiresAt":        k.ExpiresAt,
+		"expired":          k.Expired(time.Now()),
+		"enabled":          k.Enabled,
+		"allowedModels":    k.AllowedModels,
+		"allowedEndpoints": k.AllowedEndpoints,
+	}
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"kiro-api-proxy/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "kiro-proxy-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// 默认配置包含 DefaultModelAliases
+	if err := config.Init(filepath.Join(dir, "config.json")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func requestWithApiKey(key *config.ApiKey) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	if key == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+}
+
+func TestCheckApiKeyModelUsesResolvedModel(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		model   string
+		wantErr bool
+	}{
+		{name: "dated name resolves to allowed model", allowed: []string{"claude-haiku-4.5"}, model: "claude-haiku-4-5-20251001"},
+		{name: "exact model", allowed: []string{"claude-haiku-4.5"}, model: "claude-haiku-4.5"},
+		{name: "alias to disallowed model", allowed: []string{"claude-haiku-4.5"}, model: "gpt-4o", wantErr: true},
+		{name: "allowing the alias name is not enough", allowed: []string{"gpt-4o"}, model: "gpt-4o", wantErr: true},
+		{name: "prefix pattern", allowed: []string{"claude-sonnet-*"}, model: "gpt-4o"},
+		{name: "unrestricted key", allowed: nil, model: "gpt-4o"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, err := resolveModel(tt.model, "", nil)
+			if err != nil {
+				t.Fatalf("resolveModel: %v", err)
+			}
+			r := requestWithApiKey(&config.ApiKey{ID: "k", Enabled: true, AllowedModels: tt.allowed})
+			keyErr := checkApiKeyModel(r, resolved.Model)
+			if (keyErr != nil) != tt.wantErr {
+				t.Fatalf("checkApiKeyModel(%s -> %s) = %v, wantErr %v", tt.model, resolved.Model, keyErr, tt.wantErr)
+			}
+			if keyErr != nil && keyErr.status != http.StatusForbidden {
+				t.Fatalf("status = %d, want 403", keyErr.status)
+			}
+		})
+	}
+}
+
+func TestCheckApiKeyModelUnknownModel(t *testing.T) {
+	if keyErr := checkApiKeyModel(requestWithApiKey(&config.ApiKey{AllowedModels: []string{"claude-*"}}), ""); keyErr == nil || keyErr.status != http.StatusForbidden {
+		t.Fatalf("restricted key with unknown model: got %v, want 403", keyErr)
+	}
+	if keyErr := checkApiKeyModel(requestWithApiKey(&config.ApiKey{}), ""); keyErr != nil {
+		t.Fatalf("unrestricted key with unknown model: got %v", keyErr)
+	}
+	if keyErr := checkApiKeyModel(requestWithApiKey(nil), ""); keyErr != nil {
+		t.Fatalf("no key: got %v", keyErr)
+	}
+}
+
+func TestModelFallbackChainSkipsDisallowedModels(t *testing.T) {
+	previous := config.GetAllModelFallbacks()
+	t.Cleanup(func() { config.UpdateModelFallbacks(previous) })
+	if err := config.UpdateModelFallbacks(map[string][]string{
+		"claude-haiku-4.5": {"claude-sonnet-4.5", "", "claude-opus-4.5", "claude-haiku-4.5"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  *config.ApiKey
+		want []string
+	}{
+		{name: "no key", key: nil, want: []string{"claude-haiku-4.5", "claude-sonnet-4.5", "claude-opus-4.5"}},
+		{name: "unrestricted key", key: &config.ApiKey{}, want: []string{"claude-haiku-4.5", "claude-sonnet-4.5", "claude-opus-4.5"}},
+		{name: "restricted key", key: &config.ApiKey{AllowedModels: []string{"claude-haiku-4.5", "claude-opus-*"}}, want: []string{"claude-haiku-4.5", "claude-opus-4.5"}},
+		{name: "no allowed fallback", key: &config.ApiKey{AllowedModels: []string{"claude-haiku-4.5"}}, want: []string{"claude-haiku-4.5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := modelFallbackChain(requestWithApiKey(tt.key).Context(), "claude-haiku-4.5")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("chain = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateApiKeyKeepsOmittedFields(t *testing.T) {
+	key := config.ApiKey{
+		ID:               "partial-update",
+		Name:             "ci",
+		Enabled:          false,
+		AllowedModels:    []string{"claude-haiku-4.5"},
+		AllowedEndpoints: []string{config.ApiKeyEndpointClaude},
+	}
+	if err := config.AddApiKey(key); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { config.DeleteApiKey(key.ID) })
+
+	h := &Handler{}
+	update := func(body string) (int, config.ApiKey) {
+		w := httptest.NewRecorder()
+		h.apiUpdateApiKey(w, httptest.NewRequest(http.MethodPut, "/admin/api/keys/"+key.ID, strings.NewReader(body)), key.ID)
+		for _, k := range config.GetApiKeys() {
+			if k.ID == key.ID {
+				return w.Code, k
+			}
+		}
+		t.Fatalf("key %s disappeared", key.ID)
+		return 0, config.ApiKey{}
+	}
+
+	// 只改名称不会重新启用或放开权限
+	if code, got := update(`{"name":"ci-renamed"}`); code != http.StatusOK || got.Name != "ci-renamed" || got.Enabled ||
+		!reflect.DeepEqual(got.AllowedModels, key.AllowedModels) || !reflect.DeepEqual(got.AllowedEndpoints, key.AllowedEndpoints) {
+		t.Fatalf("rename: code %d, key %+v", code, got)
+	}
+	// 只传 enabled 不要求 name
+	if code, got := update(`{"enabled":true}`); code != http.StatusOK || !got.Enabled || got.Name != "ci-renamed" {
+		t.Fatalf("enable: code %d, key %+v", code, got)
+	}
+	// 空列表清除允许列表
+	if code, got := update(`{"allowedModels":[]}`); code != http.StatusOK || len(got.AllowedModels) != 0 || len(got.AllowedEndpoints) != 1 {
+		t.Fatalf("clear models: code %d, key %+v", code, got)
+	}
+	// 校验失败时不修改记录
+	if code, got := update(`{"enabled":false,"allowedEndpoints":["admin"]}`); code != http.StatusBadRequest || !got.Enabled {
+		t.Fatalf("invalid endpoint: code %d, key %+v", code, got)
+	}
+	if code, _ := update(`{"name":"  "}`); code != http.StatusBadRequest {
+		t.Fatalf("empty name: code %d, want 400", code)
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+)
+
+// CacheUsageStats prompt cache 用量统计
+type CacheUsageStats struct {
+	Requests         int64   `json:"requests"`
+	CachedRequests   int64   `json:"cachedRequests"` // 命中缓存的请求数
+	InputTokens      int64   `json:"inputTokens"`
+	CacheReadTokens  int64   `json:"cacheReadTokens"`
+	CacheWriteTokens int64   `json:"cacheWriteTokens"`
+	HitRatio         float64 `json:"hitRatio"` // cacheReadTokens / inputTokens
+}
+
+func (s *CacheUsageStats) add(m RequestFinalMetrics) {
+	s.Requests++
+	if m.CacheReadTokens > 0 {
+		s.CachedRequests++
+	}
+	s.InputTokens += int64(m.InputTokens)
+	s.CacheReadTokens += int64(m.CacheReadTokens)
+	s.CacheWriteTokens += int64(m.CacheWriteTokens)
+	if s.InputTokens > 0 {
+		s.HitRatio = float64(s.CacheReadTokens) / float64(s.InputTokens)
+	}
+}
+
+// AccountCacheStats 单个账号的缓存统计
+type AccountCacheStats struct {
+	AccountID string `json:"accountId"`
+	Email     string `json:"email,omitempty"`
+	CacheUsageStats
+}
+
+// ModelCacheStats 单个模型的缓存统计
+type ModelCacheStats struct {
+	Model string `json:"model"`
+	CacheUsageStats
+}
+
+// cacheStatsTracker 按模型与账号汇总 prompt cache 命中情况（仅内存，重启后清零）
+type cacheStatsTracker struct {
+	mu        sync.Mutex
+	total     CacheUsageStats
+	byModel   map[string]*ModelCacheStats
+	byAccount map[string]*AccountCacheStats
+}
+
+func newCacheStatsTracker() *cacheStatsTracker {
+	return &cacheStatsTracker{
+		byModel:   make(map[string]*ModelCacheStats),
+		byAccount: make(map[string]*AccountCacheStats),
+	}
+}
+
+// Record 记录一次成功请求的输入与缓存用量
+func (t *cacheStatsTracker) Record(m RequestFinalMetrics) {
+	if m.InputTokens <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.total.add(m)
+	if m.Model != "" {
+		ms, ok := t.byModel[m.Model]
+		if !ok {
+			ms = &ModelCacheStats{Model: m.Model}
+			t.byModel[m.Model] = ms
+		}
+		ms.add(m)
+	}
+	if m.AccountID != "" {
+		as, ok := t.byAccount[m.AccountID]
+		if !ok {
+			as = &AccountCacheStats{AccountID: m.AccountID}
+			t.byAccount[m.AccountID] = as
+		}
+		as.Email = m.AccountEmail
+		as.add(m)
+	}
+}
+
+// Snapshot 返回当前统计（按输入 token 降序）
+func (t *cacheStatsTracker) Snapshot() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	models := make([]ModelCacheStats, 0, len(t.byModel))
+	for _, ms := range t.byModel {
+		models = append(models, *ms)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].InputTokens > models[j].InputTokens })
+
+	accounts := make([]AccountCacheStats, 0, len(t.byAccount))
+	for _, as := range t.byAccount {
+		accounts = append(accounts, *as)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].InputTokens > accounts[j].InputTokens })
+
+	return map[string]interface{}{
+		"total":     t.total,
+		"byModel":   models,
+		"byAccount": accounts,
+	}
+}
+
+// Reset 清空统计
+func (t *cacheStatsTracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total = CacheUsageStats{}
+	t.byModel = make(map[string]*ModelCacheStats)
+	t.byAccount = make(map[string]*AccountCacheStats)
+}
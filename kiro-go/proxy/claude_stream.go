@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// claudeBlockWriter 管理 Claude SSE 内容块的索引与开闭状态
+// 保证 thinking / text / tool_use 块按顺序编号且每个块都被正确关闭
+type claudeBlockWriter struct {
+	h        *Handler
+	w        http.ResponseWriter
+	flusher  http.Flusher
+	next     int    // 下一个块的索引
+	open     string // 当前打开的块类型（text/thinking/tool_use），空表示没有
+	thinking strings.Builder
+
+	toolID        string // 当前打开的 tool_use 块
+	toolInputSent bool   // 是否已增量输出过参数
+}
+
+func newClaudeBlockWriter(h *Handler, w http.ResponseWriter, flusher http.Flusher) *claudeBlockWriter {
+	return &claudeBlockWriter{h: h, w: w, flusher: flusher}
+}
+
+func (b *claudeBlockWriter) startBlock(blockType string, block map[string]interface{}) {
+	b.closeBlock()
+	b.h.sendSSE(b.w, b.flusher, "content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         b.next,
+		"content_block": block,
+	})
+	b.open = blockType
+}
+
+func (b *claudeBlockWriter) delta(delta map[string]interface{}) {
+	b.h.sendSSE(b.w, b.flusher, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": b.next,
+		"delta": delta,
+	})
+}
+
+// closeBlock 关闭当前打开的块，thinking 块关闭前补发签名
+func (b *claudeBlockWriter) closeBlock() {
+	if b.open == "" {
+		return
+	}
+	if b.open == "thinking" {
+		b.delta(map[string]interface{}{
+			"type":      "signature_delta",
+			"signature": thinkingSignature(b.thinking.String()),
+		})
+		b.thinking.Reset()
+	}
+	b.h.sendSSE(b.w, b.flusher, "content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": b.next,
+	})
+	b.next++
+	b.open = ""
+	b.toolID = ""
+}
+
+// Text 输出普通文本，必要时开启新的 text 块
+func (b *claudeBlockWriter) Text(text string) {
+	if text == "" {
+		return
+	}
+	if b.open != "text" {
+		b.startBlock("text", map[string]interface{}{"type": "text", "text": ""})
+	}
+	b.delta(map[string]interface{}{"type": "text_delta", "text": text})
+}
+
+// Thinking 输出原生 thinking 内容，必要时开启新的 thinking 块
+func (b *claudeBlockWriter) Thinking(text string) {
+	if b.open != "thinking" {
+		b.startBlock("thinking", map[string]interface{}{"type": "thinking", "thinking": "", "signature": ""})
+	}
+	if text == "" {
+		return
+	}
+	b.thinking.WriteString(text)
+	b.delta(map[string]interface{}{"type": "thinking_delta", "thinking": text})
+}
+
+// EndThinking 结束当前 thinking 块（如果有）
+func (b *claudeBlockWriter) EndThinking() {
+	if b.open == "thinking" {
+		b.closeBlock()
+	}
+}
+
+// StartToolUse 开启 tool_use 块，参数随后通过 ToolInputDelta 增量输出
+func (b *claudeBlockWriter) StartToolUse(id, name string) {
+	b.startBlock("tool_use", map[string]interface{}{
+		"type":  "tool_use",
+		"id":    id,
+		"name":  name,
+		"input": map[string]interface{}{},
+	})
+	b.toolID = id
+	b.toolInputSent = false
+}
+
+// ToolInputDelta 输出工具参数的 JSON 片段
+func (b *claudeBlockWriter) ToolInputDelta(id, partialJSON string) {
+	if b.open != "tool_use" || b.toolID != id || partialJSON == "" {
+		return
+	}
+	b.toolInputSent = true
+	b.delta(map[string]interface{}{
+		"type":         "input_json_delta",
+		"partial_json": partialJSON,
+	})
+}
+
+// ToolUse 结束 tool_use 块；块未开启或参数未增量输出时补发完整参数
+func (b *claudeBlockWriter) ToolUse(tu KiroToolUse) {
+	if b.open != "tool_use" || b.toolID != tu.ToolUseID {
+		b.StartToolUse(tu.ToolUseID, tu.Name)
+	}
+	if !b.toolInputSent {
+		inputJSON, _ := json.Marshal(tu.Input)
+		b.delta(map[string]interface{}{
+			"type":         "input_json_delta",
+			"partial_json": string(inputJSON),
+		})
+	}
+	b.closeBlock()
+}
+
+// Close 关闭最后一个打开的块
+func (b *claudeBlockWriter) Close() {
+	b.closeBlock()
+}
+
+// thinkingSignature 为 thinking 块生成签名
+// Kiro 不返回 Anthropic 的加密签名，这里用内容摘要占位，保证客户端回传时字段非空且稳定
+func thinkingSignature(thinking string) string {
+	sum := sha256.Sum256([]byte(thinking))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"kiro-api-proxy/config"
+	"kiro-api-proxy/tokenizer"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// 裁剪目标为上下文窗口的 90%，为估算误差留出余量
+	contextTrimTargetRatio = 0.9
+	// 上游仍报超长时，按当前估算值的 70% 再裁剪一次
+	contextRetryShrinkRatio = 0.7
+	// 最近的若干条历史消息不压缩
+	contextKeepRecentMessages = 4
+	// 压缩后的工具结果保留的字符数
+	compressedToolResultChars = 1000
+)
+
+// 压缩后的工具结果末尾标记，避免重复压缩
+const truncatedMarker = "\n...[truncated "
+
+// HistoryTrim 一次历史裁剪的记录（写入请求日志）
+type HistoryTrim struct {
+	Reason            string `json:"reason"` // "model_limit" | "upstream_too_long"
+	LimitTokens       int    `json:"limitTokens"`
+	BeforeTokens      int    `json:"beforeTokens"`
+	AfterTokens       int    `json:"afterTokens"`
+	CompressedResults int    `json:"compressedResults,omitempty"`
+	DroppedMessages   int    `json:"droppedMessages,omitempty"`
+}
+
+// modelInputLimit 从模型缓存中查找模型的最大输入 token，未知时返回 0
+func (h *Handler) modelInputLimit(modelID string) int {
+	h.modelsCacheMu.RLock()
+	defer h.modelsCacheMu.RUnlock()
+	for _, m := range h.cachedModels {
+		if strings.EqualFold(m.ModelId, modelID) && m.TokenLimits != nil {
+			return m.TokenLimits.MaxInputTokens
+		}
+	}
+	return 0
+}
+
+// trimToContextWindow 按模型上下文窗口主动裁剪历史，模型未知时不裁剪
+func (h *Handler) trimToContextWindow(payload *KiroPayload) {
+	modelID := payload.ConversationState.CurrentMessage.UserInputMessage.ModelID
+	if maxInput := h.modelInputLimit(modelID); maxInput > 0 {
+		trimPayloadHistory(payload, int(float64(maxInput)*contextTrimTargetRatio), "model_limit")
+	}
+}
+
+// trimPayloadHistory 将 payload 裁剪到 limit 以内：
+// 先压缩较早历史中的长工具结果，仍超出时从最早的轮次开始整段丢弃。
+// 丢弃只在不带工具结果的 user 消息处切分，保证 toolUse/toolResult 成对保留。
+// 未发生裁剪时返回 nil。
+func trimPayloadHistory(payload *KiroPayload, limit int, reason string) *HistoryTrim {
+	if limit <= 0 {
+		return nil
+	}
+	before := countPayloadTokens(payload)
+	if before <= limit {
+		return nil
+	}
+
+	trim := &HistoryTrim{Reason: reason, LimitTokens: limit, BeforeTokens: before}
+	history := payload.ConversationState.History
+
+	// 1. 压缩较早历史中的长工具结果
+	for i := 0; i < len(history)-contextKeepRecentMessages; i++ {
+		trim.CompressedResults += compressToolResults(history[i].UserInputMessage)
+	}
+
+	current := payload.ConversationState.CurrentMessage.UserInputMessage
+	total := countUserInputTokens(&current)
+	sizes := make([]int, len(history))
+	for i, msg := range history {
+		sizes[i] = historyMessageTokens(msg)
+		total += sizes[i]
+	}
+
+	// 2. 从最早的轮次开始丢弃
+	// OpenAI 请求的系统提示合并在首条 user 历史消息中，被丢弃时需转移到新的首条消息
+	prefix := payload.pinnedPrefix
+	cut, movePrefix := 0, false
+	for total > limit {
+		next := nextHistoryCut(history, cut, hasToolResults(current))
+		if next == -1 {
+			break
+		}
+		for i := cut; i < next; i++ {
+			total -= sizes[i]
+		}
+		cut = next
+		if prefix != "" && !movePrefix && droppedPinned(history[:cut], prefix) {
+			movePrefix = true
+			total += tokenizer.Count(prefix)
+		}
+	}
+
+	if cut > 0 {
+		kept := history[cut:]
+		if movePrefix {
+			if len(kept) > 0 {
+				first := *kept[0].UserInputMessage
+				first.Content = prefix + "\n" + first.Content
+				kept[0].UserInputMessage = &first
+			} else {
+				msg := &payload.ConversationState.CurrentMessage.UserInputMessage
+				msg.Content = prefix + "\n" + msg.Content
+				payload.pinnedPrefix = ""
+			}
+		}
+		payload.ConversationState.History = kept
+		trim.DroppedMessages = cut
+	}
+
+	trim.AfterTokens = total
+	payload.trims = append(payload.trims, *trim)
+	fmt.Printf("[ContextWindow] Trimmed history (%s): ~%d -> ~%d tokens (limit %d), compressed %d tool results, dropped %d messages\n",
+		reason, trim.BeforeTokens, trim.AfterTokens, limit, trim.CompressedResults, trim.DroppedMessages)
+	return trim
+}
+
+// nextHistoryCut 返回 from 之后下一个可切分位置：
+// 切分后历史以不带工具结果的 user 消息开头（或历史为空），不会留下孤立的 toolResult
+// 当前消息带工具结果时，必须保留其对应的最后一条 assistant 消息
+func nextHistoryCut(history []KiroHistoryMessage, from int, currentHasResults bool) int {
+	for i := from + 1; i < len(history); i++ {
+		msg := history[i].UserInputMessage
+		if msg != nil && !hasToolResults(*msg) {
+			return i
+		}
+	}
+	if !currentHasResults && len(history) > from {
+		return len(history)
+	}
+	return -1
+}
+
+// droppedPinned 被丢弃的消息中是否包含合并了系统提示的消息
+func droppedPinned(dropped []KiroHistoryMessage, prefix string) bool {
+	for _, msg := range dropped {
+		if msg.UserInputMessage != nil && strings.HasPrefix(msg.UserInputMessage.Content, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasToolResults(msg KiroUserInputMessage) bool {
+	return msg.UserInputMessageContext != nil && len(msg.UserInputMessageContext.ToolResults) > 0
+}
+
+// compressToolResults 截断消息中过长的工具结果，返回被压缩的数量
+func compressToolResults(msg *KiroUserInputMessage) int {
+	if msg == nil || msg.UserInputMessageContext == nil {
+		return 0
+	}
+	compressed := 0
+	for i := range msg.UserInputMessageContext.ToolResults {
+		tr := &msg.UserInputMessageContext.ToolResults[i]
+		for j := range tr.Content {
+			text := tr.Content[j].Text
+			if len(text) <= compressedToolResultChars || strings.Contains(text, truncatedMarker) {
+				continue
+			}
+			cut := compressedToolResultChars
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			tr.Content[j].Text = fmt.Sprintf("%s%s%d chars]", text[:cut], truncatedMarker, len(text)-cut)
+			compressed++
+		}
+	}
+	return compressed
+}
+
+// isContextTooLongError 上游因输入超长拒绝请求
+func isContextTooLongError(err error) bool {
+	var apiErr *KiroAPIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return strings.Contains(apiErr.Body, "CONTENT_LENGTH_EXCEEDS_THRESHOLD") ||
+		strings.Contains(strings.ToLower(apiErr.Body), "input is too long")
+}
+
+// withContextRetry 上游报输入超长时缩小历史后在同一账号上重试一次
+func withContextRetry(payload *KiroPayload, run upstreamAttempt) upstreamAttempt {
+	return func(account *config.Account) (kiroUsage, error) {
+		usage, err := run(account)
+		if !isContextTooLongError(err) || len(payload.ConversationState.History) == 0 {
+			return usage, err
+		}
+		limit := int(float64(countPayloadTokens(payload)) * contextRetryShrinkRatio)
+		if trimPayloadHistory(payload, limit, "upstream_too_long") == nil {
+			return usage, err
+		}
+		return run(account)
+	}
+}
@@ -0,0 +1,445 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kiro-api-proxy/config"
+	"kiro-api-proxy/pool"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errStreamingUnsupported = errors.New("Streaming not supported")
+
+// errNoAccountForModel 池中没有账号可以服务请求的模型
+var errNoAccountForModel = errors.New("No available accounts for model")
+
+// modelHeader 响应头：实际使用的模型（发生模型 fallback 时与请求模型不同）
+const modelHeader = "X-Kiro-Model"
+
+// commitWriter 记录是否已向客户端写出数据
+// 一旦写出首个字节就不能再切换账号重试
+type commitWriter struct {
+	http.ResponseWriter
+	committed bool
+}
+
+func (cw *commitWriter) WriteHeader(code int) {
+	cw.committed = true
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *commitWriter) Write(b []byte) (int, error) {
+	cw.committed = true
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *commitWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// kiroUsage 单次上游调用的用量
+type kiroUsage struct {
+	InputTokens      int // 全部输入 token（含缓存命中与写入）
+	OutputTokens     int
+	CacheReadTokens  int
+	CacheWriteTokens int
+	Credits          float64
+}
+
+// claudeUsage Claude usage：input_tokens 仅为未命中缓存的部分
+func (u kiroUsage) claudeUsage() ClaudeUsage {
+	return ClaudeUsage{
+		InputTokens:              max(0, u.InputTokens-u.CacheReadTokens-u.CacheWriteTokens),
+		OutputTokens:             u.OutputTokens,
+		CacheCreationInputTokens: u.CacheWriteTokens,
+		CacheReadInputTokens:     u.CacheReadTokens,
+	}
+}
+
+// openAIUsage OpenAI usage：prompt_tokens 包含缓存命中部分
+func (u kiroUsage) openAIUsage() map[string]interface{} {
+	return map[string]interface{}{
+		"prompt_tokens":     u.InputTokens,
+		"completion_tokens": u.OutputTokens,
+		"total_tokens":      u.InputTokens + u.OutputTokens,
+		"prompt_tokens_details": map[string]int{
+			"cached_tokens": u.CacheReadTokens,
+		},
+	}
+}
+
+// 模型输出未通过校验时在同一账号上的最大尝试次数
+const outputCheckMaxTries = 2
+
+// responseOptions 影响响应输出的请求参数
+type responseOptions struct {
+	ToolChoice     ToolChoice
+	ResponseFormat *OpenAIResponseFormat
+	StopSequences  []string
+	MaxTokens      int
+}
+
+// needsOutputCheck 是否需要校验模型输出
+func (o responseOptions) needsOutputCheck() bool {
+	return o.ToolChoice.Required() || o.ResponseFormat.structured()
+}
+
+// upstreamAttempt 使用指定账号执行一次上游调用
+type upstreamAttempt func(account *config.Account) (kiroUsage, error)
+
+// modelAttempt 为指定模型构造上游调用
+type modelAttempt func(model string) upstreamAttempt
+
+// failoverResult 跨账号重试的最终结果
+type failoverResult struct {
+	Account  *config.Account
+	Usage    kiroUsage
+	Attempts []RequestLogAttempt
+	Status   int           // 最终状态码（成功为 200）
+	Err      error         // 最终错误，成功时为 nil
+	Trims    []HistoryTrim // 上下文历史裁剪记录
+	Model    string        // 实际使用的模型
+}
+
+// executeWithFailover 原生模式跨账号重试：
+// 只选择可用模型列表包含 model 的账号，preferred 账号可用时优先使用（会话粘性），
+// 可重试错误（429/配额/5xx/认证/网络）且尚未向客户端写出数据时换账号重试；
+// 所有账号都已达并发上限时排队等待
+func (h *Handler) executeWithFailover(ctx context.Context, cw *commitWriter, model, preferred string, run upstreamAttempt) failoverResult {
+	maxAttempts := config.GetFailoverMaxAttempts()
+	tried := map[string]bool{}
+	res := failoverResult{Attempts: make([]RequestLogAttempt, 0, maxAttempts)}
+
+	for i := 0; i < maxAttempts; i++ {
+		opts := pool.SelectOptions{Model: model, Exclude: tried}
+		if i == 0 {
+			opts.Preferred = preferred
+		}
+		account, release, err := h.pool.Acquire(ctx, opts)
+		if err != nil {
+			// 排队超时或客户端已断开
+			res.Status = http.StatusServiceUnavailable
+			if ctx.Err() != nil {
+				res.Status = 499
+			}
+			res.Err = err
+			res.Attempts = append(res.Attempts, RequestLogAttempt{
+				Try:        len(res.Attempts) + 1,
+				StatusCode: res.Status,
+				Error:      err.Error(),
+			})
+			return res
+		}
+		if account == nil {
+			break
+		}
+		tried[account.ID] = true
+		res.Account = account
+		tryStart := time.Now()
+
+		// 检查并刷新 token
+		if err := h.ensureValidToken(account); err != nil {
+			release()
+			h.pool.RecordError(account.ID, pool.ErrorTransient, 0)
+			res.Status = http.StatusServiceUnavailable
+			res.Err = fmt.Errorf("Token refresh failed: %w", err)
+			res.Attempts = append(res.Attempts, RequestLogAttempt{
+				Try:        len(res.Attempts) + 1,
+				AccountID:  account.ID,
+				Email:      account.Email,
+				StatusCode: res.Status,
+				Error:      truncateError(res.Err.Error()),
+				DurationMs: time.Since(tryStart).Milliseconds(),
+			})
+			continue
+		}
+
+		usage, err := run(account)
+		release()
+		if err == nil {
+			res.Usage = usage
+			res.Status = http.StatusOK
+			res.Err = nil
+			res.Attempts = append(res.Attempts, RequestLogAttempt{
+				Try:        len(res.Attempts) + 1,
+				AccountID:  account.ID,
+				Email:      account.Email,
+				StatusCode: http.StatusOK,
+				DurationMs: time.Since(tryStart).Milliseconds(),
+			})
+			h.pool.RecordSuccess(account.ID)
+			h.pool.UpdateStats(account.ID, usage.InputTokens+usage.OutputTokens, usage.Credits)
+			h.pool.RecordOutputTokens(account.ID, usage.OutputTokens)
+			return res
+		}
+
+		// 输出校验失败是模型行为，schema 无效是请求问题，均不计入账号错误
+		if !isOutputCheckError(err) && !isSchemaError(err) {
+			kind, retryAfter := accountErrorKind(err)
+			h.pool.RecordError(account.ID, kind, retryAfter)
+		}
+		res.Status = upstreamErrorStatus(err)
+		res.Err = err
+		res.Attempts = append(res.Attempts, RequestLogAttempt{
+			Try:        len(res.Attempts) + 1,
+			AccountID:  account.ID,
+			Email:      account.Email,
+			StatusCode: res.Status,
+			Error:      truncateError(err.Error()),
+			DurationMs: time.Since(tryStart).Milliseconds(),
+		})
+
+		if cw.committed || !isRetryableUpstreamError(err) {
+			return res
+		}
+		fmt.Printf("[Failover] Account %s failed (%v), trying next account\n", account.Email, err)
+	}
+
+	if len(res.Attempts) == 0 {
+		res.Status = http.StatusServiceUnavailable
+		res.Err = errors.New("No available accounts")
+		if h.pool.Count() > 0 && !h.pool.HasModel(model) {
+			res.Err = fmt.Errorf("%w %s", errNoAccountForModel, model)
+		}
+		res.Attempts = append(res.Attempts, RequestLogAttempt{
+			Try:        1,
+			StatusCode: res.Status,
+			Error:      res.Err.Error(),
+		})
+	}
+	return res
+}
+
+// modelFallbackChain 返回 model 及其 fallback 模型，跳过请求的 API Key 不允许使用的 fallback 模型
+func modelFallbackChain(ctx context.Context, model string) []string {
+	key := apiKeyFromContext(ctx)
+	chain := []string{model}
+	for _, m := range config.GetModelFallbacks(model) {
+		if m == "" || containsFold(chain, m) {
+			continue
+		}
+		if key != nil && !key.AllowsModel(m) {
+			continue
+		}
+		chain = append(chain, m)
+	}
+	return chain
+}
+
+// executeWithModelFallback 当前模型在所有账号上都因配额/容量不可用时，按配置的 fallback 链换模型重试
+// 会话已绑定账号时优先使用该账号
+func (h *Handler) executeWithModelFallback(ctx context.Context, cw *commitWriter, payload *KiroPayload, model string, session sessionRoute, run modelAttempt) failoverResult {
+	chain := modelFallbackChain(ctx, model)
+
+	var res failoverResult
+	var attempts []RequestLogAttempt
+	for i, m := range chain {
+		if i > 0 {
+			fmt.Printf("[ModelFallback] %s unavailable (%v), falling back to %s\n", chain[i-1], res.Err, m)
+			payload.ConversationState.CurrentMessage.UserInputMessage.ModelID = m
+			h.trimToContextWindow(payload)
+		}
+		cw.Header().Set(modelHeader, m)
+
+		res = h.executeWithFailover(ctx, cw, m, session.AccountID, run(m))
+		res.Model = m
+		for _, a := range res.Attempts {
+			a.Try = len(attempts) + 1
+			a.Model = m
+			attempts = append(attempts, a)
+		}
+		if res.Err == nil || cw.committed || !isModelUnavailableError(res.Err) {
+			break
+		}
+	}
+	res.Attempts = attempts
+	return res
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// withOutputRetry 模型输出未通过校验（tool_choice / response_format）时在同一账号上重试
+func withOutputRetry(opts responseOptions, run upstreamAttempt) upstreamAttempt {
+	if !opts.needsOutputCheck() {
+		return run
+	}
+	return func(account *config.Account) (kiroUsage, error) {
+		var usage kiroUsage
+		var err error
+		for i := 0; i < outputCheckMaxTries; i++ {
+			usage, err = run(account)
+			if !isOutputCheckError(err) {
+				return usage, err
+			}
+			fmt.Printf("[OutputCheck] %s on %s (try %d/%d)\n", err, account.Email, i+1, outputCheckMaxTries)
+		}
+		return usage, err
+	}
+}
+
+// finalizeFailover 记录跨账号重试结果的统计与请求日志
+func (h *Handler) finalizeFailover(r *http.Request, model string, requestStart time.Time, res failoverResult) {
+	m := RequestFinalMetrics{
+		Path:         r.URL.Path,
+		Model:        model,
+		ApiKey:       apiKeyFromContext(r.Context()),
+		Attempts:     len(res.Attempts),
+		FinalStatus:  res.Status,
+		DurationMs:   time.Since(requestStart).Milliseconds(),
+		AttemptItems: res.Attempts,
+		HistoryTrims: res.Trims,
+	}
+	if res.Model != "" && !strings.EqualFold(res.Model, model) {
+		m.Model, m.RequestedModel = res.Model, model
+	}
+	if res.Account != nil {
+		m.AccountID = res.Account.ID
+		m.AccountEmail = res.Account.Email
+	}
+	if res.Err != nil {
+		m.Error = truncateError(res.Err.Error())
+	} else {
+		m.TotalTokens = res.Usage.InputTokens + res.Usage.OutputTokens
+		m.InputTokens = res.Usage.InputTokens
+		m.OutputTokens = res.Usage.OutputTokens
+		m.CacheReadTokens = res.Usage.CacheReadTokens
+		m.CacheWriteTokens = res.Usage.CacheWriteTokens
+		m.Credits = res.Usage.Credits
+	}
+	h.finalizeRequest(m)
+}
+
+// upstreamStatusCode 提取上游 HTTP 状态码，非 HTTP 错误返回 0
+func upstreamStatusCode(err error) int {
+	var apiErr *KiroAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// upstreamErrorStatus 上游错误对应的请求日志状态码
+func upstreamErrorStatus(err error) int {
+	if isSchemaError(err) {
+		return http.StatusBadRequest
+	}
+	if status := upstreamStatusCode(err); status != 0 {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+func isQuotaError(err error) bool {
+	switch upstreamStatusCode(err) {
+	case 402, 429:
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "429") || strings.Contains(msg, "quota")
+}
+
+// accountErrorKind 按上游错误判断账号冷却类型与上游给出的重试等待时间
+func accountErrorKind(err error) (pool.ErrorKind, time.Duration) {
+	var apiErr *KiroAPIError
+	if errors.As(err, &apiErr) {
+		return cooldownKind(apiErr.StatusCode, apiErr.Body), apiErr.RetryAfter
+	}
+	if isQuotaError(err) {
+		return pool.ErrorQuotaExhausted, 0
+	}
+	return pool.ErrorTransient, 0
+}
+
+// cooldownKind 按状态码与响应体区分额度用尽、限流与临时错误
+// 429 无法从响应体判断时按限流处理，账号池会结合账号额度信息再判断是否为额度用尽
+func cooldownKind(status int, body string) pool.ErrorKind {
+	switch status {
+	case 402:
+		return pool.ErrorQuotaExhausted
+	case 429:
+		lower := strings.ToLower(body)
+		if strings.Contains(lower, "throttl") || strings.Contains(lower, "too many requests") {
+			return pool.ErrorRateLimited
+		}
+		if strings.Contains(lower, "quota") || strings.Contains(lower, "limit exceeded") ||
+			strings.Contains(lower, "monthly_request_count") {
+			return pool.ErrorQuotaExhausted
+		}
+		return pool.ErrorRateLimited
+	}
+	return pool.ErrorTransient
+}
+
+// parseRetryAfter 解析 Retry-After 头（秒数或 HTTP 日期），无效时返回 0
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return max(0, time.Duration(secs)*time.Second)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(0, time.Until(t))
+	}
+	return 0
+}
+
+// isModelUnavailableError 判断错误是否可能通过换模型解决（配额、容量不足或模型不可用）
+func isModelUnavailableError(err error) bool {
+	if errors.Is(err, errNoAccountForModel) {
+		return true
+	}
+	if errors.Is(err, errStreamingUnsupported) || isOutputCheckError(err) || isSchemaError(err) {
+		return false
+	}
+	if isQuotaError(err) || upstreamStatusCode(err) >= 500 {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "capacity") || strings.Contains(msg, "invalid_model") ||
+		strings.Contains(msg, "model is not available") || strings.Contains(msg, "model not available")
+}
+
+// isRetryableUpstreamError 判断错误是否可能在其他账号上成功
+func isRetryableUpstreamError(err error) bool {
+	if errors.Is(err, errStreamingUnsupported) || isOutputCheckError(err) || isSchemaError(err) {
+		return false
+	}
+	status := upstreamStatusCode(err)
+	switch {
+	case status == 0: // 网络错误或流中断
+		return true
+	case status == 401, status == 402, status == 403, status == 408, status == 429:
+		return true
+	case status >= 500:
+		return true
+	}
+	return false
+}
+
+// clientErrorStatus 返回给客户端的状态码与 Claude 错误类型
+func clientErrorStatus(res failoverResult) (int, string) {
+	switch {
+	case res.Status == 400:
+		return 400, "invalid_request_error"
+	case res.Status == 429 || res.Status == 402:
+		return 429, "rate_limit_error"
+	case res.Status == 503:
+		return 503, "api_error"
+	}
+	return 500, "api_error"
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// 非 SSE 响应最多缓存的字节数（用于解析 usage）
+const maxUsageBodyBytes = 8 << 20
+
+// usageSniffer 在透传网关响应时旁路解析用量
+// SSE 响应逐行解析 data 事件；JSON 响应在结束时整体解析
+type usageSniffer struct {
+	sse          bool
+	buf          []byte
+	overflow     bool
+	inputTokens  int
+	outputTokens int
+	totalTokens  int
+	credits      float64
+}
+
+func newUsageSniffer(contentType string) *usageSniffer {
+	return &usageSniffer{sse: strings.Contains(contentType, "text/event-stream")}
+}
+
+func (u *usageSniffer) Write(p []byte) (int, error) {
+	if !u.sse {
+		if !u.overflow {
+			if len(u.buf)+len(p) > maxUsageBodyBytes {
+				u.overflow = true
+				u.buf = nil
+			} else {
+				u.buf = append(u.buf, p...)
+			}
+		}
+		return len(p), nil
+	}
+
+	u.buf = append(u.buf, p...)
+	for {
+		idx := bytes.IndexByte(u.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		u.parseSSELine(u.buf[:idx])
+		u.buf = u.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+func (u *usageSniffer) parseSSELine(line []byte) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return
+	}
+	data := bytes.TrimSpace(line[len("data:"):])
+	if len(data) == 0 || data[0] != '{' {
+		return
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return
+	}
+	u.collect(obj)
+	// Claude message_start 的 usage 在 message 字段内
+	if msg, ok := obj["message"].(map[string]interface{}); ok {
+		u.collect(msg)
+	}
+}
+
+// collect 从响应对象中提取 usage（兼容 OpenAI 与 Claude 字段）
+func (u *usageSniffer) collect(obj map[string]interface{}) {
+	if v, ok := obj["credits"].(float64); ok && v > 0 {
+		u.credits = v
+	}
+	usage, ok := obj["usage"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for _, key := range []string{"input_tokens", "prompt_tokens"} {
+		if v, ok := usage[key].(float64); ok && v > 0 {
+			u.inputTokens = int(v)
+		}
+	}
+	for _, key := range []string{"output_tokens", "completion_tokens"} {
+		if v, ok := usage[key].(float64); ok && v > 0 {
+			u.outputTokens = int(v)
+		}
+	}
+	if v, ok := usage["total_tokens"].(float64); ok && v > 0 {
+		u.totalTokens = int(v)
+	}
+	if v, ok := usage["credits_used"].(float64); ok && v > 0 {
+		u.credits = v
+	}
+}
+
+// Finish 返回解析到的总 token 与 credits
+func (u *usageSniffer) Finish() (int, float64) {
+	if u.sse {
+		if len(u.buf) > 0 {
+			u.parseSSELine(u.buf)
+			u.buf = nil
+		}
+	} else if !u.overflow && len(u.buf) > 0 {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(u.buf, &obj); err == nil {
+			u.collect(obj)
+		}
+		u.buf = nil
+	}
+
+	if u.totalTokens > 0 {
+		return u.totalTokens, u.credits
+	}
+	return u.inputTokens + u.outputTokens, u.credits
+}
+
+// copyAndFlush 将上游响应体逐块写给客户端并立即 flush，同时旁路给 tee
+func copyAndFlush(w http.ResponseWriter, body io.Reader, tee io.Writer) error {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			tee.Write(buf[:n])
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
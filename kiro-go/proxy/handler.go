@@ -8,9 +8,7 @@ import (
 	"kiro-api-proxy/auth"
 	"kiro-api-proxy/config"
 	"kiro-api-proxy/pool"
-	"math/rand"
 	"net/http"
-	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"os"
@@ -42,6 +40,7 @@ func (sr *statusRecorder) Write(b []byte) (int, error) {
 
 type RequestLogAttempt struct {
 	Try        int   `json:"try"`
+	Model      string `json:"model,omitempty"`
 	AccountID  string `json:"accountId,omitempty"`
 	Email      string `json:"email,omitempty"`
 	StatusCode int   `json:"statusCode"`
@@ -50,16 +49,25 @@ type RequestLogAttempt struct {
 }
 
 type RequestLogEntry struct {
-	Time         int64               `json:"time"`
-	Path         string              `json:"path"`
-	Model        string              `json:"model,omitempty"`
-	AccountID    string              `json:"accountId,omitempty"`
-	Email        string              `json:"email,omitempty"`
-	Attempts     int                 `json:"attempts"`
-	FinalStatus  int                 `json:"finalStatus"`
-	DurationMs   int64               `json:"durationMs"`
-	Error        string              `json:"error,omitempty"`
-	AttemptItems []RequestLogAttempt `json:"attemptItems,omitempty"`
+	Time           int64               `json:"time"`
+	Path           string              `json:"path"`
+	Model          string              `json:"model,omitempty"`
+	RequestedModel string              `json:"requestedModel,omitempty"` // 发生模型 fallback 时的原始模型
+	AccountID      string              `json:"accountId,omitempty"`
+	Email          string              `json:"email,omitempty"`
+	ApiKeyID       string              `json:"apiKeyId,omitempty"` // 请求使用的 API Key（旧版单一 Key 为 legacy）
+	ApiKeyName     string              `json:"apiKeyName,omitempty"`
+	Attempts       int                 `json:"attempts"`
+	FinalStatus    int                 `json:"finalStatus"`
+	DurationMs     int64               `json:"durationMs"`
+	Error          string              `json:"error,omitempty"`
+	AttemptItems   []RequestLogAttempt `json:"attemptItems,omitempty"`
+	HistoryTrims   []HistoryTrim       `json:"historyTrims,omitempty"`
+	// token 用量（成功请求）
+	InputTokens      int `json:"inputTokens,omitempty"`
+	OutputTokens     int `json:"outputTokens,omitempty"`
+	CacheReadTokens  int `json:"cacheReadTokens,omitempty"`
+	CacheWriteTokens int `json:"cacheWriteTokens,omitempty"`
 }
 
 type requestLogRing struct {
@@ -104,17 +112,25 @@ func (r *requestLogRing) List(limit int) []RequestLogEntry {
 }
 
 type RequestFinalMetrics struct {
-	Path         string
-	Model        string
-	AccountID    string
-	AccountEmail string
-	Attempts     int
-	FinalStatus  int
-	DurationMs   int64
-	Error        string
-	AttemptItems []RequestLogAttempt
-	TotalTokens  int
-	Credits      float64
+	Path           string
+	Model          string
+	RequestedModel string // 发生模型 fallback 时的原始模型
+	AccountID      string
+	AccountEmail   string
+	ApiKey         *config.ApiKey // 请求使用的 API Key，未要求 API Key 时为 nil
+	Attempts       int
+	FinalStatus    int
+	DurationMs     int64
+	Error          string
+	AttemptItems   []RequestLogAttempt
+	HistoryTrims   []HistoryTrim
+	TotalTokens    int
+	Credits        float64
+	// 输入/输出与 prompt cache token（InputTokens 含缓存部分）
+	InputTokens      int
+	OutputTokens     int
+	CacheReadTokens  int
+	CacheWriteTokens int
 }
 
 // Handler HTTP 处理器
@@ -133,6 +149,9 @@ type Handler struct {
 	stopRefresh           chan struct{}
 	stopStatsSaver        chan struct{}
 	requestLogs           *requestLogRing
+	cacheStats            *cacheStatsTracker
+	sessions              *sessionStore
+	prober                *healthProber
 	// 模型缓存
 	cachedModels    []ModelInfo
 	modelsCacheMu   sync.RWMutex
@@ -140,6 +159,7 @@ type Handler struct {
 	gatewayBase     string
 	gatewayAPIKey   string
 	gatewayProxy    *httputil.ReverseProxy
+	gatewayClient   *http.Client
 }
 
 func NewHandler() *Handler {
@@ -157,6 +177,9 @@ func NewHandler() *Handler {
 		stopRefresh:           make(chan struct{}),
 		stopStatsSaver:        make(chan struct{}),
 		requestLogs:           newRequestLogRing(500),
+		cacheStats:            newCacheStatsTracker(),
+		sessions:              newSessionStore(),
+		prober:                newHealthProber(),
 		gatewayBase:           strings.TrimRight(os.Getenv("KIRO_GATEWAY_BASE"), "/"),
 		gatewayAPIKey:         os.Getenv("KIRO_GATEWAY_API_KEY"),
 	}
@@ -170,6 +193,13 @@ func NewHandler() *Handler {
 					req.Header.Set("Authorization", "Bearer "+h.gatewayAPIKey)
 				}
 			}
+			// 故障转移使用独立客户端：不设总超时以支持长时间流式响应，不跟随重定向
+			h.gatewayClient = &http.Client{
+				Transport: http.DefaultTransport.(*http.Transport).Clone(),
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
 			logger := fmt.Sprintf("[GatewayProxy] enabled -> %s", h.gatewayBase)
 			_ = logger
 		}
@@ -178,10 +208,15 @@ func NewHandler() *Handler {
 	go h.backgroundRefresh()
 	// 启动后台统计保存 (每30秒保存一次)
 	go h.backgroundStatsSaver()
+	// 启动后台健康探测
+	go h.backgroundProbe()
+	// 启动 token 主动刷新
+	go auth.GetRefreshManager().Run(h.stopRefresh)
 	return h
 }
 
-// backgroundRefresh 后台定时刷新账户信息
+// backgroundRefresh 后台定时刷新账户信息与模型列表
+// Token 由 RefreshManager.Run 在过期前主动刷新，这里只读取配置中的最新 token，不触发刷新
 func (h *Handler) backgroundRefresh() {
 	ticker := time.NewTicker(30 * time.Minute) // 每 30 分钟刷新一次
 	defer ticker.Stop()
@@ -211,20 +246,10 @@ func (h *Handler) refreshAllAccounts() {
 			continue
 		}
 
-		// 检查 token 是否需要刷新
-		if account.ExpiresAt > 0 && time.Now().Unix() > account.ExpiresAt-300 {
-			newAccessToken, newRefreshToken, newExpiresAt, err := auth.RefreshToken(account)
-			if err != nil {
-				fmt.Printf("[BackgroundRefresh] Token refresh failed for %s: %v\n", account.Email, err)
-				continue
-			}
-			account.AccessToken = newAccessToken
-			if newRefreshToken != "" {
-				account.RefreshToken = newRefreshToken
-			}
-			account.ExpiresAt = newExpiresAt
-			config.UpdateAccountToken(account.ID, newAccessToken, newRefreshToken, newExpiresAt)
-			h.pool.UpdateToken(account.ID, newAccessToken, newRefreshToken, newExpiresAt)
+		// token 已过期说明主动刷新失败，由 RefreshManager 按退避重试，恢复后下一轮再刷新账户信息
+		if account.ExpiresAt > 0 && time.Now().Unix() >= account.ExpiresAt {
+			fmt.Printf("[BackgroundRefresh] Skipping %s: token expired, waiting for token refresh\n", account.Email)
+			continue
 		}
 
 		// 刷新账户信息
@@ -236,164 +261,119 @@ func (h *Handler) refreshAllAccounts() {
 
 		config.UpdateAccountInfo(account.ID, *info)
 		fmt.Printf("[BackgroundRefresh] Refreshed %s: %s %.1f/%.1f\n", account.Email, info.SubscriptionType, info.UsageCurrent, info.UsageLimit)
+
+		// 缓存账号可用模型，用于按模型选择账号
+		models, err := ListAvailableModels(account)
+		if err != nil {
+			fmt.Printf("[BackgroundRefresh] Failed to list models for %s: %v\n", account.Email, err)
+			continue
+		}
+		h.setAccountModels(account.ID, models)
 	}
 	h.pool.Reload()
 }
 
-// validateApiKey 验证 API Key
-func (h *Handler) validateApiKey(r *http.Request) bool {
-	if !config.IsApiKeyRequired() {
-		return true
-	}
-
-	expectedKey := config.GetApiKey()
-	if expectedKey == "" {
-		return true
+// setAccountModels 缓存账号可用模型，并将新模型合并进模型缓存（供上下文窗口与模型解析使用）
+func (h *Handler) setAccountModels(accountID string, models []ModelInfo) {
+	ids := make([]string, len(models))
+	for i, m := range models {
+		ids[i] = m.ModelId
 	}
+	h.pool.SetAccountModels(accountID, ids)
 
-	// 从 Authorization 头或 X-Api-Key 头获取
-	authHeader := r.Header.Get("Authorization")
-	apiKeyHeader := r.Header.Get("X-Api-Key")
-
-	var providedKey string
-	if strings.HasPrefix(authHeader, "Bearer ") {
-		providedKey = strings.TrimPrefix(authHeader, "Bearer ")
-	} else if apiKeyHeader != "" {
-		providedKey = apiKeyHeader
+	h.modelsCacheMu.Lock()
+	defer h.modelsCacheMu.Unlock()
+	merged := append([]ModelInfo(nil), h.cachedModels...)
+	for _, m := range models {
+		found := false
+		for _, c := range merged {
+			if strings.EqualFold(c.ModelId, m.ModelId) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, m)
+		}
 	}
-
-	return providedKey == expectedKey
+	h.cachedModels = merged
 }
 
 func (h *Handler) useGatewayProxy() bool {
 	return h.gatewayProxy != nil
 }
 
-func (h *Handler) selectGatewayAccountWithTried(tried map[string]bool) *config.Account {
-	accounts := h.pool.GetAllAccounts()
-	if len(accounts) == 0 {
-		return nil
-	}
-
-	candidates := make([]config.Account, 0, len(accounts))
-	for _, a := range accounts {
-		if !a.Enabled || a.RefreshToken == "" {
-			continue
-		}
-		if tried != nil && tried[a.ID] {
-			continue
-		}
-		candidates = append(candidates, a)
-	}
-	if len(candidates) == 0 {
-		return nil
+func (h *Handler) proxyToGatewayWithAccount(w http.ResponseWriter, r *http.Request, account *config.Account) {
+	if h.gatewayProxy == nil {
+		http.Error(w, "gateway proxy not configured", 500)
+		return
 	}
 
-	// 优先 + 可降级：永远先试最高权重组，失败后在下一轮降级到次高权重组
-	maxWeight := 0
-	for i := range candidates {
-		w := candidates[i].Weight
-		if w <= 0 {
-			w = 100
-		}
-		if w > maxWeight {
-			maxWeight = w
-		}
-	}
-	if maxWeight <= 0 {
-		maxWeight = 100
+	if account != nil {
+		r.Header.Set("X-Kiro-Refresh-Token", account.RefreshToken)
+		r.Header.Set("X-Kiro-Region", account.Region)
+		r.Header.Set("X-Kiro-Auth-Method", account.AuthMethod)
+		r.Header.Set("X-Kiro-Client-Id", account.ClientID)
+		r.Header.Set("X-Kiro-Client-Secret", account.ClientSecret)
 	}
 
-	top := make([]config.Account, 0, len(candidates))
-	for i := range candidates {
-		w := candidates[i].Weight
-		if w <= 0 {
-			w = 100
-		}
-		if w == maxWeight {
-			top = append(top, candidates[i])
-		}
-	}
-	if len(top) == 0 {
-		chosen := candidates[rand.Intn(len(candidates))]
-		return &chosen
-	}
-	chosen := top[rand.Intn(len(top))]
-	return &chosen
+	h.gatewayProxy.ServeHTTP(w, r)
 }
 
-func (h *Handler) buildGatewayPools(accounts []config.Account) ([]config.Account, []config.Account) {
-	primary := make([]config.Account, 0)
-	fallback := make([]config.Account, 0)
-	for _, a := range accounts {
-		if !a.Enabled || a.RefreshToken == "" {
-			continue
-		}
-		if a.UsageCurrent >= 10 {
-			primary = append(primary, a)
-		} else {
-			fallback = append(fallback, a)
-		}
-	}
-	return primary, fallback
+// hopHeaders 逐跳头部，不在代理两端之间转发
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
 }
 
-func (h *Handler) pickWeightedGateway(candidates []config.Account) *config.Account {
-	if len(candidates) == 0 {
-		return nil
+// sendGatewayRequest 使用指定账号向网关发起一次请求，返回未读取的响应
+func (h *Handler) sendGatewayRequest(r *http.Request, body []byte, account *config.Account) (*http.Response, error) {
+	target := h.gatewayBase + r.URL.Path
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
 	}
-
-	// 严格优先：仅从最高权重组里选择（同权重再随机）
-	maxWeight := 0
-	for i := range candidates {
-		w := candidates[i].Weight
-		if w <= 0 {
-			w = 100
-		}
-		if w > maxWeight {
-			maxWeight = w
-		}
-	}
-	if maxWeight <= 0 {
-		maxWeight = 100
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
 	}
-
-	top := make([]config.Account, 0, len(candidates))
-	for i := range candidates {
-		w := candidates[i].Weight
-		if w <= 0 {
-			w = 100
-		}
-		if w == maxWeight {
-			top = append(top, candidates[i])
-		}
+	req.Header = r.Header.Clone()
+	for _, hh := range hopHeaders {
+		req.Header.Del(hh)
 	}
-	if len(top) == 0 {
-		chosen := candidates[rand.Intn(len(candidates))]
-		return &chosen
+	// 由 Transport 透明解压，保证可以旁路解析 usage
+	req.Header.Del("Accept-Encoding")
+	if h.gatewayAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+h.gatewayAPIKey)
 	}
+	req.Header.Set("X-Kiro-Refresh-Token", account.RefreshToken)
+	req.Header.Set("X-Kiro-Region", account.Region)
+	req.Header.Set("X-Kiro-Auth-Method", account.AuthMethod)
+	req.Header.Set("X-Kiro-Client-Id", account.ClientID)
+	req.Header.Set("X-Kiro-Client-Secret", account.ClientSecret)
 
-	chosen := top[rand.Intn(len(top))]
-	return &chosen
+	return h.gatewayClient.Do(req)
 }
 
-func (h *Handler) proxyToGatewayWithAccount(w http.ResponseWriter, r *http.Request, account *config.Account) {
-	if h.gatewayProxy == nil {
-		http.Error(w, "gateway proxy not configured", 500)
-		return
+func copyResponseHeaders(w http.ResponseWriter, header http.Header) {
+	for k, vals := range header {
+		for _, v := range vals {
+			w.Header().Add(k, v)
+		}
 	}
-
-	if account != nil {
-		r.Header.Set("X-Kiro-Refresh-Token", account.RefreshToken)
-		r.Header.Set("X-Kiro-Region", account.Region)
-		r.Header.Set("X-Kiro-Auth-Method", account.AuthMethod)
-		r.Header.Set("X-Kiro-Client-Id", account.ClientID)
-		r.Header.Set("X-Kiro-Client-Secret", account.ClientSecret)
+	for _, hh := range hopHeaders {
+		w.Header().Del(hh)
 	}
-
-	h.gatewayProxy.ServeHTTP(w, r)
 }
 
+// proxyWithFailover 网关模式跨账号重试
+// 根据状态码与头部决定是否换账号；收到 2xx/3xx 后响应体直接流式透传给客户端
 func (h *Handler) proxyWithFailover(w http.ResponseWriter, r *http.Request) {
 	if h.gatewayProxy == nil {
 		http.Error(w, "gateway proxy not configured", 500)
@@ -404,8 +384,15 @@ func (h *Handler) proxyWithFailover(w http.ResponseWriter, r *http.Request) {
 	bodyBytes, _ := io.ReadAll(r.Body)
 	r.Body.Close()
 	model := extractModelFromRequestBody(bodyBytes)
+	// 网关模式下模型映射由网关完成，按请求中的模型名检查；GET 请求（如模型列表）不指定模型
+	if r.Method != http.MethodGet {
+		if keyErr := checkApiKeyModel(r, model); keyErr != nil {
+			h.sendApiKeyError(w, r, keyErr)
+			return
+		}
+	}
 
-	maxAttempts := 4
+	maxAttempts := config.GetFailoverMaxAttempts()
 	if r.URL.Path == "/v1/models" || r.Method == http.MethodGet {
 		maxAttempts = 2
 	}
@@ -423,7 +410,18 @@ func (h *Handler) proxyWithFailover(w http.ResponseWriter, r *http.Request) {
 	tried := map[string]bool{}
 
 	for i := 0; i < maxAttempts; i++ {
-		acc := h.selectGatewayAccountWithTried(tried)
+		acc, release, err := h.pool.Acquire(r.Context(), pool.SelectOptions{Exclude: tried, Gateway: true})
+		if err != nil {
+			// 排队超时或客户端已断开
+			lastStatus = http.StatusServiceUnavailable
+			if r.Context().Err() != nil {
+				lastStatus = 499
+			}
+			lastError = err.Error()
+			lastBody = []byte(lastError)
+			lastHeader = nil
+			break
+		}
 		if acc == nil {
 			break
 		}
@@ -432,59 +430,80 @@ func (h *Handler) proxyWithFailover(w http.ResponseWriter, r *http.Request) {
 		lastAccID = acc.ID
 		lastEmail = acc.Email
 
-		cloneReq := r.Clone(r.Context())
-		cloneReq.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-		cloneReq.ContentLength = int64(len(bodyBytes))
-		if len(bodyBytes) > 0 {
-			cloneReq.GetBody = func() (io.ReadCloser, error) {
-				return io.NopCloser(bytes.NewReader(bodyBytes)), nil
+		tryStart := time.Now()
+		resp, err := h.sendGatewayRequest(r, bodyBytes, acc)
+		if err != nil {
+			release()
+			// 客户端已断开，无需重试
+			if r.Context().Err() != nil {
+				lastStatus = 499
+				lastError = err.Error()
+				attemptItems = append(attemptItems, RequestLogAttempt{
+					Try:        len(attemptItems) + 1,
+					AccountID:  acc.ID,
+					Email:      acc.Email,
+					StatusCode: lastStatus,
+					DurationMs: time.Since(tryStart).Milliseconds(),
+					Error:      truncateError(lastError),
+				})
+				break
 			}
+			// 网络错误，换账号重试
+			h.pool.RecordError(acc.ID, pool.ErrorTransient, 0)
+			lastStatus = http.StatusBadGateway
+			lastBody = []byte(err.Error())
+			lastHeader = nil
+			lastError = err.Error()
+			attemptItems = append(attemptItems, RequestLogAttempt{
+				Try:        len(attemptItems) + 1,
+				AccountID:  acc.ID,
+				Email:      acc.Email,
+				StatusCode: lastStatus,
+				DurationMs: time.Since(tryStart).Milliseconds(),
+				Error:      truncateError(lastError),
+			})
+			continue
 		}
 
-		tryStart := time.Now()
-		rec := httptest.NewRecorder()
-		h.proxyToGatewayWithAccount(rec, cloneReq, acc)
-		resp := rec.Result()
-		respBody, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-
-		lastStatus = resp.StatusCode
-		lastBody = respBody
-		lastHeader = resp.Header.Clone()
-		if resp.StatusCode >= 400 {
-			lastError = string(respBody)
-		} else {
-			lastError = ""
-		}
+		// success：流式透传，边转发边解析 usage
+		if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+			copyResponseHeaders(w, resp.Header)
+			w.Header().Del("Content-Length")
+			w.WriteHeader(resp.StatusCode)
 
-		attemptItems = append(attemptItems, RequestLogAttempt{
-			Try:        len(attemptItems) + 1,
-			AccountID:  acc.ID,
-			Email:      acc.Email,
-			StatusCode: resp.StatusCode,
-			DurationMs: time.Since(tryStart).Milliseconds(),
-			Error:      truncateError(lastError),
-		})
+			sniffer := newUsageSniffer(resp.Header.Get("Content-Type"))
+			streamErr := copyAndFlush(w, resp.Body, sniffer)
+			resp.Body.Close()
+			release()
+			totalTokens, credits := sniffer.Finish()
+			h.pool.RecordOutputTokens(acc.ID, sniffer.outputTokens)
 
-		// success
-		if resp.StatusCode >= 200 && resp.StatusCode < 400 {
-			for k, vals := range resp.Header {
-				for _, v := range vals {
-					w.Header().Add(k, v)
-				}
+			streamError := ""
+			if streamErr != nil {
+				streamError = truncateError("stream interrupted: " + streamErr.Error())
+			} else {
+				// 与原生模式一致：成功后重置连续错误计数并结束冷却
+				h.pool.RecordSuccess(acc.ID)
 			}
-			w.WriteHeader(resp.StatusCode)
-			_, _ = w.Write(respBody)
+			attemptItems = append(attemptItems, RequestLogAttempt{
+				Try:        len(attemptItems) + 1,
+				AccountID:  acc.ID,
+				Email:      acc.Email,
+				StatusCode: resp.StatusCode,
+				DurationMs: time.Since(tryStart).Milliseconds(),
+				Error:      streamError,
+			})
 
-			totalTokens, credits := extractUsageMetrics(respBody)
 			h.finalizeRequest(RequestFinalMetrics{
 				Path:         r.URL.Path,
 				Model:        model,
 				AccountID:    acc.ID,
 				AccountEmail: acc.Email,
+				ApiKey:       apiKeyFromContext(r.Context()),
 				Attempts:     len(attemptItems),
 				FinalStatus:  resp.StatusCode,
 				DurationMs:   time.Since(reqStart).Milliseconds(),
+				Error:        streamError,
 				AttemptItems: attemptItems,
 				TotalTokens:  totalTokens,
 				Credits:      credits,
@@ -492,19 +511,33 @@ func (h *Handler) proxyWithFailover(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		release()
+
+		lastStatus = resp.StatusCode
+		lastBody = respBody
+		lastHeader = resp.Header.Clone()
+		lastError = string(respBody)
+
+		attemptItems = append(attemptItems, RequestLogAttempt{
+			Try:        len(attemptItems) + 1,
+			AccountID:  acc.ID,
+			Email:      acc.Email,
+			StatusCode: resp.StatusCode,
+			DurationMs: time.Since(tryStart).Milliseconds(),
+			Error:      truncateError(lastError),
+		})
+
 		// classify failover conditions
 		if resp.StatusCode == 402 || resp.StatusCode == 429 || resp.StatusCode >= 500 {
 			// mark cooldown in pool
-			h.pool.RecordError(acc.ID, resp.StatusCode == 402 || resp.StatusCode == 429)
+			h.pool.RecordError(acc.ID, cooldownKind(resp.StatusCode, string(respBody)), parseRetryAfter(resp.Header.Get("Retry-After")))
 			continue
 		}
 
 		// non-retryable, return immediately
-		for k, vals := range resp.Header {
-			for _, v := range vals {
-				w.Header().Add(k, v)
-			}
-		}
+		copyResponseHeaders(w, resp.Header)
 		w.WriteHeader(resp.StatusCode)
 		_, _ = w.Write(respBody)
 
@@ -513,6 +546,7 @@ func (h *Handler) proxyWithFailover(w http.ResponseWriter, r *http.Request) {
 			Model:        model,
 			AccountID:    acc.ID,
 			AccountEmail: acc.Email,
+			ApiKey:       apiKeyFromContext(r.Context()),
 			Attempts:     len(attemptItems),
 			FinalStatus:  resp.StatusCode,
 			DurationMs:   time.Since(reqStart).Milliseconds(),
@@ -526,13 +560,9 @@ func (h *Handler) proxyWithFailover(w http.ResponseWriter, r *http.Request) {
 		lastStatus = http.StatusServiceUnavailable
 		lastError = "no available account"
 		http.Error(w, "no available account", http.StatusServiceUnavailable)
-	} else {
+	} else if lastStatus != 499 {
 		if lastHeader != nil {
-			for k, vals := range lastHeader {
-				for _, v := range vals {
-					w.Header().Add(k, v)
-				}
-			}
+			copyResponseHeaders(w, lastHeader)
 		}
 		w.WriteHeader(lastStatus)
 		_, _ = w.Write(lastBody)
@@ -543,6 +573,7 @@ func (h *Handler) proxyWithFailover(w http.ResponseWriter, r *http.Request) {
 		Model:        model,
 		AccountID:    lastAccID,
 		AccountEmail: lastEmail,
+		ApiKey:       apiKeyFromContext(r.Context()),
 		Attempts:     max(1, len(attemptItems)),
 		FinalStatus:  lastStatus,
 		DurationMs:   time.Since(reqStart).Milliseconds(),
@@ -564,8 +595,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// CORS - 完整的头部支持
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Api-Key, anthropic-version, anthropic-beta, x-api-key, x-stainless-os, x-stainless-lang, x-stainless-package-version, x-stainless-runtime, x-stainless-runtime-version, x-stainless-arch")
-	w.Header().Set("Access-Control-Expose-Headers", "x-request-id, x-ratelimit-limit-requests, x-ratelimit-limit-tokens, x-ratelimit-remaining-requests, x-ratelimit-remaining-tokens, x-ratelimit-reset-requests, x-ratelimit-reset-tokens")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Api-Key, X-Session-Id, anthropic-version, anthropic-beta, x-api-key, x-stainless-os, x-stainless-lang, x-stainless-package-version, x-stainless-runtime, x-stainless-runtime-version, x-stainless-arch")
+	w.Header().Set("Access-Control-Expose-Headers", "x-request-id, x-kiro-model, x-ratelimit-limit-requests, x-ratelimit-limit-tokens, x-ratelimit-remaining-requests, x-ratelimit-remaining-tokens, x-ratelimit-reset-requests, x-ratelimit-reset-tokens")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(204)
@@ -573,11 +604,12 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 路由
+	var keyErr *apiKeyError
 	switch {
 	// API 端点（需要验证 API Key）
 	case path == "/v1/messages" || path == "/messages" || path == "/anthropic/v1/messages":
-		if !h.validateApiKey(r) {
-			h.sendClaudeError(w, 401, "authentication_error", "Invalid or missing API key")
+		if r, keyErr = h.validateApiKey(r, config.ApiKeyEndpointClaude); keyErr != nil {
+			h.sendApiKeyError(w, r, keyErr)
 			return
 		}
 		if h.useGatewayProxy() {
@@ -586,8 +618,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		h.handleClaudeMessages(w, r)
 	case path == "/v1/messages/count_tokens" || path == "/messages/count_tokens":
-		if !h.validateApiKey(r) {
-			h.sendClaudeError(w, 401, "authentication_error", "Invalid or missing API key")
+		if r, keyErr = h.validateApiKey(r, config.ApiKeyEndpointClaude); keyErr != nil {
+			h.sendApiKeyError(w, r, keyErr)
 			return
 		}
 		if h.useGatewayProxy() {
@@ -596,8 +628,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		h.handleCountTokens(w, r)
 	case path == "/v1/chat/completions" || path == "/chat/completions":
-		if !h.validateApiKey(r) {
-			h.sendOpenAIError(w, 401, "authentication_error", "Invalid or missing API key")
+		if r, keyErr = h.validateApiKey(r, config.ApiKeyEndpointOpenAI); keyErr != nil {
+			h.sendApiKeyError(w, r, keyErr)
 			return
 		}
 		if h.useGatewayProxy() {
@@ -630,10 +662,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// 统计端点（需要 API Key 鉴权）
 	case path == "/v1/stats":
-		if !h.validateApiKey(r) {
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			w.WriteHeader(401)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid or missing API key"})
+		if r, keyErr = h.validateApiKey(r, config.ApiKeyEndpointStats); keyErr != nil {
+			h.sendApiKeyError(w, r, keyErr)
 			return
 		}
 		h.handleStats(w, r)
@@ -672,22 +702,27 @@ func (h *Handler) handleStats(w http.ResponseWriter, r *http.Request) {
 
 // handleModels 模型列表
 func (h *Handler) handleModels(w http.ResponseWriter, r *http.Request) {
-	// 尝试用缓存的真实模型列表
-	h.modelsCacheMu.RLock()
-	cached := h.cachedModels
-	h.modelsCacheMu.RUnlock()
+	// 优先使用池中账号可用模型的并集，其次为缓存的真实模型列表
+	modelIDs := h.pool.Models()
+	if len(modelIDs) == 0 {
+		h.modelsCacheMu.RLock()
+		for _, m := range h.cachedModels {
+			modelIDs = append(modelIDs, m.ModelId)
+		}
+		h.modelsCacheMu.RUnlock()
+	}
 
 	thinkingSuffix := config.GetThinkingConfig().Suffix
 
 	var models []map[string]interface{}
-	if len(cached) > 0 {
-		for _, m := range cached {
+	if len(modelIDs) > 0 {
+		for _, id := range modelIDs {
 			models = append(models, map[string]interface{}{
-				"id": m.ModelId, "object": "model", "owned_by": "anthropic",
+				"id": id, "object": "model", "owned_by": "anthropic",
 			})
 			// 自动生成 thinking 变体
 			models = append(models, map[string]interface{}{
-				"id": m.ModelId + thinkingSuffix, "object": "model", "owned_by": "anthropic",
+				"id": id + thinkingSuffix, "object": "model", "owned_by": "anthropic",
 			})
 		}
 	} else {
@@ -705,12 +740,14 @@ func (h *Handler) handleModels(w http.ResponseWriter, r *http.Request) {
 			{"id": "claude-opus-4.5" + thinkingSuffix, "object": "model", "owned_by": "anthropic"},
 		}
 	}
-	// 添加别名模型
-	models = append(models,
-		map[string]interface{}{"id": "auto", "object": "model", "owned_by": "kiro-proxy"},
-		map[string]interface{}{"id": "gpt-4o", "object": "model", "owned_by": "kiro-proxy"},
-		map[string]interface{}{"id": "gpt-4", "object": "model", "owned_by": "kiro-proxy"},
-	)
+	// 添加精确匹配的别名模型
+	for _, alias := range config.GetModelAliases() {
+		if alias.Match == config.MatchExact && !alias.Disabled {
+			models = append(models, map[string]interface{}{
+				"id": alias.Pattern, "object": "model", "owned_by": "kiro-proxy",
+			})
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -738,8 +775,8 @@ func (h *Handler) refreshModelsCache() {
 	}
 
 	if len(models) > 0 {
+		h.setAccountModels(account.ID, models)
 		h.modelsCacheMu.Lock()
-		h.cachedModels = models
 		h.modelsCacheTime = time.Now().Unix()
 		h.modelsCacheMu.Unlock()
 		fmt.Printf("[ModelsCache] Cached %d models\n", len(models))
@@ -759,53 +796,23 @@ func (h *Handler) handleCountTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Messages []struct {
-			Role    string      `json:"role"`
-			Content interface{} `json:"content"`
-		} `json:"messages"`
-		System interface{} `json:"system"`
-	}
+	var req ClaudeRequest
 	if err := json.Unmarshal(body, &req); err != nil {
 		h.sendClaudeError(w, 400, "invalid_request_error", "Invalid JSON")
 		return
 	}
-
-	// 简单估算 token 数量（每 4 个字符约 1 个 token）
-	var totalChars int
-	for _, msg := range req.Messages {
-		switch content := msg.Content.(type) {
-		case string:
-			totalChars += len(content)
-		case []interface{}:
-			for _, part := range content {
-				if p, ok := part.(map[string]interface{}); ok {
-					if text, ok := p["text"].(string); ok {
-						totalChars += len(text)
-					}
-				}
-			}
-		}
+	// 按别名解析后的模型检查 API Key 权限，无法解析时按请求中的模型名检查
+	model := req.Model
+	if resolved, err := h.resolveModel(req.Model); err == nil {
+		model = resolved.Model
 	}
-
-	// 系统提示
-	switch system := req.System.(type) {
-	case string:
-		totalChars += len(system)
-	case []interface{}:
-		for _, part := range system {
-			if p, ok := part.(map[string]interface{}); ok {
-				if text, ok := p["text"].(string); ok {
-					totalChars += len(text)
-				}
-			}
-		}
+	if keyErr := checkApiKeyModel(r, model); keyErr != nil {
+		h.sendApiKeyError(w, r, keyErr)
+		return
 	}
 
-	estimatedTokens := (totalChars + 3) / 4 // 向上取整
-	if estimatedTokens < 1 {
-		estimatedTokens = 1
-	}
+	// 系统提示、消息（含工具调用/结果、图片、文档）与工具定义
+	estimatedTokens := countClaudeRequestTokens(&req)
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(map[string]int{"input_tokens": estimatedTokens})
@@ -833,88 +840,95 @@ func (h *Handler) handleClaudeMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 获取账号
-	account := h.pool.GetNext()
-	if account == nil {
-		h.sendClaudeError(w, 503, "api_error", "No available accounts")
-		h.finalizeRequest(RequestFinalMetrics{
-			Path:        r.URL.Path,
-			Model:       req.Model,
-			Attempts:    1,
-			FinalStatus: 503,
-			DurationMs:  time.Since(requestStart).Milliseconds(),
-			Error:       "No available accounts",
-			AttemptItems: []RequestLogAttempt{{
-				Try:        1,
-				StatusCode: 503,
-				Error:      "No available accounts",
-				DurationMs: time.Since(requestStart).Milliseconds(),
-			}},
-		})
+	// 解析模型和 thinking 模式（模型后缀、请求参数或别名默认值均可开启）
+	resolved, err := h.resolveModel(req.Model)
+	if err != nil {
+		h.sendClaudeError(w, 404, "not_found_error", err.Error())
 		return
 	}
-
-	// 检查并刷新 token
-	if err := h.ensureValidToken(account); err != nil {
-		h.sendClaudeError(w, 503, "api_error", "Token refresh failed: "+err.Error())
-		h.finalizeRequest(RequestFinalMetrics{
-			Path:         r.URL.Path,
-			Model:        req.Model,
-			AccountID:    account.ID,
-			AccountEmail: account.Email,
-			Attempts:     1,
-			FinalStatus:  503,
-			DurationMs:   time.Since(requestStart).Milliseconds(),
-			Error:        truncateError(err.Error()),
-			AttemptItems: []RequestLogAttempt{{
-				Try:        1,
-				AccountID:  account.ID,
-				Email:      account.Email,
-				StatusCode: 503,
-				Error:      truncateError(err.Error()),
-				DurationMs: time.Since(requestStart).Milliseconds(),
-			}},
-		})
+	if keyErr := checkApiKeyModel(r, resolved.Model); keyErr != nil {
+		h.sendApiKeyError(w, r, keyErr)
 		return
 	}
-
-	// 解析模型和 thinking 模式
-	thinkingCfg := config.GetThinkingConfig()
-	actualModel, thinking := ParseModelAndThinking(req.Model, thinkingCfg.Suffix)
-	req.Model = actualModel
+	req.Model = resolved.Model
+	resolved.applyDefaults(&req.Temperature, &req.MaxTokens)
 
 	// 转换请求
-	kiroPayload := ClaudeToKiro(&req, thinking)
+	kiroPayload := ClaudeToKiro(&req, resolved.thinkingBudget(req.ThinkingBudget(), req.Thinking != nil))
+	h.trimToContextWindow(kiroPayload)
+
+	// 会话粘性：同一会话复用账号与 conversationId
+	session := h.sessions.Route(claudeSessionKey(r, &req))
+	session.apply(kiroPayload)
+
+	opts := responseOptions{
+		ToolChoice:    req.ParsedToolChoice(),
+		StopSequences: req.StopSequences,
+		MaxTokens:     req.MaxTokens,
+	}
+
+	// 跨账号重试，直到首个字节写出
+	cw := &commitWriter{ResponseWriter: w}
+	// 所有账号都因配额/容量失败时按 fallback 链换模型
+	res := h.executeWithModelFallback(r.Context(), cw, kiroPayload, req.Model, session, func(model string) upstreamAttempt {
+		return withContextRetry(kiroPayload, withOutputRetry(opts, func(account *config.Account) (kiroUsage, error) {
+			if req.Stream {
+				return h.handleClaudeStream(cw, account, kiroPayload, model, opts)
+			}
+			return h.handleClaudeNonStream(cw, account, kiroPayload, model, opts)
+		}))
+	})
+	res.Trims = kiroPayload.trims
+	h.sessions.Bind(session, res, kiroPayload)
 
-	// 流式或非流式
-	if req.Stream {
-		h.handleClaudeStream(w, account, kiroPayload, req.Model, requestStart)
-	} else {
-		h.handleClaudeNonStream(w, account, kiroPayload, req.Model, requestStart)
+	if res.Err != nil && !cw.committed {
+		status, errType := clientErrorStatus(res)
+		h.sendClaudeError(w, status, errType, res.Err.Error())
 	}
+	h.finalizeFailover(r, req.Model, requestStart, res)
 }
 
 // handleClaudeStream Claude 流式响应
-func (h *Handler) handleClaudeStream(w http.ResponseWriter, account *config.Account, payload *KiroPayload, model string, requestStart time.Time) {
+// message_start 延迟到首个事件时发送，上游失败前未写出任何数据时可换账号重试
+func (h *Handler) handleClaudeStream(w http.ResponseWriter, account *config.Account, payload *KiroPayload, model string, opts responseOptions) (kiroUsage, error) {
 	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		h.sendClaudeError(w, 500, "api_error", "Streaming not supported")
-		return
+		return kiroUsage{}, errStreamingUnsupported
 	}
 
 	// 获取 thinking 输出格式配置
 	thinkingFormat := config.GetThinkingConfig().ClaudeFormat
 
 	msgID := "msg_" + uuid.New().String()
-	var contentStarted bool
-	var toolUseIndex int
+	var messageStarted bool
 	var inputTokens, outputTokens int
+	var cacheRead, cacheWrite int
 	var credits float64
 	var toolUses []KiroToolUse
+	blocks := newClaudeBlockWriter(h, w, flusher)
+	limiter := newOutputLimiter(opts.StopSequences, opts.MaxTokens)
+
+	// 发送 message_start（仅一次）
+	startMessage := func() {
+		if messageStarted {
+			return
+		}
+		messageStarted = true
+		h.sendSSE(w, flusher, "message_start", map[string]interface{}{
+			"type": "message_start",
+			"message": map[string]interface{}{
+				"id":      msgID,
+				"type":    "message",
+				"role":    "assistant",
+				"content": []interface{}{},
+				"model":   model,
+			},
+		})
+	}
 
 	// Thinking 标签解析状态
 	var textBuffer string
@@ -923,61 +937,49 @@ func (h *Handler) handleClaudeStream(w http.ResponseWriter, account *config.Acco
 	// 发送文本的辅助函数
 	// thinkingState: 0=普通内容, 1=thinking开始, 2=thinking中间, 3=thinking结束
 	sendText := func(text string, thinkingState int) {
-		// 确保 content_block 已开始
-		if !contentStarted {
-			h.sendSSE(w, flusher, "content_block_start", map[string]interface{}{
-				"type":          "content_block_start",
-				"index":         0,
-				"content_block": map[string]string{"type": "text", "text": ""},
-			})
-			contentStarted = true
-		}
+		startMessage()
 
 		if thinkingState == 0 {
 			// 普通内容
-			if text == "" {
-				return
+			blocks.Text(text)
+			return
+		}
+
+		// thinking 内容
+		var outputText string
+		switch thinkingFormat {
+		case "native":
+			// 原生 thinking 内容块
+			if text != "" || thinkingState == 1 {
+				blocks.Thinking(text)
 			}
-			h.sendSSE(w, flusher, "content_block_delta", map[string]interface{}{
-				"type":  "content_block_delta",
-				"index": 0,
-				"delta": map[string]string{"type": "text_delta", "text": text},
-			})
-		} else {
-			// thinking 内容
-			var outputText string
-			switch thinkingFormat {
-			case "think":
-				switch thinkingState {
-				case 1:
-					outputText = "<think>" + text
-				case 2:
-					outputText = text
-				case 3:
-					outputText = text + "</think>"
-				}
-			case "reasoning_content":
-				// Claude 格式不支持 reasoning_content，直接输出内容
+			if thinkingState == 3 {
+				blocks.EndThinking()
+			}
+			return
+		case "think":
+			switch thinkingState {
+			case 1:
+				outputText = "<think>" + text
+			case 2:
 				outputText = text
-			default: // "thinking"
-				switch thinkingState {
-				case 1:
-					outputText = "<thinking>" + text
-				case 2:
-					outputText = text
-				case 3:
-					outputText = text + "</thinking>"
-				}
+			case 3:
+				outputText = text + "</think>"
 			}
-			if outputText == "" {
-				return
+		case "reasoning_content":
+			// Claude 格式不支持 reasoning_content，直接输出内容
+			outputText = text
+		default: // "thinking"
+			switch thinkingState {
+			case 1:
+				outputText = "<thinking>" + text
+			case 2:
+				outputText = text
+			case 3:
+				outputText = text + "</thinking>"
 			}
-			h.sendSSE(w, flusher, "content_block_delta", map[string]interface{}{
-				"type":  "content_block_delta",
-				"index": 0,
-				"delta": map[string]string{"type": "text_delta", "text": outputText},
-			})
 		}
+		blocks.Text(outputText)
 	}
 
 	// 处理文本，解析 <thinking> 标签
@@ -995,6 +997,12 @@ func (h *Handler) handleClaudeStream(w http.ResponseWriter, account *config.Acco
 			return
 		}
 
+		// reasoningContentEvent 结束，关闭 thinking 输出
+		if thinkingStarted && !inThinkingBlock {
+			sendText("", 3)
+			thinkingStarted = false
+		}
+
 		textBuffer += text
 
 		for {
@@ -1067,163 +1075,94 @@ func (h *Handler) handleClaudeStream(w http.ResponseWriter, account *config.Acco
 		}
 	}
 
-	// 发送 message_start
-	h.sendSSE(w, flusher, "message_start", map[string]interface{}{
-		"type": "message_start",
-		"message": map[string]interface{}{
-			"id":      msgID,
-			"type":    "message",
-			"role":    "assistant",
-			"content": []interface{}{},
-			"model":   model,
-		},
-	})
-
 	callback := &KiroStreamCallback{
 		OnText: func(text string, isThinking bool) {
-			if text == "" {
+			// 强制工具调用时只输出工具调用
+			if text == "" || opts.ToolChoice.Required() {
 				return
 			}
+			if !isThinking {
+				text = limiter.Text(text)
+			}
 			processClaudeText(text, isThinking, false)
 		},
+		OnToolUseStart: func(id, name string) {
+			if limiter.Stopped() || !opts.ToolChoice.accepts(KiroToolUse{Name: name}) {
+				return
+			}
+			// 先刷新缓冲区
+			processClaudeText(limiter.Flush(), false, true)
+			startMessage()
+			blocks.StartToolUse(id, name)
+		},
+		OnToolUseDelta: func(id, partialJSON string) {
+			blocks.ToolInputDelta(id, partialJSON)
+		},
 		OnToolUse: func(tu KiroToolUse) {
+			if limiter.Stopped() || !opts.ToolChoice.accepts(tu) {
+				return
+			}
 			// 先刷新缓冲区
-			processClaudeText("", false, true)
+			processClaudeText(limiter.Flush(), false, true)
 
 			toolUses = append(toolUses, tu)
-
-			// 关闭文本块
-			if contentStarted && toolUseIndex == 0 {
-				h.sendSSE(w, flusher, "content_block_stop", map[string]interface{}{
-					"type":  "content_block_stop",
-					"index": 0,
-				})
-			}
-
-			idx := toolUseIndex
-			if contentStarted {
-				idx = toolUseIndex + 1
-			}
-			toolUseIndex++
-
-			h.sendSSE(w, flusher, "content_block_start", map[string]interface{}{
-				"type":  "content_block_start",
-				"index": idx,
-				"content_block": map[string]interface{}{
-					"type":  "tool_use",
-					"id":    tu.ToolUseID,
-					"name":  tu.Name,
-					"input": map[string]interface{}{},
-				},
-			})
-
-			inputJSON, _ := json.Marshal(tu.Input)
-			h.sendSSE(w, flusher, "content_block_delta", map[string]interface{}{
-				"type":  "content_block_delta",
-				"index": idx,
-				"delta": map[string]interface{}{
-					"type":         "input_json_delta",
-					"partial_json": string(inputJSON),
-				},
-			})
-
-			h.sendSSE(w, flusher, "content_block_stop", map[string]interface{}{
-				"type":  "content_block_stop",
-				"index": idx,
-			})
+			startMessage()
+			blocks.ToolUse(tu)
 		},
 		OnComplete: func(inTok, outTok int) {
 			inputTokens = inTok
 			outputTokens = outTok
 		},
-		OnError: func(err error) {
-			h.pool.RecordError(account.ID, strings.Contains(err.Error(), "429") || strings.Contains(err.Error(), "quota"))
-		},
 		OnCredits: func(c float64) {
 			credits = c
 		},
+		OnCacheUsage: func(read, write int) {
+			cacheRead, cacheWrite = read, write
+		},
+		ShouldStop: limiter.Stopped,
 	}
 
 	err := CallKiroAPI(account, payload, callback)
 	if err != nil {
-		h.pool.RecordError(account.ID, strings.Contains(err.Error(), "429") || strings.Contains(err.Error(), "quota"))
-		h.sendSSE(w, flusher, "error", map[string]interface{}{
-			"type":  "error",
-			"error": map[string]string{"type": "api_error", "message": err.Error()},
-		})
-		h.finalizeRequest(RequestFinalMetrics{
-			Path:         "/v1/messages",
-			Model:        model,
-			AccountID:    account.ID,
-			AccountEmail: account.Email,
-			Attempts:     1,
-			FinalStatus:  500,
-			DurationMs:   time.Since(requestStart).Milliseconds(),
-			Error:        truncateError(err.Error()),
-			AttemptItems: []RequestLogAttempt{{
-				Try:        1,
-				AccountID:  account.ID,
-				Email:      account.Email,
-				StatusCode: 500,
-				Error:      truncateError(err.Error()),
-				DurationMs: time.Since(requestStart).Milliseconds(),
-			}},
-		})
-		return
+		// 已开始输出则只能在流内报错，否则交给上层换账号重试
+		if messageStarted {
+			h.sendSSE(w, flusher, "error", map[string]interface{}{
+				"type":  "error",
+				"error": map[string]string{"type": "api_error", "message": err.Error()},
+			})
+		}
+		return kiroUsage{}, err
 	}
 
-	// 刷新剩余缓冲区
-	processClaudeText("", false, true)
+	// 强制工具调用未满足：此时尚未写出任何数据，交给上层重试
+	if opts.ToolChoice.Required() && len(toolUses) == 0 {
+		return kiroUsage{}, errToolChoiceUnsatisfied
+	}
 
-	h.recordSuccess(inputTokens, outputTokens, credits, 1)
-	h.pool.RecordSuccess(account.ID)
-	h.pool.UpdateStats(account.ID, inputTokens+outputTokens, credits)
+	// 刷新剩余缓冲区
+	processClaudeText(limiter.Flush(), false, true)
+	startMessage()
 
 	// 关闭最后的内容块
-	if contentStarted && toolUseIndex == 0 {
-		h.sendSSE(w, flusher, "content_block_stop", map[string]interface{}{
-			"type":  "content_block_stop",
-			"index": 0,
-		})
-	}
+	blocks.Close()
 
-	// 发送 message_delta
-	stopReason := "end_turn"
-	if len(toolUses) > 0 {
-		stopReason = "tool_use"
-	}
+	usage := kiroUsage{InputTokens: inputTokens, OutputTokens: outputTokens, CacheReadTokens: cacheRead, CacheWriteTokens: cacheWrite, Credits: credits}
 
+	// 发送 message_delta
 	h.sendSSE(w, flusher, "message_delta", map[string]interface{}{
 		"type": "message_delta",
 		"delta": map[string]interface{}{
-			"stop_reason": stopReason,
-		},
-		"usage": map[string]int{
-			"input_tokens":  inputTokens,
-			"output_tokens": outputTokens,
+			"stop_reason":   limiter.ClaudeStopReason(len(toolUses) > 0, outputTokens),
+			"stop_sequence": limiter.stopSequenceValue(),
 		},
+		"usage": usage.claudeUsage(),
 	})
 
 	h.sendSSE(w, flusher, "message_stop", map[string]interface{}{
 		"type": "message_stop",
 	})
 
-	h.appendRequestLog(RequestFinalMetrics{
-		Path:         "/v1/messages",
-		Model:        model,
-		AccountID:    account.ID,
-		AccountEmail: account.Email,
-		Attempts:     1,
-		FinalStatus:  200,
-		DurationMs:   time.Since(requestStart).Milliseconds(),
-		AttemptItems: []RequestLogAttempt{{
-			Try:        1,
-			AccountID:  account.ID,
-			Email:      account.Email,
-			StatusCode: 200,
-			DurationMs: time.Since(requestStart).Milliseconds(),
-		}},
-	})
+	return usage, nil
 }
 
 func (h *Handler) sendSSE(w http.ResponseWriter, flusher http.Flusher, event string, data interface{}) {
@@ -1308,16 +1247,25 @@ func (h *Handler) appendRequestLog(m RequestFinalMetrics) {
 		return
 	}
 	entry := RequestLogEntry{
-		Time:         time.Now().Unix(),
-		Path:         m.Path,
-		Model:        m.Model,
-		AccountID:    m.AccountID,
-		Email:        m.AccountEmail,
-		Attempts:     max(1, m.Attempts),
-		FinalStatus:  m.FinalStatus,
-		DurationMs:   m.DurationMs,
-		Error:        m.Error,
-		AttemptItems: m.AttemptItems,
+		Time:             time.Now().Unix(),
+		Path:             m.Path,
+		Model:            m.Model,
+		RequestedModel:   m.RequestedModel,
+		AccountID:        m.AccountID,
+		Email:            m.AccountEmail,
+		Attempts:         max(1, m.Attempts),
+		FinalStatus:      m.FinalStatus,
+		DurationMs:       m.DurationMs,
+		Error:            m.Error,
+		AttemptItems:     m.AttemptItems,
+		HistoryTrims:     m.HistoryTrims,
+		InputTokens:      m.InputTokens,
+		OutputTokens:     m.OutputTokens,
+		CacheReadTokens:  m.CacheReadTokens,
+		CacheWriteTokens: m.CacheWriteTokens,
+	}
+	if m.ApiKey != nil {
+		entry.ApiKeyID, entry.ApiKeyName = m.ApiKey.ID, m.ApiKey.Name
 	}
 	h.requestLogs.Add(entry)
 }
@@ -1338,6 +1286,7 @@ func (h *Handler) finalizeRequest(m RequestFinalMetrics) {
 	if m.FinalStatus >= 200 && m.FinalStatus < 400 {
 		h.recordSuccess(0, 0, 0, attempts)
 		h.recordAttemptFailure(max(0, attemptFailures))
+		h.cacheStats.Record(m)
 	} else {
 		h.recordFailure(max(attempts, attemptFailures))
 	}
@@ -1353,40 +1302,13 @@ func (h *Handler) finalizeRequest(m RequestFinalMetrics) {
 	h.appendRequestLog(m)
 }
 
-func extractUsageMetrics(body []byte) (int, float64) {
+func extractModelFromRequestBody(body []byte) string {
 	if len(body) == 0 {
-		return 0, 0
+		return ""
 	}
 	var obj map[string]interface{}
 	if err := json.Unmarshal(body, &obj); err != nil {
-		return 0, 0
-	}
-
-	totalTokens := 0
-	if usage, ok := obj["usage"].(map[string]interface{}); ok {
-		if v, ok := usage["total_tokens"].(float64); ok {
-			totalTokens = int(v)
-		} else {
-			pt, _ := usage["prompt_tokens"].(float64)
-			ct, _ := usage["completion_tokens"].(float64)
-			totalTokens = int(pt + ct)
-		}
-	}
-
-	credits := 0.0
-	if v, ok := obj["credits"].(float64); ok {
-		credits = v
-	}
-	return totalTokens, credits
-}
-
-func extractModelFromRequestBody(body []byte) string {
-	if len(body) == 0 {
-		return ""
-	}
-	var obj map[string]interface{}
-	if err := json.Unmarshal(body, &obj); err != nil {
-		return ""
+		return ""
 	}
 	if m, ok := obj["model"].(string); ok {
 		return m
@@ -1403,69 +1325,64 @@ func truncateError(err string) string {
 }
 
 // handleClaudeNonStream Claude 非流式响应
-func (h *Handler) handleClaudeNonStream(w http.ResponseWriter, account *config.Account, payload *KiroPayload, model string, requestStart time.Time) {
+func (h *Handler) handleClaudeNonStream(w http.ResponseWriter, account *config.Account, payload *KiroPayload, model string, opts responseOptions) (kiroUsage, error) {
 	var content string
 	var thinkingContent string
 	var toolUses []KiroToolUse
 	var inputTokens, outputTokens int
+	var cacheRead, cacheWrite int
 	var credits float64
+	limiter := newOutputLimiter(opts.StopSequences, opts.MaxTokens)
 
 	callback := &KiroStreamCallback{
 		OnText: func(text string, isThinking bool) {
 			if isThinking {
 				thinkingContent += text
 			} else {
-				content += text
+				content += limiter.Text(text)
 			}
 		},
 		OnToolUse: func(tu KiroToolUse) {
-			toolUses = append(toolUses, tu)
+			if !limiter.Stopped() && opts.ToolChoice.accepts(tu) {
+				toolUses = append(toolUses, tu)
+			}
 		},
 		OnComplete: func(inTok, outTok int) {
 			inputTokens = inTok
 			outputTokens = outTok
 		},
-		OnError: func(err error) {
-			h.pool.RecordError(account.ID, strings.Contains(err.Error(), "429"))
-		},
 		OnCredits: func(c float64) {
 			credits = c
 		},
+		OnCacheUsage: func(read, write int) {
+			cacheRead, cacheWrite = read, write
+		},
+		ShouldStop: limiter.Stopped,
 	}
 
-	err := CallKiroAPI(account, payload, callback)
-	if err != nil {
-		h.pool.RecordError(account.ID, strings.Contains(err.Error(), "429"))
-		h.sendClaudeError(w, 500, "api_error", err.Error())
-		h.finalizeRequest(RequestFinalMetrics{
-			Path:         "/v1/messages",
-			Model:        model,
-			AccountID:    account.ID,
-			AccountEmail: account.Email,
-			Attempts:     1,
-			FinalStatus:  500,
-			DurationMs:   time.Since(requestStart).Milliseconds(),
-			Error:        truncateError(err.Error()),
-			AttemptItems: []RequestLogAttempt{{
-				Try:        1,
-				AccountID:  account.ID,
-				Email:      account.Email,
-				StatusCode: 500,
-				Error:      truncateError(err.Error()),
-				DurationMs: time.Since(requestStart).Milliseconds(),
-			}},
-		})
-		return
+	if err := CallKiroAPI(account, payload, callback); err != nil {
+		return kiroUsage{}, err
 	}
+	content += limiter.Flush()
 
-	h.recordSuccess(inputTokens, outputTokens, credits, 1)
-	h.pool.RecordSuccess(account.ID)
-	h.pool.UpdateStats(account.ID, inputTokens+outputTokens, credits)
+	// 强制工具调用：未满足时交给上层重试，满足时只返回工具调用
+	if opts.ToolChoice.Required() {
+		if len(toolUses) == 0 {
+			return kiroUsage{}, errToolChoiceUnsatisfied
+		}
+		content, thinkingContent = "", ""
+	}
 
 	// 合并 thinking 内容（如果有 reasoningContentEvent 的内容）
 	thinkingFormat := config.GetThinkingConfig().ClaudeFormat
 	finalContent := content
-	if thinkingContent != "" {
+	var nativeThinking string
+	if thinkingFormat == "native" {
+		// 原生 thinking 块：同时提取正文中的 <thinking> 标签
+		var tagThinking string
+		finalContent, tagThinking = extractThinkingFromContent(content)
+		nativeThinking = thinkingContent + tagThinking
+	} else if thinkingContent != "" {
 		switch thinkingFormat {
 		case "think":
 			finalContent = "<think>" + thinkingContent + "</think>" + content
@@ -1476,26 +1393,15 @@ func (h *Handler) handleClaudeNonStream(w http.ResponseWriter, account *config.A
 		}
 	}
 
-	resp := KiroToClaudeResponse(finalContent, toolUses, inputTokens, outputTokens, model)
+	usage := kiroUsage{InputTokens: inputTokens, OutputTokens: outputTokens, CacheReadTokens: cacheRead, CacheWriteTokens: cacheWrite, Credits: credits}
+	resp := KiroToClaudeResponse(finalContent, nativeThinking, toolUses, inputTokens, outputTokens, model)
+	resp.Usage = usage.claudeUsage()
+	resp.StopReason = limiter.ClaudeStopReason(len(toolUses) > 0, outputTokens)
+	resp.StopSequence = limiter.stopSequenceValue()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(resp)
 
-	h.appendRequestLog(RequestFinalMetrics{
-		Path:         "/v1/messages",
-		Model:        model,
-		AccountID:    account.ID,
-		AccountEmail: account.Email,
-		Attempts:     1,
-		FinalStatus:  200,
-		DurationMs:   time.Since(requestStart).Milliseconds(),
-		AttemptItems: []RequestLogAttempt{{
-			Try:        1,
-			AccountID:  account.ID,
-			Email:      account.Email,
-			StatusCode: 200,
-			DurationMs: time.Since(requestStart).Milliseconds(),
-		}},
-	})
+	return usage, nil
 }
 
 func (h *Handler) sendClaudeError(w http.ResponseWriter, status int, errType, message string) {
@@ -1530,83 +1436,87 @@ func (h *Handler) handleOpenAIChat(w http.ResponseWriter, r *http.Request) {
 		h.sendOpenAIError(w, 400, "invalid_request_error", "Invalid JSON")
 		return
 	}
-
-	account := h.pool.GetNext()
-	if account == nil {
-		h.sendOpenAIError(w, 503, "server_error", "No available accounts")
-		h.finalizeRequest(RequestFinalMetrics{
-			Path:        r.URL.Path,
-			Model:       req.Model,
-			Attempts:    1,
-			FinalStatus: 503,
-			DurationMs:  time.Since(requestStart).Milliseconds(),
-			Error:       "No available accounts",
-			AttemptItems: []RequestLogAttempt{{
-				Try:        1,
-				StatusCode: 503,
-				Error:      "No available accounts",
-				DurationMs: time.Since(requestStart).Milliseconds(),
-			}},
-		})
+	if err := req.ResponseFormat.checkSchema(); err != nil {
+		h.sendOpenAIError(w, 400, "invalid_request_error", err.Error())
 		return
 	}
 
-	if err := h.ensureValidToken(account); err != nil {
-		h.sendOpenAIError(w, 503, "server_error", "Token refresh failed")
-		h.finalizeRequest(RequestFinalMetrics{
-			Path:         r.URL.Path,
-			Model:        req.Model,
-			AccountID:    account.ID,
-			AccountEmail: account.Email,
-			Attempts:     1,
-			FinalStatus:  503,
-			DurationMs:   time.Since(requestStart).Milliseconds(),
-			Error:        truncateError(err.Error()),
-			AttemptItems: []RequestLogAttempt{{
-				Try:        1,
-				AccountID:  account.ID,
-				Email:      account.Email,
-				StatusCode: 503,
-				Error:      truncateError(err.Error()),
-				DurationMs: time.Since(requestStart).Milliseconds(),
-			}},
-		})
+	// 解析模型和 thinking 模式（模型后缀、请求参数或别名默认值均可开启）
+	resolved, err := h.resolveModel(req.Model)
+	if err != nil {
+		h.sendOpenAIErrorCode(w, 404, "invalid_request_error", "model_not_found", err.Error())
+		return
+	}
+	if keyErr := checkApiKeyModel(r, resolved.Model); keyErr != nil {
+		h.sendApiKeyError(w, r, keyErr)
 		return
 	}
+	req.Model = resolved.Model
+	resolved.applyDefaults(&req.Temperature, &req.MaxTokens)
 
-	// 解析模型和 thinking 模式
-	thinkingCfg := config.GetThinkingConfig()
-	actualModel, thinking := ParseModelAndThinking(req.Model, thinkingCfg.Suffix)
-	req.Model = actualModel
+	kiroPayload := OpenAIToKiro(&req, resolved.thinkingBudget(req.ThinkingBudget(), req.ReasoningEffort != ""))
+	h.trimToContextWindow(kiroPayload)
 
-	kiroPayload := OpenAIToKiro(&req, thinking)
+	// 会话粘性：同一会话复用账号与 conversationId
+	session := h.sessions.Route(openAISessionKey(r, &req))
+	session.apply(kiroPayload)
 
-	if req.Stream {
-		h.handleOpenAIStream(w, account, kiroPayload, req.Model, requestStart)
-	} else {
-		h.handleOpenAINonStream(w, account, kiroPayload, req.Model, requestStart)
+	opts := responseOptions{
+		ToolChoice:     req.ParsedToolChoice(),
+		ResponseFormat: req.ResponseFormat,
+		StopSequences:  req.ParsedStop(),
+		MaxTokens:      req.MaxTokens,
+	}
+
+	// 跨账号重试，直到首个字节写出
+	cw := &commitWriter{ResponseWriter: w}
+	// 所有账号都因配额/容量失败时按 fallback 链换模型
+	res := h.executeWithModelFallback(r.Context(), cw, kiroPayload, req.Model, session, func(model string) upstreamAttempt {
+		return withContextRetry(kiroPayload, withOutputRetry(opts, func(account *config.Account) (kiroUsage, error) {
+			if req.Stream {
+				return h.handleOpenAIStream(cw, account, kiroPayload, model, opts)
+			}
+			return h.handleOpenAINonStream(cw, account, kiroPayload, model, opts)
+		}))
+	})
+	res.Trims = kiroPayload.trims
+	h.sessions.Bind(session, res, kiroPayload)
+
+	if res.Err != nil && !cw.committed {
+		status, errType := clientErrorStatus(res)
+		if errType == "api_error" {
+			errType = "server_error"
+		}
+		h.sendOpenAIError(w, status, errType, res.Err.Error())
 	}
+	h.finalizeFailover(r, req.Model, requestStart, res)
 }
 
 // handleOpenAIStream OpenAI 流式响应
-func (h *Handler) handleOpenAIStream(w http.ResponseWriter, account *config.Account, payload *KiroPayload, model string, requestStart time.Time) {
+func (h *Handler) handleOpenAIStream(w http.ResponseWriter, account *config.Account, payload *KiroPayload, model string, opts responseOptions) (kiroUsage, error) {
+	if opts.ResponseFormat.structured() {
+		return h.handleOpenAIStructuredStream(w, account, payload, model, opts)
+	}
+
 	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		h.sendOpenAIError(w, 500, "server_error", "Streaming not supported")
-		return
+		return kiroUsage{}, errStreamingUnsupported
 	}
 
 	// 获取 thinking 输出格式配置
 	thinkingFormat := config.GetThinkingConfig().OpenAIFormat
 
 	chatID := "chatcmpl-" + uuid.New().String()
+	limiter := newOutputLimiter(opts.StopSequences, opts.MaxTokens)
 	var toolCalls []ToolCall
-	var toolCallIndex int
+	toolCallIndexes := make(map[string]int) // toolUseId -> tool_calls index
+	argsStreamed := make(map[string]bool)
 	var inputTokens, outputTokens int
+	var cacheRead, cacheWrite int
 	var credits float64
 
 	// Thinking 标签解析状态
@@ -1807,16 +1717,69 @@ func (h *Handler) handleOpenAIStream(w http.ResponseWriter, account *config.Acco
 		}
 	}
 
+	// 发送 tool_calls 增量
+	sendToolCallDelta := func(id string, function map[string]string) {
+		call := map[string]interface{}{
+			"index":    toolCallIndexes[id],
+			"function": function,
+		}
+		if _, ok := function["name"]; ok {
+			call["id"] = id
+			call["type"] = "function"
+		}
+		chunk := map[string]interface{}{
+			"id":      chatID,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []map[string]interface{}{{
+				"index":         0,
+				"delta":         map[string]interface{}{"tool_calls": []map[string]interface{}{call}},
+				"finish_reason": nil,
+			}},
+		}
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", string(data))
+		flusher.Flush()
+	}
+
+	// 工具调用开始：首个 chunk 携带 id、name 与空 arguments
+	startToolCall := func(id, name string) {
+		toolCallIndexes[id] = len(toolCallIndexes)
+		sendToolCallDelta(id, map[string]string{"name": name, "arguments": ""})
+	}
+
 	callback := &KiroStreamCallback{
 		OnText: func(text string, isThinking bool) {
-			if text == "" {
+			// 强制工具调用时只输出工具调用
+			if text == "" || opts.ToolChoice.Required() {
 				return
 			}
+			if !isThinking {
+				text = limiter.Text(text)
+			}
 			processText(text, isThinking, false)
 		},
+		OnToolUseStart: func(id, name string) {
+			if limiter.Stopped() || !opts.ToolChoice.accepts(KiroToolUse{Name: name}) {
+				return
+			}
+			// 先刷新缓冲区
+			processText(limiter.Flush(), false, true)
+			startToolCall(id, name)
+		},
+		OnToolUseDelta: func(id, partialJSON string) {
+			if _, ok := toolCallIndexes[id]; ok {
+				argsStreamed[id] = true
+				sendToolCallDelta(id, map[string]string{"arguments": partialJSON})
+			}
+		},
 		OnToolUse: func(tu KiroToolUse) {
+			if limiter.Stopped() || !opts.ToolChoice.accepts(tu) {
+				return
+			}
 			// 先刷新缓冲区
-			processText("", false, true)
+			processText(limiter.Flush(), false, true)
 
 			args, _ := json.Marshal(tu.Input)
 			tc := ToolCall{ID: tu.ToolUseID, Type: "function"}
@@ -1824,80 +1787,42 @@ func (h *Handler) handleOpenAIStream(w http.ResponseWriter, account *config.Acco
 			tc.Function.Arguments = string(args)
 			toolCalls = append(toolCalls, tc)
 
-			chunk := map[string]interface{}{
-				"id":      chatID,
-				"object":  "chat.completion.chunk",
-				"created": time.Now().Unix(),
-				"model":   model,
-				"choices": []map[string]interface{}{{
-					"index": 0,
-					"delta": map[string]interface{}{
-						"tool_calls": []map[string]interface{}{{
-							"index": toolCallIndex,
-							"id":    tu.ToolUseID,
-							"type":  "function",
-							"function": map[string]string{
-								"name":      tu.Name,
-								"arguments": string(args),
-							},
-						}},
-					},
-					"finish_reason": nil,
-				}},
+			// 未增量输出参数时一次性补发
+			if _, ok := toolCallIndexes[tu.ToolUseID]; !ok {
+				startToolCall(tu.ToolUseID, tu.Name)
+			}
+			if !argsStreamed[tu.ToolUseID] {
+				sendToolCallDelta(tu.ToolUseID, map[string]string{"arguments": string(args)})
 			}
-			toolCallIndex++
-			data, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "data: %s\n\n", string(data))
-			flusher.Flush()
 		},
 		OnComplete: func(inTok, outTok int) {
 			inputTokens = inTok
 			outputTokens = outTok
 		},
-		OnError: func(err error) {
-			h.pool.RecordError(account.ID, strings.Contains(err.Error(), "429"))
-		},
 		OnCredits: func(c float64) {
 			credits = c
 		},
+		OnCacheUsage: func(read, write int) {
+			cacheRead, cacheWrite = read, write
+		},
+		ShouldStop: limiter.Stopped,
 	}
 
-	err := CallKiroAPI(account, payload, callback)
-	if err != nil {
-		h.pool.RecordError(account.ID, strings.Contains(err.Error(), "429"))
-		h.finalizeRequest(RequestFinalMetrics{
-			Path:         "/v1/chat/completions",
-			Model:        model,
-			AccountID:    account.ID,
-			AccountEmail: account.Email,
-			Attempts:     1,
-			FinalStatus:  500,
-			DurationMs:   time.Since(requestStart).Milliseconds(),
-			Error:        truncateError(err.Error()),
-			AttemptItems: []RequestLogAttempt{{
-				Try:        1,
-				AccountID:  account.ID,
-				Email:      account.Email,
-				StatusCode: 500,
-				Error:      truncateError(err.Error()),
-				DurationMs: time.Since(requestStart).Milliseconds(),
-			}},
-		})
-		return
+	if err := CallKiroAPI(account, payload, callback); err != nil {
+		return kiroUsage{}, err
 	}
 
-	// 刷新剩余缓冲区
-	processText("", false, true)
+	// 强制工具调用未满足：此时尚未写出任何数据，交给上层重试
+	if opts.ToolChoice.Required() && len(toolCalls) == 0 {
+		return kiroUsage{}, errToolChoiceUnsatisfied
+	}
 
-	h.recordSuccess(inputTokens, outputTokens, credits, 1)
-	h.pool.RecordSuccess(account.ID)
-	h.pool.UpdateStats(account.ID, inputTokens+outputTokens, credits)
+	// 刷新剩余缓冲区
+	processText(limiter.Flush(), false, true)
 
 	// 发送结束
-	finishReason := "stop"
-	if len(toolCalls) > 0 {
-		finishReason = "tool_calls"
-	}
+	finishReason := limiter.OpenAIFinishReason(len(toolCalls) > 0, outputTokens)
+	usage := kiroUsage{InputTokens: inputTokens, OutputTokens: outputTokens, CacheReadTokens: cacheRead, CacheWriteTokens: cacheWrite, Credits: credits}
 
 	chunk := map[string]interface{}{
 		"id":      chatID,
@@ -1909,149 +1834,64 @@ func (h *Handler) handleOpenAIStream(w http.ResponseWriter, account *config.Acco
 			"delta":         map[string]interface{}{},
 			"finish_reason": finishReason,
 		}},
-		"usage": map[string]int{
-			"prompt_tokens":     inputTokens,
-			"completion_tokens": outputTokens,
-			"total_tokens":      inputTokens + outputTokens,
-		},
+		"usage": usage.openAIUsage(),
 	}
 	data, _ := json.Marshal(chunk)
 	fmt.Fprintf(w, "data: %s\n\n", string(data))
 	fmt.Fprintf(w, "data: [DONE]\n\n")
 	flusher.Flush()
 
-	h.appendRequestLog(RequestFinalMetrics{
-		Path:         "/v1/chat/completions",
-		Model:        model,
-		AccountID:    account.ID,
-		AccountEmail: account.Email,
-		Attempts:     1,
-		FinalStatus:  200,
-		DurationMs:   time.Since(requestStart).Milliseconds(),
-		AttemptItems: []RequestLogAttempt{{
-			Try:        1,
-			AccountID:  account.ID,
-			Email:      account.Email,
-			StatusCode: 200,
-			DurationMs: time.Since(requestStart).Milliseconds(),
-		}},
-	})
+	return usage, nil
 }
 
 // handleOpenAINonStream OpenAI 非流式响应
-func (h *Handler) handleOpenAINonStream(w http.ResponseWriter, account *config.Account, payload *KiroPayload, model string, requestStart time.Time) {
-	var content string
-	var reasoningContent string
-	var toolUses []KiroToolUse
-	var inputTokens, outputTokens int
-	var credits float64
-
-	callback := &KiroStreamCallback{
-		OnText: func(text string, isThinking bool) {
-			if isThinking {
-				reasoningContent += text
-			} else {
-				content += text
-			}
-		},
-		OnToolUse:  func(tu KiroToolUse) { toolUses = append(toolUses, tu) },
-		OnComplete: func(inTok, outTok int) { inputTokens = inTok; outputTokens = outTok },
-		OnError:    func(err error) { h.pool.RecordError(account.ID, strings.Contains(err.Error(), "429")) },
-		OnCredits:  func(c float64) { credits = c },
-	}
-
-	err := CallKiroAPI(account, payload, callback)
+func (h *Handler) handleOpenAINonStream(w http.ResponseWriter, account *config.Account, payload *KiroPayload, model string, opts responseOptions) (kiroUsage, error) {
+	out, err := h.collectOpenAIResponse(account, payload, opts)
 	if err != nil {
-		h.pool.RecordError(account.ID, strings.Contains(err.Error(), "429"))
-		h.sendOpenAIError(w, 500, "server_error", err.Error())
-		h.finalizeRequest(RequestFinalMetrics{
-			Path:         "/v1/chat/completions",
-			Model:        model,
-			AccountID:    account.ID,
-			AccountEmail: account.Email,
-			Attempts:     1,
-			FinalStatus:  500,
-			DurationMs:   time.Since(requestStart).Milliseconds(),
-			Error:        truncateError(err.Error()),
-			AttemptItems: []RequestLogAttempt{{
-				Try:        1,
-				AccountID:  account.ID,
-				Email:      account.Email,
-				StatusCode: 500,
-				Error:      truncateError(err.Error()),
-				DurationMs: time.Since(requestStart).Milliseconds(),
-			}},
-		})
-		return
-	}
-
-	h.recordSuccess(inputTokens, outputTokens, credits, 1)
-	h.pool.RecordSuccess(account.ID)
-	h.pool.UpdateStats(account.ID, inputTokens+outputTokens, credits)
-
-	// 解析 content 中的 <thinking> 标签
-	finalContent, extractedReasoning := extractThinkingFromContent(content)
-	if extractedReasoning != "" {
-		reasoningContent = extractedReasoning + reasoningContent
+		return kiroUsage{}, err
 	}
 
 	thinkingFormat := config.GetThinkingConfig().OpenAIFormat
-	resp := KiroToOpenAIResponseWithReasoning(finalContent, reasoningContent, toolUses, inputTokens, outputTokens, model, thinkingFormat)
+	if opts.ResponseFormat.structured() {
+		// 结构化输出时 thinking 总是放在 reasoning_content，避免破坏 JSON 内容
+		thinkingFormat = "reasoning_content"
+	}
+	resp := KiroToOpenAIResponseWithReasoning(out.Content, out.ReasoningContent, out.ToolUses, out.Usage.InputTokens, out.Usage.OutputTokens, model, thinkingFormat)
+	resp["choices"].([]map[string]interface{})[0]["finish_reason"] = out.FinishReason
+	resp["usage"] = out.Usage.openAIUsage()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(resp)
 
-	h.appendRequestLog(RequestFinalMetrics{
-		Path:         "/v1/chat/completions",
-		Model:        model,
-		AccountID:    account.ID,
-		AccountEmail: account.Email,
-		Attempts:     1,
-		FinalStatus:  200,
-		DurationMs:   time.Since(requestStart).Milliseconds(),
-		AttemptItems: []RequestLogAttempt{{
-			Try:        1,
-			AccountID:  account.ID,
-			Email:      account.Email,
-			StatusCode: 200,
-			DurationMs: time.Since(requestStart).Milliseconds(),
-		}},
-	})
+	return out.Usage, nil
 }
 
 func (h *Handler) sendOpenAIError(w http.ResponseWriter, status int, errType, message string) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": map[string]interface{}{
-			"type":    errType,
-			"message": message,
-		},
-	})
+	h.sendOpenAIErrorCode(w, status, errType, "", message)
 }
 
-// ensureValidToken 确保 token 有效
-func (h *Handler) ensureValidToken(account *config.Account) error {
-	if account.ExpiresAt == 0 || time.Now().Unix() < account.ExpiresAt-300 {
-		return nil
-	}
-
-	accessToken, refreshToken, expiresAt, err := auth.RefreshToken(account)
-	if err != nil {
-		return err
+// sendOpenAIErrorCode 返回带 error.code 的 OpenAI 错误（如 model_not_found），code 为空时省略
+func (h *Handler) sendOpenAIErrorCode(w http.ResponseWriter, status int, errType, code, message string) {
+	body := map[string]interface{}{
+		"type":    errType,
+		"message": message,
 	}
-
-	// 更新内存
-	h.pool.UpdateToken(account.ID, accessToken, refreshToken, expiresAt)
-	account.AccessToken = accessToken
-	if refreshToken != "" {
-		account.RefreshToken = refreshToken
+	if code != "" {
+		body["code"] = code
 	}
-	account.ExpiresAt = expiresAt
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": body})
+}
 
-	// 持久化
-	config.UpdateAccountToken(account.ID, accessToken, refreshToken, expiresAt)
+// ensureValidToken 确保 token 有效，即将过期时刷新（同一账号的并发刷新只请求一次上游）
+// 后台在过期前主动刷新，正常情况下请求路径不会触发刷新
+func (h *Handler) ensureValidToken(account *config.Account) error {
+	return auth.GetRefreshManager().EnsureValid(account)
+}
 
-	return nil
+// forceRefreshToken 无论是否临近过期都刷新 token（用于认证失败后的恢复探测）
+func (h *Handler) forceRefreshToken(account *config.Account) error {
+	return auth.GetRefreshManager().Refresh(account)
 }
 
 // ==================== 管理 API ====================
@@ -2083,6 +1923,9 @@ func (h *Handler) handleAdminAPI(w http.ResponseWriter, r *http.Request) {
 	case strings.HasPrefix(path, "/accounts/") && strings.HasSuffix(path, "/refresh") && r.Method == "POST":
 		id := strings.TrimSuffix(strings.TrimPrefix(path, "/accounts/"), "/refresh")
 		h.apiRefreshAccount(w, r, id)
+	case strings.HasPrefix(path, "/accounts/") && strings.HasSuffix(path, "/probe") && r.Method == "POST":
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/accounts/"), "/probe")
+		h.apiProbeAccount(w, r, id)
 	case strings.HasPrefix(path, "/accounts/") && strings.HasSuffix(path, "/models") && r.Method == "GET":
 		id := strings.TrimSuffix(strings.TrimPrefix(path, "/accounts/"), "/models")
 		h.apiGetAccountModels(w, r, id)
@@ -2129,6 +1972,58 @@ func (h *Handler) handleAdminAPI(w http.ResponseWriter, r *http.Request) {
 		h.apiGetEndpointConfig(w, r)
 	case path == "/endpoint" && r.Method == "POST":
 		h.apiUpdateEndpointConfig(w, r)
+	case path == "/failover" && r.Method == "GET":
+		h.apiGetFailoverConfig(w, r)
+	case path == "/failover" && r.Method == "POST":
+		h.apiUpdateFailoverConfig(w, r)
+	case path == "/models" && r.Method == "GET":
+		h.apiGetModelAliases(w, r)
+	case path == "/models" && r.Method == "POST":
+		h.apiAddModelAlias(w, r)
+	case path == "/models/settings" && r.Method == "POST":
+		h.apiUpdateModelSettings(w, r)
+	case path == "/models/fallbacks" && r.Method == "GET":
+		h.apiGetModelFallbacks(w, r)
+	case path == "/models/fallbacks" && r.Method == "POST":
+		h.apiUpdateModelFallbacks(w, r)
+	case strings.HasPrefix(path, "/models/") && r.Method == "PUT":
+		h.apiUpdateModelAlias(w, r, strings.TrimPrefix(path, "/models/"))
+	case strings.HasPrefix(path, "/models/") && r.Method == "DELETE":
+		h.apiDeleteModelAlias(w, r, strings.TrimPrefix(path, "/models/"))
+	case path == "/concurrency" && r.Method == "GET":
+		h.apiGetConcurrencyConfig(w, r)
+	case path == "/concurrency" && r.Method == "POST":
+		h.apiUpdateConcurrencyConfig(w, r)
+	case path == "/ratelimit" && r.Method == "GET":
+		h.apiGetRateLimitConfig(w, r)
+	case path == "/ratelimit" && r.Method == "POST":
+		h.apiUpdateRateLimitConfig(w, r)
+	case path == "/keys" && r.Method == "GET":
+		h.apiGetApiKeys(w, r)
+	case path == "/keys" && r.Method == "POST":
+		h.apiCreateApiKey(w, r)
+	case strings.HasPrefix(path, "/keys/") && r.Method == "PUT":
+		h.apiUpdateApiKey(w, r, strings.TrimPrefix(path, "/keys/"))
+	case strings.HasPrefix(path, "/keys/") && r.Method == "DELETE":
+		h.apiDeleteApiKey(w, r, strings.TrimPrefix(path, "/keys/"))
+	case path == "/transitions" && r.Method == "GET":
+		h.apiGetTransitions(w, r)
+	case path == "/probes" && r.Method == "GET":
+		h.apiGetProbes(w, r)
+	case path == "/probes" && r.Method == "POST":
+		h.apiUpdateProbeConfig(w, r)
+	case path == "/strategy" && r.Method == "GET":
+		h.apiGetStrategy(w, r)
+	case path == "/strategy" && r.Method == "POST":
+		h.apiUpdateStrategy(w, r)
+	case path == "/sessions" && r.Method == "GET":
+		h.apiGetSessions(w, r)
+	case path == "/sessions" && r.Method == "POST":
+		h.apiUpdateSessionConfig(w, r)
+	case path == "/sessions" && r.Method == "DELETE":
+		h.apiDeleteSession(w, r, "")
+	case strings.HasPrefix(path, "/sessions/") && r.Method == "DELETE":
+		h.apiDeleteSession(w, r, strings.TrimPrefix(path, "/sessions/"))
 	case path == "/version" && r.Method == "GET":
 		h.apiGetVersion(w, r)
 	case path == "/export" && r.Method == "POST":
@@ -2149,6 +2044,13 @@ func (h *Handler) apiGetAccounts(w http.ResponseWriter, r *http.Request) {
 		statsMap[a.ID] = a
 	}
 
+	// 冷却中账号的冷却原因与结束时间
+	cooldowns := h.pool.GetCooldowns()
+	states := h.pool.States()
+	inFlight := h.pool.InFlight()
+	rateLimits := h.pool.GetRateLimits()
+	tokenRefresh := auth.GetRefreshManager().Status()
+
 	// 隐藏敏感信息
 	result := make([]map[string]interface{}, len(accounts))
 	for i, a := range accounts {
@@ -2161,6 +2063,10 @@ func (h *Handler) apiGetAccounts(w http.ResponseWriter, r *http.Request) {
 			"userId":            a.UserId,
 			"nickname":          a.Nickname,
 			"weight":            a.Weight,
+			"maxConcurrent":     a.MaxConcurrent,
+			"requestsPerMinute": a.RequestsPerMinute,
+			"tokensPerMinute":   a.TokensPerMinute,
+			"inFlight":          inFlight[a.ID],
 			"authMethod":        a.AuthMethod,
 			"provider":          a.Provider,
 			"region":            a.Region,
@@ -2190,6 +2096,24 @@ func (h *Handler) apiGetAccounts(w http.ResponseWriter, r *http.Request) {
 			"totalCredits":      stats.TotalCredits,
 			"lastUsed":          stats.LastUsed,
 		}
+		if state, ok := states[a.ID]; ok {
+			result[i]["state"] = state.State
+			result[i]["stateReason"] = state.Reason
+			result[i]["stateSince"] = state.Since.Unix()
+		}
+		if cooldown, ok := cooldowns[a.ID]; ok {
+			result[i]["cooldownReason"] = cooldown.Reason
+			result[i]["cooldownUntil"] = cooldown.Until.Unix()
+		}
+		if limit, ok := rateLimits[a.ID]; ok {
+			result[i]["rateLimit"] = limit
+		}
+		if refresh, ok := tokenRefresh[a.ID]; ok {
+			result[i]["tokenRefresh"] = refresh
+		}
+		if probe, ok := h.prober.Last(a.ID); ok {
+			result[i]["lastProbe"] = probe
+		}
 	}
 	json.NewEncoder(w).Encode(result)
 }
@@ -2252,10 +2176,7 @@ func (h *Handler) apiUpdateAccount(w http.ResponseWriter, r *http.Request, id st
 		return
 	}
 
-	// 只更新传入的字段
-	if v, ok := updates["enabled"].(bool); ok {
-		existing.Enabled = v
-	}
+	// 只更新传入的字段，启用状态通过账号状态变更保存
 	if v, ok := updates["nickname"].(string); ok {
 		existing.Nickname = v
 	}
@@ -2273,14 +2194,35 @@ func (h *Handler) apiUpdateAccount(w http.ResponseWriter, r *http.Request, id st
 			existing.Weight = 100
 		}
 	}
+	if v, ok := updates["maxConcurrent"].(float64); ok {
+		existing.MaxConcurrent = max(0, int(v))
+	}
+	if v, ok := updates["requestsPerMinute"].(float64); ok {
+		existing.RequestsPerMinute = max(0, int(v))
+	}
+	if v, ok := updates["tokensPerMinute"].(float64); ok {
+		existing.TokensPerMinute = max(0, int(v))
+	}
 
 	if err := config.UpdateAccount(id, *existing); err != nil {
 		w.WriteHeader(500)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
-
 	h.pool.Reload()
+
+	if v, ok := updates["enabled"].(bool); ok {
+		state, reason := pool.StateDisabledByAdmin, "disabled by admin"
+		if v {
+			state, reason = pool.StateActive, "enabled by admin"
+		}
+		if err := h.pool.SetState(id, state, reason); err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
@@ -2711,10 +2653,12 @@ func (h *Handler) apiGetStats(w http.ResponseWriter, r *http.Request) {
 		"totalTokens":           atomic.LoadInt64(&h.totalTokens),
 		"totalCredits":          h.getCredits(),
 		"uptime":                time.Now().Unix() - h.startTime,
+		"cache":                 h.cacheStats.Snapshot(),
 		"statsDescription": map[string]string{
 			"failedRequests":        "最终失败请求数（重试后仍失败）",
 			"attemptFailedRequests": "尝试失败次数（包含重试中的失败）",
 			"totalRetries":          "总重试次数（sum(attempts-1)）",
+			"cache":                 "Prompt cache 命中统计（hitRatio = cacheReadTokens / inputTokens，重启后清零）",
 		},
 	})
 }
@@ -2729,6 +2673,7 @@ func (h *Handler) apiResetStats(w http.ResponseWriter, r *http.Request) {
 	h.creditsMu.Lock()
 	h.totalCredits = 0
 	h.creditsMu.Unlock()
+	h.cacheStats.Reset()
 	config.UpdateStats(0, 0, 0, 0, 0, 0, 0)
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
@@ -2837,18 +2782,7 @@ func (h *Handler) apiRefreshAccount(w http.ResponseWriter, r *http.Request, id s
 		if account.RefreshToken == "" {
 			return nil
 		}
-		newAccessToken, newRefreshToken, newExpiresAt, err := auth.RefreshToken(account)
-		if err != nil {
-			return err
-		}
-		account.AccessToken = newAccessToken
-		if newRefreshToken != "" {
-			account.RefreshToken = newRefreshToken
-		}
-		account.ExpiresAt = newExpiresAt
-		config.UpdateAccountToken(id, newAccessToken, newRefreshToken, newExpiresAt)
-		h.pool.UpdateToken(id, newAccessToken, newRefreshToken, newExpiresAt)
-		return nil
+		return h.forceRefreshToken(account)
 	}
 
 	// 检查 token 是否快过期，先刷新
@@ -2949,6 +2883,10 @@ func (h *Handler) apiGetAccountFull(w http.ResponseWriter, r *http.Request, id s
 		"userId":              account.UserId,
 		"nickname":            account.Nickname,
 		"weight":              account.Weight,
+		"maxConcurrent":       account.MaxConcurrent,
+		"requestsPerMinute":   account.RequestsPerMinute,
+		"tokensPerMinute":     account.TokensPerMinute,
+		"inFlight":            h.pool.InFlight()[id],
 		"accessToken":         account.AccessToken,
 		"refreshToken":        account.RefreshToken,
 		"clientId":            account.ClientID,
@@ -2981,6 +2919,18 @@ func (h *Handler) apiGetAccountFull(w http.ResponseWriter, r *http.Request, id s
 		"totalCredits":        stats.TotalCredits,
 		"lastUsed":            stats.LastUsed,
 	}
+	if state, ok := h.pool.State(id); ok {
+		result["state"] = state.State
+		result["stateReason"] = state.Reason
+		result["stateSince"] = state.Since.Unix()
+	}
+	if cooldown, ok := h.pool.GetCooldowns()[id]; ok {
+		result["cooldownReason"] = cooldown.Reason
+		result["cooldownUntil"] = cooldown.Until.Unix()
+	}
+	if limit, ok := h.pool.GetRateLimits()[id]; ok {
+		result["rateLimit"] = limit
+	}
 
 	json.NewEncoder(w).Encode(result)
 }
@@ -3008,6 +2958,9 @@ func (h *Handler) apiGetAccountModels(w http.ResponseWriter, r *http.Request, id
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
+	if account.Enabled {
+		h.setAccountModels(account.ID, models)
+	}
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
@@ -3056,9 +3009,9 @@ func (h *Handler) apiUpdateThinkingConfig(w http.ResponseWriter, r *http.Request
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid openaiFormat, must be: reasoning_content, thinking, or think"})
 		return
 	}
-	if req.ClaudeFormat != "" && !validFormats[req.ClaudeFormat] {
+	if req.ClaudeFormat != "" && !validFormats[req.ClaudeFormat] && req.ClaudeFormat != "native" {
 		w.WriteHeader(400)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid claudeFormat, must be: reasoning_content, thinking, or think"})
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid claudeFormat, must be: native, reasoning_content, thinking, or think"})
 		return
 	}
 
@@ -3105,6 +3058,549 @@ func (h *Handler) apiUpdateEndpointConfig(w http.ResponseWriter, r *http.Request
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
+// apiGetFailoverConfig 获取跨账号重试配置
+func (h *Handler) apiGetFailoverConfig(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]int{
+		"maxAttempts": config.GetFailoverMaxAttempts(),
+	})
+}
+
+// apiUpdateFailoverConfig 更新跨账号重试配置
+func (h *Handler) apiUpdateFailoverConfig(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MaxAttempts int `json:"maxAttempts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	if req.MaxAttempts < 1 || req.MaxAttempts > 20 {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid maxAttempts, must be between 1 and 20"})
+		return
+	}
+
+	if err := config.UpdateFailoverMaxAttempts(req.MaxAttempts); err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// apiGetModelAliases 获取模型别名表
+func (h *Handler) apiGetModelAliases(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"aliases":       config.GetModelAliases(),
+		"rejectUnknown": config.IsRejectUnknownModels(),
+	})
+}
+
+// apiAddModelAlias 添加模型别名
+func (h *Handler) apiAddModelAlias(w http.ResponseWriter, r *http.Request) {
+	var alias config.ModelAlias
+	if err := json.NewDecoder(r.Body).Decode(&alias); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	if err := validateModelAlias(&alias); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	alias.ID = uuid.New().String()
+
+	if err := config.AddModelAlias(alias); err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "alias": alias})
+}
+
+// apiUpdateModelAlias 更新模型别名
+func (h *Handler) apiUpdateModelAlias(w http.ResponseWriter, r *http.Request, id string) {
+	var alias config.ModelAlias
+	if err := json.NewDecoder(r.Body).Decode(&alias); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	if err := validateModelAlias(&alias); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := config.UpdateModelAlias(id, alias); err != nil {
+		if err == config.ErrModelAliasNotFound {
+			w.WriteHeader(404)
+		} else {
+			w.WriteHeader(500)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// apiDeleteModelAlias 删除模型别名
+func (h *Handler) apiDeleteModelAlias(w http.ResponseWriter, r *http.Request, id string) {
+	if err := config.DeleteModelAlias(id); err != nil {
+		if err == config.ErrModelAliasNotFound {
+			w.WriteHeader(404)
+		} else {
+			w.WriteHeader(500)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// apiUpdateModelSettings 更新未知模型的处理方式
+func (h *Handler) apiUpdateModelSettings(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RejectUnknown bool `json:"rejectUnknown"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	if err := config.UpdateRejectUnknownModels(req.RejectUnknown); err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// apiGetModelFallbacks 获取模型 fallback 链
+func (h *Handler) apiGetModelFallbacks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"fallbacks": config.GetAllModelFallbacks(),
+	})
+}
+
+// apiUpdateModelFallbacks 更新模型 fallback 链（整体替换）
+func (h *Handler) apiUpdateModelFallbacks(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Fallbacks map[string][]string `json:"fallbacks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	for model, chain := range req.Fallbacks {
+		for _, m := range chain {
+			if model == "" || m == "" || strings.EqualFold(m, model) {
+				w.WriteHeader(400)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Invalid fallback chain for " + model})
+				return
+			}
+		}
+	}
+
+	if err := config.UpdateModelFallbacks(req.Fallbacks); err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// apiGetConcurrencyConfig 获取并发上限配置与排队统计
+func (h *Handler) apiGetConcurrencyConfig(w http.ResponseWriter, r *http.Request) {
+	maxConcurrent, queueTimeout := config.GetConcurrencyConfig()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"maxConcurrentPerAccount": maxConcurrent,
+		"queueTimeoutSeconds":     int(queueTimeout.Seconds()),
+		"inFlight":                h.pool.InFlight(),
+		"queue":                   h.pool.GetQueueStats(),
+	})
+}
+
+// apiUpdateConcurrencyConfig 更新账号默认并发上限与排队超时
+func (h *Handler) apiUpdateConcurrencyConfig(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MaxConcurrentPerAccount int `json:"maxConcurrentPerAccount"`
+		QueueTimeoutSeconds     int `json:"queueTimeoutSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	if req.MaxConcurrentPerAccount < 0 || req.QueueTimeoutSeconds < 0 || req.QueueTimeoutSeconds > 600 {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid config, maxConcurrentPerAccount must be >= 0 and queueTimeoutSeconds between 0 and 600"})
+		return
+	}
+
+	if err := config.UpdateConcurrencyConfig(req.MaxConcurrentPerAccount, req.QueueTimeoutSeconds); err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// 上限调整后唤醒排队的请求
+	h.pool.Reload()
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// apiGetRateLimitConfig 获取账号默认限速配置与各账号令牌桶水位
+func (h *Handler) apiGetRateLimitConfig(w http.ResponseWriter, r *http.Request) {
+	rpm, tpm := config.GetRateLimitConfig()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"requestsPerMinutePerAccount": rpm,
+		"tokensPerMinutePerAccount":   tpm,
+		"accounts":                    h.pool.GetRateLimits(),
+	})
+}
+
+// apiUpdateRateLimitConfig 更新账号默认每分钟请求数与输出 token 数上限
+func (h *Handler) apiUpdateRateLimitConfig(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RequestsPerMinutePerAccount int `json:"requestsPerMinutePerAccount"`
+		TokensPerMinutePerAccount   int `json:"tokensPerMinutePerAccount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	if req.RequestsPerMinutePerAccount < 0 || req.TokensPerMinutePerAccount < 0 {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid config, limits must not be negative"})
+		return
+	}
+
+	if err := config.UpdateRateLimitConfig(req.RequestsPerMinutePerAccount, req.TokensPerMinutePerAccount); err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// 上限调整后唤醒排队的请求
+	h.pool.Reload()
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// apiKeyRequest 创建或更新命名 API Key 的请求，未传入的字段为 nil
+type apiKeyRequest struct {
+	Name             *string   `json:"name"`
+	ExpiresAt        *int64    `json:"expiresAt"`
+	Enabled          *bool     `json:"enabled"`
+	AllowedModels    *[]string `json:"allowedModels"`
+	AllowedEndpoints *[]string `json:"allowedEndpoints"`
+}
+
+// toApiKey 校验创建请求并转换为 API Key 记录，enabled 未传入时为启用
+func (req *apiKeyRequest) toApiKey() (config.ApiKey, error) {
+	key := config.ApiKey{Enabled: true}
+	if err := req.apply(&key); err != nil {
+		return key, err
+	}
+	if key.Name == "" {
+		return key, fmt.Errorf("name is required")
+	}
+	return key, nil
+}
+
+// apply 校验请求并将传入的字段写入 key，未传入的字段保持不变
+func (req *apiKeyRequest) apply(key *config.ApiKey) error {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			return fmt.Errorf("name must not be empty")
+		}
+		key.Name = name
+	}
+	if req.ExpiresAt != nil {
+		if *req.ExpiresAt < 0 {
+			return fmt.Errorf("expiresAt must not be negative")
+		}
+		key.ExpiresAt = *req.ExpiresAt
+	}
+	if req.Enabled != nil {
+		key.Enabled = *req.Enabled
+	}
+	if req.AllowedModels != nil {
+		var models []string
+		for _, m := range *req.AllowedModels {
+			if m = strings.TrimSpace(m); m != "" {
+				models = append(models, m)
+			}
+		}
+		key.AllowedModels = models
+	}
+	if req.AllowedEndpoints != nil {
+		var endpoints []string
+		for _, e := range *req.AllowedEndpoints {
+			switch e {
+			case config.ApiKeyEndpointClaude, config.ApiKeyEndpointOpenAI, config.ApiKeyEndpointStats:
+				endpoints = append(endpoints, e)
+			default:
+				return fmt.Errorf("unknown endpoint %q, expected claude, openai or stats", e)
+			}
+		}
+		key.AllowedEndpoints = endpoints
+	}
+	return nil
+}
+
+// apiGetApiKeys 获取命名 API Key 列表（不含密钥）
+func (h *Handler) apiGetApiKeys(w http.ResponseWriter, r *http.Request) {
+	keys := config.GetApiKeys()
+	result := make([]map[string]interface{}, len(keys))
+	for i, k := range keys {
+		result[i] = apiKeyView(k)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys":        result,
+		"legacyKey":   config.GetApiKey() != "",
+		"requireKeys": config.IsApiKeyRequired(),
+	})
+}
+
+// apiCreateApiKey 创建命名 API Key，密钥只在创建时返回一次
+func (h *Handler) apiCreateApiKey(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	key, err := req.toApiKey()
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	secret := config.GenerateApiKeySecret()
+	key.ID = uuid.New().String()
+	key.Prefix = secret[:12]
+	key.SecretHash = config.HashApiKey(secret)
+	key.CreatedAt = time.Now().Unix()
+
+	if err := config.AddApiKey(key); err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "key": apiKeyView(key), "secret": secret})
+}
+
+// apiUpdateApiKey 更新命名 API Key（名称、过期时间、启用状态与权限），密钥不变
+func (h *Handler) apiUpdateApiKey(w http.ResponseWriter, r *http.Request, id string) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	// 部分更新：只修改请求中传入的字段
+	var invalid error
+	key, err := config.UpdateApiKey(id, func(k *config.ApiKey) error {
+		invalid = req.apply(k)
+		return invalid
+	})
+	if err != nil {
+		switch {
+		case err == config.ErrApiKeyNotFound:
+			w.WriteHeader(404)
+		case invalid != nil:
+			w.WriteHeader(400)
+		default:
+			w.WriteHeader(500)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "key": apiKeyView(key)})
+}
+
+// apiDeleteApiKey 删除（吊销）命名 API Key
+func (h *Handler) apiDeleteApiKey(w http.ResponseWriter, r *http.Request, id string) {
+	if err := config.DeleteApiKey(id); err != nil {
+		if err == config.ErrApiKeyNotFound {
+			w.WriteHeader(404)
+		} else {
+			w.WriteHeader(500)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// apiGetTransitions 获取最近的账号状态变更（按时间倒序），?id= 只返回指定账号，?limit= 限制条数（默认 100）
+func (h *Handler) apiGetTransitions(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = n
+	}
+
+	transitions := h.pool.Transitions(r.URL.Query().Get("id"), limit)
+	if transitions == nil {
+		transitions = []pool.Transition{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"transitions": transitions,
+	})
+}
+
+// apiGetProbes 获取健康探测配置与探测记录，?id= 只返回指定账号
+func (h *Handler) apiGetProbes(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": config.IsHealthProbeEnabled(),
+		"history": h.prober.History(r.URL.Query().Get("id")),
+	})
+}
+
+// apiUpdateProbeConfig 启用或关闭后台健康探测
+func (h *Handler) apiUpdateProbeConfig(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	if err := config.UpdateHealthProbe(req.Enabled); err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// apiProbeAccount 立即探测指定账号
+func (h *Handler) apiProbeAccount(w http.ResponseWriter, r *http.Request, id string) {
+	var account *config.Account
+	for _, a := range config.GetAccounts() {
+		if a.ID == id {
+			account = &a
+			break
+		}
+	}
+	if account == nil {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Account not found"})
+		return
+	}
+
+	target, reason := h.probeTarget(account)
+	json.NewEncoder(w).Encode(h.probeAccount(account, target, reason))
+}
+
+// apiGetStrategy 获取账号选择策略
+func (h *Handler) apiGetStrategy(w http.ResponseWriter, r *http.Request) {
+	strategy := config.GetSelectionStrategy()
+	if !pool.IsValidStrategy(strategy) {
+		strategy = pool.DefaultStrategy
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"strategy":  strategy,
+		"available": pool.StrategyNames(),
+	})
+}
+
+// apiUpdateStrategy 切换账号选择策略，立即对新请求生效
+func (h *Handler) apiUpdateStrategy(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Strategy string `json:"strategy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	if !pool.IsValidStrategy(req.Strategy) {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid strategy, must be one of: " + strings.Join(pool.StrategyNames(), ", ")})
+		return
+	}
+
+	if err := config.UpdateSelectionStrategy(req.Strategy); err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// apiGetSessions 获取当前会话粘性绑定
+func (h *Handler) apiGetSessions(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ttlMinutes": int(config.GetSessionTTL().Minutes()),
+		"sessions":   h.sessions.List(),
+	})
+}
+
+// apiUpdateSessionConfig 更新会话绑定过期时间
+func (h *Handler) apiUpdateSessionConfig(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TTLMinutes int `json:"ttlMinutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	if req.TTLMinutes < 1 || req.TTLMinutes > 1440 {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid ttlMinutes, must be between 1 and 1440"})
+		return
+	}
+
+	if err := config.UpdateSessionTTL(req.TTLMinutes); err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// apiDeleteSession 删除会话绑定，key 为空时清空全部
+func (h *Handler) apiDeleteSession(w http.ResponseWriter, r *http.Request, key string) {
+	h.sessions.Delete(key)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
 // apiGetVersion 获取版本信息
 func (h *Handler) apiGetVersion(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{
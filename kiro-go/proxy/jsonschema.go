@@ -0,0 +1,407 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 校验时 schema 的最大嵌套深度（值的嵌套层数加上 $ref / 组合关键字的层数）
+const maxSchemaDepth = 64
+
+// schemaError schema 本身无效（无法解析的 $ref、无效的 pattern、引用循环），与模型输出无关
+type schemaError struct {
+	Reason string
+}
+
+func (e *schemaError) Error() string {
+	return "invalid JSON schema: " + e.Reason
+}
+
+func isSchemaError(err error) bool {
+	var sErr *schemaError
+	return errors.As(err, &sErr)
+}
+
+// schemaValidator 校验 JSON 值是否符合 JSON Schema
+// 支持结构化输出常用的关键字子集：type/enum/const/properties/required/additionalProperties/
+// items/anyOf/oneOf/allOf/$ref 以及字符串、数值、数组的长度与范围约束
+type schemaValidator struct {
+	root   map[string]interface{}
+	strict bool // 严格模式：未声明 additionalProperties 的对象视为不允许额外字段
+	depth  int
+	active map[string]bool // 正在展开的 (ref, path)，同一位置再次展开同一引用即为循环
+}
+
+func validateJSONSchema(value interface{}, schema map[string]interface{}, strict bool) error {
+	v := &schemaValidator{root: schema, strict: strict, active: make(map[string]bool)}
+	return v.validate(value, schema, "$")
+}
+
+func (v *schemaValidator) validate(value interface{}, schema map[string]interface{}, path string) error {
+	if schema == nil {
+		return nil
+	}
+	v.depth++
+	defer func() { v.depth-- }()
+	if v.depth > maxSchemaDepth {
+		return fmt.Errorf("%s: value is nested deeper than %d levels", path, maxSchemaDepth)
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		key := ref + "\x00" + path
+		if v.active[key] {
+			return &schemaError{Reason: fmt.Sprintf("$ref %q refers back to itself at %s", ref, path)}
+		}
+		target, err := v.resolveRef(ref)
+		if err != nil {
+			return err
+		}
+		v.active[key] = true
+		defer delete(v.active, key)
+		return v.validate(value, target, path)
+	}
+
+	if t, ok := schema["type"]; ok {
+		if err := checkSchemaType(value, t, path); err != nil {
+			return err
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		matched := false
+		for _, e := range enum {
+			if jsonEqual(value, e) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value is not one of the allowed enum values", path)
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(value, c) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+
+	if subs, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range subs {
+			if err := v.validate(value, asSchema(sub), path); err != nil {
+				return err
+			}
+		}
+	}
+	if subs, ok := schema["anyOf"].([]interface{}); ok {
+		n, err := v.countMatches(value, subs, path)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%s: value does not match any schema in anyOf", path)
+		}
+	}
+	if subs, ok := schema["oneOf"].([]interface{}); ok {
+		n, err := v.countMatches(value, subs, path)
+		if err != nil {
+			return err
+		}
+		if n != 1 {
+			return fmt.Errorf("%s: value matches %d schemas in oneOf, expected exactly 1", path, n)
+		}
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		return v.validateObject(val, schema, path)
+	case []interface{}:
+		return v.validateArray(val, schema, path)
+	case string:
+		return validateString(val, schema, path)
+	case float64:
+		return validateNumber(val, schema, path)
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateObject(obj map[string]interface{}, schema map[string]interface{}, path string) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, exists := obj[name]; !exists {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+	}
+
+	props, _ := schema["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		childPath := path + "." + k
+		if propSchema, ok := props[k]; ok {
+			if err := v.validate(obj[k], asSchema(propSchema), childPath); err != nil {
+				return err
+			}
+			continue
+		}
+		switch ap := schema["additionalProperties"].(type) {
+		case bool:
+			if !ap {
+				return fmt.Errorf("%s: additional property %q is not allowed", path, k)
+			}
+		case map[string]interface{}:
+			if err := v.validate(obj[k], ap, childPath); err != nil {
+				return err
+			}
+		case nil:
+			if v.strict && props != nil {
+				return fmt.Errorf("%s: additional property %q is not allowed", path, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateArray(arr []interface{}, schema map[string]interface{}, path string) error {
+	if n, ok := schema["minItems"].(float64); ok && float64(len(arr)) < n {
+		return fmt.Errorf("%s: expected at least %d items", path, int(n))
+	}
+	if n, ok := schema["maxItems"].(float64); ok && float64(len(arr)) > n {
+		return fmt.Errorf("%s: expected at most %d items", path, int(n))
+	}
+	if items := asSchema(schema["items"]); items != nil {
+		for i, item := range arr {
+			if err := v.validate(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateString(s string, schema map[string]interface{}, path string) error {
+	length := len([]rune(s))
+	if n, ok := schema["minLength"].(float64); ok && float64(length) < n {
+		return fmt.Errorf("%s: string shorter than %d", path, int(n))
+	}
+	if n, ok := schema["maxLength"].(float64); ok && float64(length) > n {
+		return fmt.Errorf("%s: string longer than %d", path, int(n))
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return &schemaError{Reason: fmt.Sprintf("invalid pattern %q: %v", pattern, err)}
+		}
+		if !re.MatchString(s) {
+			return fmt.Errorf("%s: string does not match pattern %q", path, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(n float64, schema map[string]interface{}, path string) error {
+	if m, ok := schema["minimum"].(float64); ok && n < m {
+		return fmt.Errorf("%s: %v is less than minimum %v", path, n, m)
+	}
+	if m, ok := schema["maximum"].(float64); ok && n > m {
+		return fmt.Errorf("%s: %v is greater than maximum %v", path, n, m)
+	}
+	if m, ok := schema["exclusiveMinimum"].(float64); ok && n <= m {
+		return fmt.Errorf("%s: %v must be greater than %v", path, n, m)
+	}
+	if m, ok := schema["exclusiveMaximum"].(float64); ok && n >= m {
+		return fmt.Errorf("%s: %v must be less than %v", path, n, m)
+	}
+	return nil
+}
+
+// countMatches 统计匹配的子 schema 数，schema 本身无效时返回错误
+func (v *schemaValidator) countMatches(value interface{}, subs []interface{}, path string) (int, error) {
+	n := 0
+	for _, sub := range subs {
+		err := v.validate(value, asSchema(sub), path)
+		if err == nil {
+			n++
+		} else if isSchemaError(err) {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// resolveRef 解析本地引用，如 #/$defs/Foo 或 #/definitions/Foo
+func (v *schemaValidator) resolveRef(ref string) (map[string]interface{}, error) {
+	if ref == "#" {
+		return v.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, &schemaError{Reason: fmt.Sprintf("unsupported $ref %q", ref)}
+	}
+	var node interface{} = v.root
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, &schemaError{Reason: fmt.Sprintf("unresolvable $ref %q", ref)}
+		}
+		node = m[part]
+	}
+	target := asSchema(node)
+	if target == nil {
+		return nil, &schemaError{Reason: fmt.Sprintf("unresolvable $ref %q", ref)}
+	}
+	return target, nil
+}
+
+// checkJSONSchema 在调用上游前检查 schema 本身：$ref 均可解析、pattern 均可编译，
+// 且不存在不消耗输入就回到自身的引用循环（如 {"anyOf":[{"$ref":"#"}]}）
+// 经过 properties/items 等关键字的递归引用（树形结构）是合法的
+func checkJSONSchema(schema map[string]interface{}) error {
+	c := &schemaChecker{
+		v:     &schemaValidator{root: schema},
+		state: make(map[uintptr]int),
+		queue: []schemaNode{{schema: schema, loc: "#"}},
+	}
+	for len(c.queue) > 0 {
+		node := c.queue[0]
+		c.queue = c.queue[1:]
+		if err := c.check(node, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type schemaNode struct {
+	schema map[string]interface{}
+	loc    string
+}
+
+// schemaChecker 在同一输入位置上展开的边（$ref、allOf/anyOf/oneOf）上做深度优先搜索检测循环，
+// 进入子值的边（properties、items 等）放入队列另行检查
+type schemaChecker struct {
+	v     *schemaValidator
+	state map[uintptr]int // 0 未访问，1 正在展开，2 已完成
+	queue []schemaNode
+}
+
+func (c *schemaChecker) check(node schemaNode, depth int) error {
+	id := reflect.ValueOf(node.schema).Pointer()
+	switch c.state[id] {
+	case 1:
+		return &schemaError{Reason: fmt.Sprintf("%s refers back to itself without consuming input", node.loc)}
+	case 2:
+		return nil
+	}
+	if depth > maxSchemaDepth {
+		return &schemaError{Reason: fmt.Sprintf("%s is nested deeper than %d levels", node.loc, maxSchemaDepth)}
+	}
+	c.state[id] = 1
+
+	if pattern, ok := node.schema["pattern"].(string); ok {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return &schemaError{Reason: fmt.Sprintf("invalid pattern %q at %s: %v", pattern, node.loc, err)}
+		}
+	}
+
+	var same []schemaNode
+	if ref, ok := node.schema["$ref"].(string); ok {
+		target, err := c.v.resolveRef(ref)
+		if err != nil {
+			return err
+		}
+		same = append(same, schemaNode{schema: target, loc: ref})
+	}
+	for _, kw := range []string{"allOf", "anyOf", "oneOf"} {
+		subs, _ := node.schema[kw].([]interface{})
+		for i, sub := range subs {
+			if m := asSchema(sub); m != nil {
+				same = append(same, schemaNode{schema: m, loc: fmt.Sprintf("%s/%s/%d", node.loc, kw, i)})
+			}
+		}
+	}
+	for _, child := range same {
+		if err := c.check(child, depth+1); err != nil {
+			return err
+		}
+	}
+
+	for _, kw := range []string{"properties", "$defs", "definitions"} {
+		children, _ := node.schema[kw].(map[string]interface{})
+		for name, sub := range children {
+			if m := asSchema(sub); m != nil {
+				c.queue = append(c.queue, schemaNode{schema: m, loc: node.loc + "/" + kw + "/" + name})
+			}
+		}
+	}
+	for _, kw := range []string{"additionalProperties", "items"} {
+		if m := asSchema(node.schema[kw]); m != nil {
+			c.queue = append(c.queue, schemaNode{schema: m, loc: node.loc + "/" + kw})
+		}
+	}
+
+	c.state[id] = 2
+	return nil
+}
+
+func checkSchemaType(value interface{}, t interface{}, path string) error {
+	var types []string
+	switch tv := t.(type) {
+	case string:
+		types = []string{tv}
+	case []interface{}:
+		for _, item := range tv {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+	if len(types) == 0 {
+		return nil
+	}
+	actual := jsonTypeOf(value)
+	for _, expected := range types {
+		if expected == actual || (expected == "number" && actual == "integer") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), actual)
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func asSchema(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+func jsonEqual(a, b interface{}) bool {
+	return fmt.Sprintf("%#v", a) == fmt.Sprintf("%#v", b)
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func parseSchemaJSON(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		t.Fatalf("invalid test schema %s: %v", s, err)
+	}
+	return m
+}
+
+func TestValidateJSONSchema(t *testing.T) {
+	tree := `{"type":"object","properties":{"name":{"type":"string"},"children":{"type":"array","items":{"$ref":"#"}}},"required":["name"]}`
+	tests := []struct {
+		name      string
+		schema    string
+		value     string
+		strict    bool
+		wantErr   string
+		schemaErr bool
+	}{
+		{name: "type match", schema: `{"type":"integer"}`, value: `3`},
+		{name: "integer is a number", schema: `{"type":"number"}`, value: `3`},
+		{name: "type mismatch", schema: `{"type":"string"}`, value: `3`, wantErr: "expected string, got integer"},
+		{name: "enum", schema: `{"enum":["a","b"]}`, value: `"c"`, wantErr: "enum"},
+		{name: "required", schema: `{"type":"object","required":["id"]}`, value: `{}`, wantErr: `missing required property "id"`},
+		{name: "additionalProperties false", schema: `{"type":"object","properties":{"a":{}},"additionalProperties":false}`, value: `{"a":1,"b":2}`, wantErr: `additional property "b"`},
+		{name: "strict rejects undeclared", schema: `{"type":"object","properties":{"a":{}}}`, value: `{"b":1}`, strict: true, wantErr: `additional property "b"`},
+		{name: "non-strict allows undeclared", schema: `{"type":"object","properties":{"a":{}}}`, value: `{"b":1}`},
+		{name: "items path", schema: `{"type":"array","items":{"type":"string"}}`, value: `["a",1]`, wantErr: "$[1]: expected string"},
+		{name: "anyOf", schema: `{"anyOf":[{"type":"string"},{"type":"null"}]}`, value: `null`},
+		{name: "oneOf ambiguous", schema: `{"oneOf":[{"type":"number"},{"type":"integer"}]}`, value: `1`, wantErr: "matches 2 schemas in oneOf"},
+		{name: "pattern", schema: `{"type":"string","pattern":"^a+$"}`, value: `"ab"`, wantErr: "does not match pattern"},
+		{name: "defs ref", schema: `{"$defs":{"id":{"type":"integer","minimum":1}},"$ref":"#/$defs/id"}`, value: `0`, wantErr: "less than minimum"},
+		{name: "recursive tree", schema: tree, value: `{"name":"a","children":[{"name":"b","children":[]}]}`},
+		{name: "recursive tree invalid child", schema: tree, value: `{"name":"a","children":[{"children":[]}]}`, wantErr: `$.children[0]: missing required property "name"`},
+		{name: "self ref in anyOf", schema: `{"anyOf":[{"$ref":"#"}]}`, value: `{}`, schemaErr: true},
+		{name: "mutual refs", schema: `{"$defs":{"a":{"$ref":"#/$defs/b"},"b":{"allOf":[{"$ref":"#/$defs/a"}]}},"$ref":"#/$defs/a"}`, value: `1`, schemaErr: true},
+		{name: "unresolvable ref", schema: `{"$ref":"#/$defs/missing"}`, value: `1`, schemaErr: true},
+		{name: "remote ref", schema: `{"$ref":"https://example.com/schema.json"}`, value: `1`, schemaErr: true},
+		{name: "invalid pattern", schema: `{"type":"string","pattern":"("}`, value: `"a"`, schemaErr: true},
+		{name: "too deep", schema: `{"type":"array","items":{"$ref":"#"}}`, value: strings.Repeat("[", 70) + strings.Repeat("]", 70), wantErr: "nested deeper than 64 levels"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatalf("invalid test value: %v", err)
+			}
+			err := validateJSONSchema(value, parseSchemaJSON(t, tt.schema), tt.strict)
+			switch {
+			case tt.schemaErr:
+				if !isSchemaError(err) {
+					t.Fatalf("expected schema error, got %v", err)
+				}
+			case tt.wantErr == "":
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case err == nil || !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			case isSchemaError(err):
+				t.Fatalf("expected validation error, got schema error %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckJSONSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr bool
+	}{
+		{name: "plain object", schema: `{"type":"object","properties":{"a":{"type":"string","pattern":"^x"}}}`},
+		{name: "recursive through items", schema: `{"type":"array","items":{"$ref":"#"}}`},
+		{name: "recursive through properties", schema: `{"$defs":{"node":{"type":"object","properties":{"next":{"anyOf":[{"$ref":"#/$defs/node"},{"type":"null"}]}}}},"$ref":"#/$defs/node"}`},
+		{name: "shared definition", schema: `{"$defs":{"id":{"type":"integer"}},"properties":{"a":{"$ref":"#/$defs/id"},"b":{"$ref":"#/$defs/id"}},"allOf":[{"$ref":"#/$defs/id"},{"$ref":"#/$defs/id"}]}`},
+		{name: "self ref in anyOf", schema: `{"anyOf":[{"$ref":"#"}]}`, wantErr: true},
+		{name: "direct self ref", schema: `{"$ref":"#"}`, wantErr: true},
+		{name: "mutual refs", schema: `{"$defs":{"a":{"$ref":"#/$defs/b"},"b":{"oneOf":[{"$ref":"#/$defs/a"}]}},"properties":{"x":{"$ref":"#/$defs/a"}}}`, wantErr: true},
+		{name: "unresolvable ref", schema: `{"properties":{"a":{"$ref":"#/definitions/missing"}}}`, wantErr: true},
+		{name: "invalid nested pattern", schema: `{"items":{"type":"string","pattern":"[a-"}}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkJSONSchema(parseSchemaJSON(t, tt.schema))
+			if tt.wantErr && !isSchemaError(err) {
+				t.Fatalf("expected schema error, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -66,6 +66,11 @@ type KiroPayload struct {
 	} `json:"conversationState"`
 	ProfileArn      string           `json:"profileArn,omitempty"`
 	InferenceConfig *InferenceConfig `json:"inferenceConfig,omitempty"`
+
+	// 以下字段仅在代理内部使用，不发送给 Kiro
+	toolNames    *toolNameMap  // 本次请求的工具名映射
+	pinnedPrefix string        // 合并在首条历史消息中的系统提示，裁剪历史时需保留
+	trims        []HistoryTrim // 历史裁剪记录
 }
 
 type KiroUserInputMessage struct {
@@ -127,24 +132,45 @@ type KiroToolUse struct {
 }
 
 type InferenceConfig struct {
-	MaxTokens   int     `json:"maxTokens,omitempty"`
-	Temperature float64 `json:"temperature,omitempty"`
-	TopP        float64 `json:"topP,omitempty"`
+	MaxTokens   int      `json:"maxTokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        float64  `json:"topP,omitempty"`
 }
 
 // ==================== 流式回调 ====================
 
 // KiroStreamCallback 流式响应回调
 type KiroStreamCallback struct {
-	OnText     func(text string, isThinking bool)
-	OnToolUse  func(toolUse KiroToolUse)
-	OnComplete func(inputTokens, outputTokens int)
-	OnError    func(err error)
-	OnCredits  func(credits float64)
+	OnText    func(text string, isThinking bool)
+	OnToolUse func(toolUse KiroToolUse) // 工具调用结束，Input 为完整参数
+	// 可选：工具调用开始与参数增量（原始 JSON 片段），用于流式输出工具参数
+	OnToolUseStart func(toolUseID, name string)
+	OnToolUseDelta func(toolUseID, partialJSON string)
+	OnComplete     func(inputTokens, outputTokens int)
+	OnError        func(err error)
+	OnCredits      func(credits float64)
+	// 可选：prompt cache 命中与写入的输入 token，在 OnComplete 之前调用
+	OnCacheUsage func(cacheReadTokens, cacheWriteTokens int)
+	ShouldStop   func() bool // 返回 true 时停止读取上游（如命中 stop sequence）
 }
 
 // ==================== API 调用 ====================
 
+// KiroAPIError Kiro 上游返回的非 200 响应
+type KiroAPIError struct {
+	StatusCode int
+	Endpoint   string
+	Body       string
+	RetryAfter time.Duration // 上游 Retry-After，未给出时为 0
+}
+
+func (e *KiroAPIError) Error() string {
+	if e.StatusCode == 429 {
+		return fmt.Sprintf("quota exhausted on %s", e.Endpoint)
+	}
+	return fmt.Sprintf("HTTP %d from %s: %s", e.StatusCode, e.Endpoint, e.Body)
+}
+
 // getSortedEndpoints 根据首选端点配置排序端点列表
 func getSortedEndpoints(preferred string) []kiroEndpoint {
 	if preferred == "amazonq" {
@@ -159,13 +185,8 @@ func getSortedEndpoints(preferred string) []kiroEndpoint {
 
 // CallKiroAPI 调用 Kiro API（流式），双端点自动 fallback
 func CallKiroAPI(account *config.Account, payload *KiroPayload, callback *KiroStreamCallback) error {
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
-
-	// 预估输入 token（约 3 字符 = 1 token）
-	estimatedInputTokens := max(1, len(body)/3)
+	// 预估输入 token，上游未返回 usage 时使用
+	estimatedInputTokens := countPayloadTokens(payload)
 
 	// User-Agent
 	machineId := account.MachineId
@@ -178,6 +199,11 @@ func CallKiroAPI(account *config.Account, payload *KiroPayload, callback *KiroSt
 		amzUserAgent = fmt.Sprintf("aws-sdk-js/1.0.18 KiroIDE %s", KiroVersion)
 	}
 
+	// 工具名映射回客户端原名
+	if payload.toolNames != nil {
+		callback = payload.toolNames.wrapCallback(callback)
+	}
+
 	// 根据配置排序端点
 	endpoints := getSortedEndpoints(config.GetPreferredEndpoint())
 
@@ -212,16 +238,22 @@ func CallKiroAPI(account *config.Account, payload *KiroPayload, callback *KiroSt
 		}
 
 		if resp.StatusCode == 429 {
+			errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
 			resp.Body.Close()
 			fmt.Printf("[KiroAPI] Endpoint %s quota exhausted (429), trying next...\n", ep.Name)
-			lastErr = fmt.Errorf("quota exhausted on %s", ep.Name)
+			lastErr = &KiroAPIError{
+				StatusCode: 429,
+				Endpoint:   ep.Name,
+				Body:       string(errBody),
+				RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			}
 			continue
 		}
 
 		if resp.StatusCode != 200 {
 			errBody, _ := io.ReadAll(resp.Body)
 			resp.Body.Close()
-			lastErr = fmt.Errorf("HTTP %d from %s: %s", resp.StatusCode, ep.Name, string(errBody))
+			lastErr = &KiroAPIError{StatusCode: resp.StatusCode, Endpoint: ep.Name, Body: string(errBody)}
 			// 认证错误不继续尝试
 			if resp.StatusCode == 401 || resp.StatusCode == 403 {
 				return lastErr
@@ -247,7 +279,8 @@ func CallKiroAPI(account *config.Account, payload *KiroPayload, callback *KiroSt
 func parseEventStream(body io.Reader, callback *KiroStreamCallback, estimatedInputTokens int) error {
 	// 不使用 bufio，直接读取避免缓冲延迟
 	var inputTokens, outputTokens int
-	var totalOutputChars int
+	var cacheReadTokens, cacheWriteTokens int
+	var outputCounter outputTokenCounter
 	var totalCredits float64
 	var currentToolUse *toolUseState
 
@@ -297,12 +330,12 @@ func parseEventStream(body io.Reader, callback *KiroStreamCallback, estimatedInp
 		case "assistantResponseEvent":
 			if content, ok := event["content"].(string); ok && content != "" {
 				callback.OnText(content, false)
-				totalOutputChars += len(content)
+				outputCounter.Add(content)
 			}
 		case "reasoningContentEvent":
 			if text, ok := event["text"].(string); ok && text != "" {
 				callback.OnText(text, true)
-				totalOutputChars += len(text)
+				outputCounter.Add(text)
 			}
 		case "toolUseEvent":
 			currentToolUse = handleToolUseEvent(event, currentToolUse, callback)
@@ -315,17 +348,22 @@ func parseEventStream(body io.Reader, callback *KiroStreamCallback, estimatedInp
 				cacheRead, _ := tokenUsage["cacheReadInputTokens"].(float64)
 				cacheWrite, _ := tokenUsage["cacheWriteInputTokens"].(float64)
 				inputTokens = int(uncached + cacheRead + cacheWrite)
+				cacheReadTokens, cacheWriteTokens = int(cacheRead), int(cacheWrite)
 			}
 		case "meteringEvent":
 			if usage, ok := event["usage"].(float64); ok {
 				totalCredits += usage
 			}
 		}
+
+		if callback.ShouldStop != nil && callback.ShouldStop() {
+			break
+		}
 	}
 
-	// 估算 token（约 3 字符 = 1 token）
-	if outputTokens == 0 && totalOutputChars > 0 {
-		outputTokens = max(1, totalOutputChars/3)
+	// 上游未返回 outputTokens 时按输出文本估算
+	if outputTokens == 0 {
+		outputTokens = outputCounter.Total()
 	}
 	// 如果 Kiro 没返回 inputTokens，使用预估值
 	if inputTokens == 0 {
@@ -335,6 +373,9 @@ func parseEventStream(body io.Reader, callback *KiroStreamCallback, estimatedInp
 	if callback.OnCredits != nil && totalCredits > 0 {
 		callback.OnCredits(totalCredits)
 	}
+	if callback.OnCacheUsage != nil && (cacheReadTokens > 0 || cacheWriteTokens > 0) {
+		callback.OnCacheUsage(cacheReadTokens, cacheWriteTokens)
+	}
 
 	callback.OnComplete(inputTokens, outputTokens)
 	return nil
@@ -355,16 +396,19 @@ func handleToolUseEvent(event map[string]interface{}, current *toolUseState, cal
 
 	if toolUseID != "" && name != "" {
 		if current == nil {
-			current = &toolUseState{ToolUseID: toolUseID, Name: name}
+			current = startToolUse(toolUseID, name, callback)
 		} else if current.ToolUseID != toolUseID {
 			finishToolUse(current, callback)
-			current = &toolUseState{ToolUseID: toolUseID, Name: name}
+			current = startToolUse(toolUseID, name, callback)
 		}
 	}
 
 	if current != nil {
 		if input, ok := event["input"].(string); ok {
 			current.InputBuffer.WriteString(input)
+			if input != "" && callback.OnToolUseDelta != nil {
+				callback.OnToolUseDelta(current.ToolUseID, input)
+			}
 		} else if inputObj, ok := event["input"].(map[string]interface{}); ok {
 			data, _ := json.Marshal(inputObj)
 			current.InputBuffer.Reset()
@@ -380,6 +424,13 @@ func handleToolUseEvent(event map[string]interface{}, current *toolUseState, cal
 	return current
 }
 
+func startToolUse(toolUseID, name string, callback *KiroStreamCallback) *toolUseState {
+	if callback.OnToolUseStart != nil {
+		callback.OnToolUseStart(toolUseID, name)
+	}
+	return &toolUseState{ToolUseID: toolUseID, Name: name}
+}
+
 func finishToolUse(state *toolUseState, callback *KiroStreamCallback) {
 	var input map[string]interface{}
 	if state.InputBuffer.Len() > 0 {
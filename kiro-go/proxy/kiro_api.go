@@ -2,9 +2,12 @@ package proxy
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"kiro-api-proxy/auth"
 	"kiro-api-proxy/config"
+	"kiro-api-proxy/pool"
 	"net/http"
 	"strings"
 	"time"
@@ -35,7 +38,7 @@ func GetUsageLimits(account *config.Account) (*UsageLimitsResponse, error) {
 
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+		return nil, &KiroAPIError{StatusCode: resp.StatusCode, Endpoint: "getUsageLimits", Body: string(body)}
 	}
 
 	var result UsageLimitsResponse
@@ -135,60 +138,39 @@ func RefreshAccountInfo(account *config.Account) (*config.AccountInfo, error) {
 
 	// 获取使用量和订阅信息
 	usage, err := GetUsageLimits(account)
+	if isTokenRejected(err) {
+		// token 可能在 ExpiresAt 之前已被撤销或轮换：强制刷新一次后重试，仍被拒绝才视为认证失败
+		if refreshErr := auth.GetRefreshManager().Refresh(account); refreshErr != nil {
+			fmt.Printf("[RefreshAccountInfo] Token refresh failed for %s: %v\n", account.Email, refreshErr)
+		} else {
+			usage, err = GetUsageLimits(account)
+		}
+	}
 	if err != nil {
 		// 检测封禁状态
-		errMsg := err.Error()
-		if strings.Contains(errMsg, "TEMPORARILY_SUSPENDED") {
-			// 账户被暂时封禁，自动禁用并标记封禁状态
-			fmt.Printf("[RefreshAccountInfo] Account %s is temporarily suspended: %v\n", account.Email, err)
-
-			// 更新账户封禁状态并自动禁用
-			updatedAccount := *account
-			updatedAccount.Enabled = false
-			updatedAccount.BanStatus = "BANNED"
-			updatedAccount.BanReason = "AWS temporarily suspended - unusual user activity detected"
-			updatedAccount.BanTime = time.Now().Unix()
-
-			// 保存更新后的账户状态
-			if updateErr := config.UpdateAccount(account.ID, updatedAccount); updateErr != nil {
-				fmt.Printf("[RefreshAccountInfo] Failed to update account ban status: %v\n", updateErr)
-			}
-
-			return nil, fmt.Errorf("Account suspended: %w", err)
-		} else if strings.Contains(errMsg, "403") || strings.Contains(errMsg, "401") ||
-				  strings.Contains(errMsg, "invalid") || strings.Contains(errMsg, "expired") {
-			// Token 相关错误，可能需要重新认证
-			fmt.Printf("[RefreshAccountInfo] Authentication error for %s: %v\n", account.Email, err)
-
-			// 更新账户封禁状态为认证失败并自动禁用
-			updatedAccount := *account
-			updatedAccount.Enabled = false
-			updatedAccount.BanStatus = "BANNED"
-			updatedAccount.BanReason = "Authentication failed - token invalid or expired"
-			updatedAccount.BanTime = time.Now().Unix()
-
-			// 保存更新后的账户状态
-			if updateErr := config.UpdateAccount(account.ID, updatedAccount); updateErr != nil {
-				fmt.Printf("[RefreshAccountInfo] Failed to update account ban status: %v\n", updateErr)
+		var apiErr *KiroAPIError
+		if errors.As(err, &apiErr) {
+			switch {
+			case strings.Contains(apiErr.Body, "TEMPORARILY_SUSPENDED"):
+				// 账户被暂时封禁，标记为 suspended（自动禁用）
+				fmt.Printf("[RefreshAccountInfo] Account %s is temporarily suspended: %v\n", account.Email, err)
+				setAccountState(account, pool.StateSuspended, "AWS temporarily suspended - unusual user activity detected")
+
+				return nil, fmt.Errorf("Account suspended: %w", err)
+			case isTokenRejected(err):
+				// 刷新 token 后仍被拒绝或无法刷新，需要重新认证，标记为 auth_failed（自动禁用）
+				fmt.Printf("[RefreshAccountInfo] Authentication error for %s: %v\n", account.Email, err)
+				setAccountState(account, pool.StateAuthFailed, "Authentication failed - token invalid or expired")
 			}
 		}
 
 		return nil, fmt.Errorf("GetUsageLimits: %w", err)
 	}
 
-	// 如果成功获取信息，清除封禁状态（如果之前被标记）
-	if account.BanStatus != "" && account.BanStatus != "ACTIVE" {
-		fmt.Printf("[RefreshAccountInfo] Account %s is now active, clearing ban status\n", account.Email)
-
-		updatedAccount := *account
-		updatedAccount.BanStatus = "ACTIVE"
-		updatedAccount.BanReason = ""
-		updatedAccount.BanTime = 0
-
-		// 保存更新后的账户状态
-		if updateErr := config.UpdateAccount(account.ID, updatedAccount); updateErr != nil {
-			fmt.Printf("[RefreshAccountInfo] Failed to clear account ban status: %v\n", updateErr)
-		}
+	// 如果成功获取信息，恢复之前因封禁或认证失败而禁用的账号
+	if info, ok := pool.GetPool().State(account.ID); ok && (info.State == pool.StateSuspended || info.State == pool.StateAuthFailed) {
+		fmt.Printf("[RefreshAccountInfo] Account %s is now active, clearing %s state\n", account.Email, info.State)
+		setAccountState(account, pool.StateActive, "account info refreshed successfully")
 	}
 
 	// 解析用户信息
@@ -343,3 +325,18 @@ type ModelInfo struct {
 		MaxOutputTokens int `json:"maxOutputTokens"`
 	} `json:"tokenLimits"`
 }
+
+// isTokenRejected 上游以 401/403 拒绝 token（不含账号被暂停）
+func isTokenRejected(err error) bool {
+	var apiErr *KiroAPIError
+	return errors.As(err, &apiErr) &&
+		(apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden) &&
+		!strings.Contains(apiErr.Body, "TEMPORARILY_SUSPENDED")
+}
+
+// setAccountState 变更账号生命周期状态，失败（如管理员已禁用该账号）时只记录日志
+func setAccountState(account *config.Account, state pool.AccountState, reason string) {
+	if err := pool.GetPool().SetState(account.ID, state, reason); err != nil {
+		fmt.Printf("[RefreshAccountInfo] Failed to update state of %s: %v\n", account.Email, err)
+	}
+}
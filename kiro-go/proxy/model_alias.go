@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"fmt"
+	"kiro-api-proxy/config"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 未匹配任何别名且未开启拒绝时使用的模型
+const defaultModel = "claude-sonnet-4.5"
+
+// 编译后的别名正则，按 pattern 缓存
+var aliasRegexCache sync.Map
+
+func compileAliasRegex(pattern string) (*regexp.Regexp, error) {
+	if re, ok := aliasRegexCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, err
+	}
+	aliasRegexCache.Store(pattern, re)
+	return re, nil
+}
+
+// validateModelAlias 校验别名配置
+func validateModelAlias(a *config.ModelAlias) error {
+	if a.Pattern == "" || a.Target == "" {
+		return fmt.Errorf("pattern and target are required")
+	}
+	switch a.Match {
+	case "":
+		a.Match = config.MatchExact
+	case config.MatchExact, config.MatchPrefix:
+	case config.MatchRegex:
+		if _, err := compileAliasRegex(a.Pattern); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	default:
+		return fmt.Errorf("invalid match, must be: exact, prefix, or regex")
+	}
+	if a.MaxTokens < 0 || a.ThinkingBudget < 0 {
+		return fmt.Errorf("maxTokens and thinkingBudget must not be negative")
+	}
+	return nil
+}
+
+func aliasMatches(a config.ModelAlias, lower string) bool {
+	switch a.Match {
+	case config.MatchExact, "":
+		return lower == strings.ToLower(a.Pattern)
+	case config.MatchPrefix:
+		return strings.HasPrefix(lower, strings.ToLower(a.Pattern))
+	case config.MatchRegex:
+		re, err := compileAliasRegex(a.Pattern)
+		return err == nil && re.MatchString(lower)
+	}
+	return false
+}
+
+// matchModelAlias 按优先级查找第一个匹配的别名
+func matchModelAlias(aliases []config.ModelAlias, model string) *config.ModelAlias {
+	sort.SliceStable(aliases, func(i, j int) bool {
+		return aliases[i].Priority > aliases[j].Priority
+	})
+	lower := strings.ToLower(model)
+	for i := range aliases {
+		if !aliases[i].Disabled && aliasMatches(aliases[i], lower) {
+			return &aliases[i]
+		}
+	}
+	return nil
+}
+
+// ModelNotFoundError 模型未匹配任何别名且已开启拒绝未知模型
+type ModelNotFoundError struct {
+	Model string
+}
+
+func (e *ModelNotFoundError) Error() string {
+	return fmt.Sprintf("model %q not found", e.Model)
+}
+
+// ModelResolution 模型解析结果
+type ModelResolution struct {
+	Model    string             // Kiro 模型 ID
+	Thinking bool               // 模型名带 thinking 后缀
+	Alias    *config.ModelAlias // 命中的别名，未命中时为 nil
+}
+
+// resolveModel 去除 thinking 后缀后按别名表解析模型
+// 未命中别名时：有效 Kiro 模型原样透传，开启拒绝时返回 ModelNotFoundError，
+// 否则 claude-* 透传、其他模型改写为默认模型。
+// known 判断模型是否为有效 Kiro 模型，为 nil 时按 claude- 前缀判断
+func resolveModel(model, thinkingSuffix string, known func(string) bool) (ModelResolution, error) {
+	res := ModelResolution{}
+	if thinkingSuffix != "" && strings.HasSuffix(strings.ToLower(model), strings.ToLower(thinkingSuffix)) {
+		res.Thinking = true
+		model = model[:len(model)-len(thinkingSuffix)]
+	}
+
+	if alias := matchModelAlias(config.GetModelAliases(), model); alias != nil {
+		res.Model, res.Alias = alias.Target, alias
+		return res, nil
+	}
+
+	isClaude := strings.HasPrefix(strings.ToLower(model), "claude-")
+	if known == nil {
+		known = func(string) bool { return isClaude }
+	}
+	switch {
+	case known(model):
+		res.Model = model
+	case config.IsRejectUnknownModels():
+		return res, &ModelNotFoundError{Model: model}
+	case isClaude:
+		// 未在模型列表中的 claude-* 仍原样透传，由上游判断
+		res.Model = model
+	default:
+		res.Model = defaultModel
+	}
+	return res, nil
+}
+
+// resolveModel 解析请求模型，拒绝未知模型时以缓存的 Kiro 模型列表为准
+func (h *Handler) resolveModel(model string) (ModelResolution, error) {
+	h.modelsCacheMu.RLock()
+	cached := h.cachedModels
+	h.modelsCacheMu.RUnlock()
+
+	var known func(string) bool
+	if len(cached) > 0 {
+		known = func(m string) bool {
+			for _, c := range cached {
+				if strings.EqualFold(c.ModelId, m) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return resolveModel(model, config.GetThinkingConfig().Suffix, known)
+}
+
+// thinkingBudget 合并模型后缀、请求参数与别名默认值，返回 0 表示不启用 thinking
+func (res ModelResolution) thinkingBudget(requested int, explicit bool) int {
+	if budget := ResolveThinkingBudget(res.Thinking, requested); budget > 0 || explicit {
+		return budget
+	}
+	if res.Alias != nil && res.Alias.ThinkingBudget > 0 {
+		return clampThinkingBudget(res.Alias.ThinkingBudget)
+	}
+	return 0
+}
+
+// applyDefaults 为请求未指定的参数填充别名默认值
+// temperature 为 nil 表示请求未指定，显式的 0 保留
+func (res ModelResolution) applyDefaults(temperature **float64, maxTokens *int) {
+	if res.Alias == nil {
+		return
+	}
+	if *temperature == nil && res.Alias.Temperature != nil {
+		t := *res.Alias.Temperature
+		*temperature = &t
+	}
+	if *maxTokens == 0 && res.Alias.MaxTokens > 0 {
+		*maxTokens = res.Alias.MaxTokens
+	}
+}
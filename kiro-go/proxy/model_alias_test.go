@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"kiro-api-proxy/config"
+	"testing"
+)
+
+func TestMatchModelAliasOrdering(t *testing.T) {
+	aliases := []config.ModelAlias{
+		{ID: "prefix-low", Match: config.MatchPrefix, Pattern: "claude-sonnet-4", Target: "claude-sonnet-4", Priority: 50},
+		{ID: "regex-high", Match: config.MatchRegex, Pattern: `^claude-sonnet-4[-.]5`, Target: "claude-sonnet-4.5", Priority: 100},
+		{ID: "exact-first", Match: config.MatchExact, Pattern: "gpt-4o", Target: "claude-sonnet-4.5", Priority: 20},
+		{ID: "exact-second", Match: config.MatchExact, Pattern: "gpt-4o", Target: "claude-haiku-4.5", Priority: 20},
+		{ID: "disabled-top", Match: config.MatchPrefix, Pattern: "gpt", Target: "claude-opus-4.5", Priority: 1000, Disabled: true},
+		{ID: "regex-fallback", Match: config.MatchRegex, Pattern: `^gpt-`, Target: "claude-haiku-4.5", Priority: 10},
+	}
+
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{model: "claude-sonnet-4-5-20250929", want: "regex-high"},
+		{model: "Claude-Sonnet-4.5", want: "regex-high"},
+		{model: "claude-sonnet-4-20250514", want: "prefix-low"},
+		{model: "gpt-4o", want: "exact-first"},
+		{model: "GPT-4O", want: "exact-first"},
+		{model: "gpt-3.5-turbo", want: "regex-fallback"},
+		{model: "gemini-pro", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			list := append([]config.ModelAlias(nil), aliases...)
+			got := matchModelAlias(list, tt.model)
+			switch {
+			case tt.want == "" && got != nil:
+				t.Fatalf("expected no match, got %s", got.ID)
+			case tt.want != "" && got == nil:
+				t.Fatalf("expected %s, got no match", tt.want)
+			case got != nil && got.ID != tt.want:
+				t.Fatalf("expected %s, got %s", tt.want, got.ID)
+			}
+		})
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	aliasTemp, zero, explicit := 0.7, 0.0, 0.2
+	res := ModelResolution{Alias: &config.ModelAlias{Temperature: &aliasTemp, MaxTokens: 4096}}
+
+	tests := []struct {
+		name          string
+		temperature   *float64
+		maxTokens     int
+		wantTemp      float64
+		wantMaxTokens int
+	}{
+		{name: "unset uses alias defaults", temperature: nil, maxTokens: 0, wantTemp: 0.7, wantMaxTokens: 4096},
+		{name: "explicit zero temperature kept", temperature: &zero, maxTokens: 0, wantTemp: 0, wantMaxTokens: 4096},
+		{name: "explicit values kept", temperature: &explicit, maxTokens: 100, wantTemp: 0.2, wantMaxTokens: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			temperature, maxTokens := tt.temperature, tt.maxTokens
+			res.applyDefaults(&temperature, &maxTokens)
+			if temperature == nil || *temperature != tt.wantTemp {
+				t.Fatalf("temperature = %v, want %v", temperature, tt.wantTemp)
+			}
+			if maxTokens != tt.wantMaxTokens {
+				t.Fatalf("maxTokens = %d, want %d", maxTokens, tt.wantMaxTokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"fmt"
+	"kiro-api-proxy/config"
+	"kiro-api-proxy/pool"
+	"sync"
+	"time"
+)
+
+const (
+	// 探测循环间隔
+	probeTick = 30 * time.Second
+	// 冷却中账号的探测间隔（冷却开始后至少等待这么久才首次探测）
+	probeCooldownInterval = time.Minute
+	// 认证失败或被暂停账号的探测间隔
+	probeBannedInterval = 10 * time.Minute
+	// 每个账号保留的探测记录数
+	probeHistorySize = 20
+)
+
+// 探测对象：cooldown 为冷却中（cooling_down、quota_exhausted），banned 为自动禁用（auth_failed、suspended）
+const (
+	probeTargetCooldown = "cooldown"
+	probeTargetBanned   = "banned"
+)
+
+// ProbeResult 单次健康探测结果
+type ProbeResult struct {
+	Time       int64  `json:"time"`
+	Target     string `json:"target"`           // cooldown / banned
+	Reason     string `json:"reason,omitempty"` // 冷却原因或禁用原因
+	Success    bool   `json:"success"`
+	Restored   bool   `json:"restored"` // 探测通过并已恢复账号
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// healthProber 后台健康探测：对冷却中与自动禁用的账号定期调用 GetUsageLimits，通过后提前恢复
+type healthProber struct {
+	mu        sync.Mutex
+	history   map[string][]ProbeResult
+	lastProbe map[string]time.Time
+}
+
+func newHealthProber() *healthProber {
+	return &healthProber{
+		history:   make(map[string][]ProbeResult),
+		lastProbe: make(map[string]time.Time),
+	}
+}
+
+// due 账号距上次探测已超过 interval
+func (p *healthProber) due(id string, interval time.Duration, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return now.Sub(p.lastProbe[id]) >= interval
+}
+
+func (p *healthProber) record(id string, result ProbeResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastProbe[id] = time.Unix(result.Time, 0)
+	history := append(p.history[id], result)
+	if len(history) > probeHistorySize {
+		history = history[len(history)-probeHistorySize:]
+	}
+	p.history[id] = history
+}
+
+// History 返回账号的探测记录（按时间倒序），id 为空时返回全部账号
+func (p *healthProber) History(id string) map[string][]ProbeResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make(map[string][]ProbeResult)
+	for accID, history := range p.history {
+		if id != "" && accID != id {
+			continue
+		}
+		items := make([]ProbeResult, len(history))
+		for i, r := range history {
+			items[len(history)-1-i] = r
+		}
+		result[accID] = items
+	}
+	return result
+}
+
+// Last 返回账号最近一次探测结果
+func (p *healthProber) Last(id string) (ProbeResult, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	history := p.history[id]
+	if len(history) == 0 {
+		return ProbeResult{}, false
+	}
+	return history[len(history)-1], true
+}
+
+// backgroundProbe 后台健康探测循环
+func (h *Handler) backgroundProbe() {
+	ticker := time.NewTicker(probeTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if config.IsHealthProbeEnabled() {
+				h.probeAccounts()
+			}
+		case <-h.stopRefresh:
+			return
+		}
+	}
+}
+
+// probeAccounts 按账号状态探测到期的冷却中账号与自动禁用账号
+func (h *Handler) probeAccounts() {
+	now := time.Now()
+	states := h.pool.States()
+	cooldowns := h.pool.GetCooldowns()
+	for _, account := range config.GetAccounts() {
+		account := account
+		info := states[account.ID]
+		switch info.State {
+		case pool.StateCoolingDown, pool.StateQuotaExhausted:
+			cooldown, ok := cooldowns[account.ID]
+			// 限流冷却遵循上游给出的等待时间，不提前探测
+			if !ok || cooldown.Reason == pool.CooldownRateLimited || now.Sub(cooldown.Since) < probeCooldownInterval {
+				continue
+			}
+			if h.prober.due(account.ID, probeCooldownInterval, now) {
+				h.probeAccount(&account, probeTargetCooldown, cooldown.Reason)
+			}
+		case pool.StateAuthFailed, pool.StateSuspended:
+			if h.prober.due(account.ID, probeBannedInterval, now) {
+				h.probeAccount(&account, probeTargetBanned, info.Reason)
+			}
+		}
+	}
+}
+
+// probeTarget 按账号当前状态确定探测对象与原因（用于手动探测）
+func (h *Handler) probeTarget(account *config.Account) (target, reason string) {
+	if info, _ := h.pool.State(account.ID); info.State == pool.StateAuthFailed || info.State == pool.StateSuspended {
+		return probeTargetBanned, info.Reason
+	}
+	return probeTargetCooldown, h.pool.GetCooldowns()[account.ID].Reason
+}
+
+// probeAccount 调用 GetUsageLimits 检查账号，通过后解除冷却或重新启用自动禁用的账号
+func (h *Handler) probeAccount(account *config.Account, target, reason string) (result ProbeResult) {
+	start := time.Now()
+	result = ProbeResult{Time: start.Unix(), Target: target, Reason: reason}
+	defer func() {
+		result.DurationMs = time.Since(start).Milliseconds()
+		h.prober.record(account.ID, result)
+		status := "failed"
+		if result.Restored {
+			status = "restored"
+		} else if result.Success {
+			status = "passed"
+		}
+		fmt.Printf("[HealthProbe] %s (%s: %s) %s %s\n", account.Email, target, reason, status, result.Error)
+	}()
+
+	// 认证失败的账号需要先换新 token
+	var err error
+	if info, _ := h.pool.State(account.ID); info.State == pool.StateAuthFailed {
+		err = h.forceRefreshToken(account)
+	} else {
+		err = h.ensureValidToken(account)
+	}
+	if err != nil {
+		result.Error = truncateError("token refresh failed: " + err.Error())
+		return result
+	}
+
+	info, err := RefreshAccountInfo(account)
+	if err != nil {
+		result.Error = truncateError(err.Error())
+		return result
+	}
+	result.Success = true
+	config.UpdateAccountInfo(account.ID, *info)
+
+	switch target {
+	case probeTargetBanned:
+		// RefreshAccountInfo 成功后已将账号恢复为 active
+		info, _ := h.pool.State(account.ID)
+		result.Restored = info.State == pool.StateActive
+		if !result.Restored {
+			result.Error = "account is still " + string(info.State)
+		}
+	case probeTargetCooldown:
+		if reason == pool.CooldownQuotaExhausted {
+			// 额度冷却只在账号信息显示额度已恢复时由账号池解除
+			h.pool.Reload()
+			_, cooling := h.pool.GetCooldowns()[account.ID]
+			result.Success, result.Restored = !cooling, !cooling
+			if cooling {
+				result.Error = "quota still exhausted"
+			}
+		} else {
+			h.pool.ClearCooldown(account.ID, "health probe passed")
+			result.Restored = reason != ""
+		}
+	}
+	return result
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kiro-api-proxy/config"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// responseFormatError 模型输出不符合 response_format
+type responseFormatError struct {
+	Reason string
+}
+
+func (e *responseFormatError) Error() string {
+	return "response does not match response_format: " + e.Reason
+}
+
+// structured 是否要求结构化 JSON 输出
+func (rf *OpenAIResponseFormat) structured() bool {
+	return rf != nil && (rf.Type == "json_object" || rf.Type == "json_schema")
+}
+
+// checkSchema 在调用上游前检查 json_schema 本身是否有效
+func (rf *OpenAIResponseFormat) checkSchema() error {
+	if rf == nil || rf.Type != "json_schema" || rf.JSONSchema == nil || rf.JSONSchema.Schema == nil {
+		return nil
+	}
+	return checkJSONSchema(rf.JSONSchema.Schema)
+}
+
+// directive 注入到当前消息末尾的结构化输出指令
+func (rf *OpenAIResponseFormat) directive() string {
+	const noWrapping = "Do not wrap it in markdown code fences and do not add any text before or after it."
+	switch {
+	case !rf.structured():
+		return ""
+	case rf.Type == "json_schema" && rf.JSONSchema != nil && rf.JSONSchema.Schema != nil:
+		schema, _ := json.Marshal(rf.JSONSchema.Schema)
+		var sb strings.Builder
+		sb.WriteString("<response_format>Respond with a single JSON value that strictly conforms to the JSON Schema below")
+		if rf.JSONSchema.Name != "" {
+			sb.WriteString(" (" + rf.JSONSchema.Name + ")")
+		}
+		sb.WriteString(". " + noWrapping)
+		if rf.JSONSchema.Description != "" {
+			sb.WriteString("\nPurpose: " + rf.JSONSchema.Description)
+		}
+		sb.WriteString("\n<json_schema>" + string(schema) + "</json_schema></response_format>")
+		return sb.String()
+	default:
+		return "<response_format>Respond with a single valid JSON object only. " + noWrapping + "</response_format>"
+	}
+}
+
+// check 校验并修复模型输出，返回可直接作为 content 的 JSON 文本
+func (rf *OpenAIResponseFormat) check(content string) (string, error) {
+	repaired := repairJSONContent(content)
+	var value interface{}
+	if err := json.Unmarshal([]byte(repaired), &value); err != nil {
+		return "", &responseFormatError{Reason: "invalid JSON: " + err.Error()}
+	}
+
+	if rf.Type == "json_schema" && rf.JSONSchema != nil && rf.JSONSchema.Schema != nil {
+		if err := validateJSONSchema(value, rf.JSONSchema.Schema, rf.JSONSchema.Strict); err != nil {
+			if isSchemaError(err) {
+				return "", err
+			}
+			return "", &responseFormatError{Reason: err.Error()}
+		}
+	} else if _, ok := value.(map[string]interface{}); !ok {
+		return "", &responseFormatError{Reason: "expected a JSON object"}
+	}
+	return repaired, nil
+}
+
+// repairJSONContent 去除代码块围栏与首尾多余文本，提取最外层 JSON
+func repairJSONContent(content string) string {
+	s := strings.TrimSpace(content)
+	if strings.HasPrefix(s, "```") {
+		if nl := strings.Index(s, "\n"); nl != -1 {
+			s = s[nl+1:]
+		}
+		s = strings.TrimSuffix(strings.TrimSpace(s), "```")
+		s = strings.TrimSpace(s)
+	}
+	if json.Valid([]byte(s)) {
+		return s
+	}
+
+	start := strings.IndexAny(s, "{[")
+	if start == -1 {
+		return s
+	}
+	closing := "}"
+	if s[start] == '[' {
+		closing = "]"
+	}
+	end := strings.LastIndex(s, closing)
+	if end <= start {
+		return s
+	}
+	return s[start : end+1]
+}
+
+// isOutputCheckError 模型输出未通过校验（tool_choice / response_format）
+// 这类错误与账号无关，只在同一账号上重试
+func isOutputCheckError(err error) bool {
+	var rfErr *responseFormatError
+	return errors.Is(err, errToolChoiceUnsatisfied) || errors.As(err, &rfErr)
+}
+
+// handleOpenAIStructuredStream 结构化输出的流式响应
+// 需要完整校验 JSON，因此先接收全部内容，校验通过后再以 SSE 输出；失败时未写出任何数据，可重试
+func (h *Handler) handleOpenAIStructuredStream(w http.ResponseWriter, account *config.Account, payload *KiroPayload, model string, opts responseOptions) (kiroUsage, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return kiroUsage{}, errStreamingUnsupported
+	}
+
+	out, err := h.collectOpenAIResponse(account, payload, opts)
+	if err != nil {
+		return kiroUsage{}, err
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	chatID := "chatcmpl-" + uuid.New().String()
+	created := time.Now().Unix()
+	sendDelta := func(delta map[string]interface{}, finishReason interface{}, extra map[string]interface{}) {
+		chunk := map[string]interface{}{
+			"id":      chatID,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   model,
+			"choices": []map[string]interface{}{{
+				"index":         0,
+				"delta":         delta,
+				"finish_reason": finishReason,
+			}},
+		}
+		for k, v := range extra {
+			chunk[k] = v
+		}
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", string(data))
+		flusher.Flush()
+	}
+
+	// thinking 总是放在 reasoning_content，避免破坏 JSON 内容
+	if out.ReasoningContent != "" {
+		sendDelta(map[string]interface{}{"reasoning_content": out.ReasoningContent}, nil, nil)
+	}
+	if out.Content != "" {
+		sendDelta(map[string]interface{}{"content": out.Content}, nil, nil)
+	}
+	for i, tu := range out.ToolUses {
+		args, _ := json.Marshal(tu.Input)
+		sendDelta(map[string]interface{}{
+			"tool_calls": []map[string]interface{}{{
+				"index": i,
+				"id":    tu.ToolUseID,
+				"type":  "function",
+				"function": map[string]string{
+					"name":      tu.Name,
+					"arguments": string(args),
+				},
+			}},
+		}, nil, nil)
+	}
+
+	sendDelta(map[string]interface{}{}, out.FinishReason, map[string]interface{}{
+		"usage": out.Usage.openAIUsage(),
+	})
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+
+	return out.Usage, nil
+}
+
+// openAICollected 完整接收的一次上游响应
+type openAICollected struct {
+	Content          string
+	ReasoningContent string
+	ToolUses         []KiroToolUse
+	FinishReason     string
+	Usage            kiroUsage
+}
+
+// collectOpenAIResponse 完整接收一次上游响应并应用 tool_choice / stop / response_format 校验
+func (h *Handler) collectOpenAIResponse(account *config.Account, payload *KiroPayload, opts responseOptions) (*openAICollected, error) {
+	var content, reasoningContent string
+	var toolUses []KiroToolUse
+	var usage kiroUsage
+	limiter := newOutputLimiter(opts.StopSequences, opts.MaxTokens)
+
+	callback := &KiroStreamCallback{
+		OnText: func(text string, isThinking bool) {
+			if isThinking {
+				reasoningContent += text
+			} else {
+				content += limiter.Text(text)
+			}
+		},
+		OnToolUse: func(tu KiroToolUse) {
+			if !limiter.Stopped() && opts.ToolChoice.accepts(tu) {
+				toolUses = append(toolUses, tu)
+			}
+		},
+		OnComplete: func(inTok, outTok int) { usage.InputTokens = inTok; usage.OutputTokens = outTok },
+		OnCredits:  func(c float64) { usage.Credits = c },
+		OnCacheUsage: func(read, write int) {
+			usage.CacheReadTokens, usage.CacheWriteTokens = read, write
+		},
+		ShouldStop: limiter.Stopped,
+	}
+
+	if err := CallKiroAPI(account, payload, callback); err != nil {
+		return nil, err
+	}
+	content += limiter.Flush()
+
+	out := &openAICollected{
+		ToolUses:     toolUses,
+		FinishReason: limiter.OpenAIFinishReason(len(toolUses) > 0, usage.OutputTokens),
+		Usage:        usage,
+	}
+
+	if opts.ToolChoice.Required() {
+		if len(toolUses) == 0 {
+			return nil, errToolChoiceUnsatisfied
+		}
+		return out, nil
+	}
+
+	finalContent, extractedReasoning := extractThinkingFromContent(content)
+	if extractedReasoning != "" {
+		reasoningContent = extractedReasoning + reasoningContent
+	}
+
+	// 调用工具时不要求结构化内容
+	if opts.ResponseFormat.structured() && len(toolUses) == 0 {
+		checked, err := opts.ResponseFormat.check(finalContent)
+		if err != nil {
+			return nil, err
+		}
+		finalContent = checked
+	}
+	out.Content, out.ReasoningContent = finalContent, reasoningContent
+	return out, nil
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"kiro-api-proxy/config"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sessionHeader 客户端指定会话 ID 的请求头
+const sessionHeader = "X-Session-Id"
+
+// 过期会话的清理间隔
+const sessionPruneInterval = time.Minute
+
+// SessionBinding 会话与账号、conversationId 的绑定
+type SessionBinding struct {
+	Key            string `json:"key"`
+	AccountID      string `json:"accountId"`
+	Email          string `json:"email,omitempty"`
+	ConversationID string `json:"conversationId"`
+	Requests       int    `json:"requests"`
+	CreatedAt      int64  `json:"createdAt"`
+	LastUsed       int64  `json:"lastUsed"`
+	ExpiresAt      int64  `json:"expiresAt"`
+}
+
+// sessionStore 会话粘性：同一会话复用账号与 conversationId，绑定在 TTL 内无请求时过期（仅内存）
+type sessionStore struct {
+	mu        sync.Mutex
+	bindings  map[string]*SessionBinding
+	inflight  map[string]int // 会话正在处理的请求数
+	lastPrune time.Time
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{bindings: make(map[string]*SessionBinding), inflight: make(map[string]int)}
+}
+
+// sessionRoute 单次请求的会话路由信息，未绑定时 AccountID 与 ConversationID 为空
+type sessionRoute struct {
+	Key            string
+	AccountID      string
+	ConversationID string
+	Concurrent     bool // 同一会话已有请求在处理，本次不复用也不改写绑定
+}
+
+// Route 查找会话当前绑定，key 为空或绑定已过期时返回空路由
+// 同一会话已有请求在处理时不复用其 conversationId，避免并发请求写入同一 Kiro 对话
+// 每次 Route 都必须调用 Bind 结束
+func (s *sessionStore) Route(key string) sessionRoute {
+	route := sessionRoute{Key: key}
+	if key == "" {
+		return route
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight[key]++
+	if s.inflight[key] > 1 {
+		route.Concurrent = true
+		return route
+	}
+	if b, ok := s.bindings[key]; ok {
+		if time.Now().Unix() < b.ExpiresAt {
+			route.AccountID, route.ConversationID = b.AccountID, b.ConversationID
+		} else {
+			delete(s.bindings, key)
+		}
+	}
+	return route
+}
+
+// apply 复用会话的 conversationId
+func (route sessionRoute) apply(payload *KiroPayload) {
+	if route.ConversationID != "" {
+		payload.ConversationState.ConversationID = route.ConversationID
+	}
+}
+
+// Bind 结束 Route 开始的请求，请求成功后将会话绑定到实际使用的账号与 conversationId
+// 并发请求不改写已有绑定
+func (s *sessionStore) Bind(route sessionRoute, res failoverResult, payload *KiroPayload) {
+	if route.Key == "" {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inflight[route.Key]--; s.inflight[route.Key] <= 0 {
+		delete(s.inflight, route.Key)
+	}
+	if res.Err != nil || res.Account == nil {
+		return
+	}
+	b, ok := s.bindings[route.Key]
+	if ok && route.Concurrent {
+		return
+	}
+	if !ok {
+		b = &SessionBinding{Key: route.Key, CreatedAt: now.Unix()}
+		s.bindings[route.Key] = b
+	}
+	b.AccountID = res.Account.ID
+	b.Email = res.Account.Email
+	b.ConversationID = payload.ConversationState.ConversationID
+	b.Requests++
+	b.LastUsed = now.Unix()
+	b.ExpiresAt = now.Add(config.GetSessionTTL()).Unix()
+
+	if now.Sub(s.lastPrune) >= sessionPruneInterval {
+		s.lastPrune = now
+		for key, b := range s.bindings {
+			if now.Unix() >= b.ExpiresAt {
+				delete(s.bindings, key)
+			}
+		}
+	}
+}
+
+// List 返回未过期的绑定，按最近使用时间倒序
+func (s *sessionStore) List() []SessionBinding {
+	now := time.Now().Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]SessionBinding, 0, len(s.bindings))
+	for _, b := range s.bindings {
+		if now < b.ExpiresAt {
+			result = append(result, *b)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastUsed > result[j].LastUsed
+	})
+	return result
+}
+
+// Delete 删除绑定，key 为空时清空全部
+func (s *sessionStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key == "" {
+		s.bindings = make(map[string]*SessionBinding)
+		return
+	}
+	delete(s.bindings, key)
+}
+
+// claudeSessionKey 会话 key：X-Session-Id 请求头 > metadata.user_id > 首条消息哈希，按调用方区分
+func claudeSessionKey(r *http.Request, req *ClaudeRequest) string {
+	if id := r.Header.Get(sessionHeader); id != "" {
+		return scopeSessionKey(r, "header:"+id)
+	}
+	if req.Metadata != nil && req.Metadata.UserID != "" {
+		return scopeSessionKey(r, "user:"+req.Metadata.UserID)
+	}
+	if len(req.Messages) == 0 {
+		return ""
+	}
+	// 只取文本：cache_control 等标记在不同轮次间会移动
+	first, _, _ := extractClaudeUserContent(req.Messages[0].Content)
+	return scopeSessionKey(r, hashSessionKey(extractSystemPrompt(req.System), first))
+}
+
+// openAISessionKey 会话 key：X-Session-Id 请求头 > 系统提示与首条 user 消息哈希，按调用方区分
+func openAISessionKey(r *http.Request, req *OpenAIRequest) string {
+	if id := r.Header.Get(sessionHeader); id != "" {
+		return scopeSessionKey(r, "header:"+id)
+	}
+	var head []interface{}
+	for _, msg := range req.Messages {
+		text, _ := extractOpenAIUserContent(msg.Content)
+		head = append(head, msg.Role, text)
+		if msg.Role == "user" {
+			return scopeSessionKey(r, hashSessionKey(head...))
+		}
+	}
+	return ""
+}
+
+// scopeSessionKey 为会话 key 加上调用方前缀：使用 API Key 时为 Key ID，否则为客户端 IP
+// 避免不同调用方因系统提示与首条消息相同而共用账号与 conversationId
+func scopeSessionKey(r *http.Request, key string) string {
+	if key == "" {
+		return ""
+	}
+	if apiKey := apiKeyFromContext(r.Context()); apiKey != nil {
+		return "key:" + apiKey.ID + "|" + key
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host + "|" + key
+}
+
+func hashSessionKey(parts ...interface{}) string {
+	data, err := json.Marshal(parts)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "hash:" + hex.EncodeToString(sum[:12])
+}
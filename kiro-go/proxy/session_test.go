@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"kiro-api-proxy/config"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sessionPayload(conversationID string) *KiroPayload {
+	p := &KiroPayload{}
+	p.ConversationState.ConversationID = conversationID
+	return p
+}
+
+func TestSessionKeyScopedByCaller(t *testing.T) {
+	req := &OpenAIRequest{Messages: []OpenAIMessage{
+		{Role: "system", Content: "You are a CI assistant."},
+		{Role: "user", Content: "Run the checks."},
+	}}
+	withKey := func(remote string, key *config.ApiKey) string {
+		r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		r.RemoteAddr = remote
+		if key != nil {
+			r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+		}
+		return openAISessionKey(r, req)
+	}
+
+	a := withKey("10.0.0.1:5000", &config.ApiKey{ID: "a"})
+	b := withKey("10.0.0.1:5000", &config.ApiKey{ID: "b"})
+	if a == b {
+		t.Fatalf("different API keys share session key %q", a)
+	}
+	if again := withKey("10.0.0.2:6000", &config.ApiKey{ID: "a"}); again != a {
+		t.Fatalf("same API key: %q != %q", again, a)
+	}
+	ip1, ip2 := withKey("10.0.0.1:5000", nil), withKey("10.0.0.2:5000", nil)
+	if ip1 == ip2 {
+		t.Fatalf("different clients without API key share session key %q", ip1)
+	}
+	if !strings.HasPrefix(ip1, "ip:10.0.0.1|hash:") {
+		t.Fatalf("unexpected key %q", ip1)
+	}
+}
+
+func TestSessionConcurrentRequestsDoNotShareConversation(t *testing.T) {
+	s := newSessionStore()
+	account := &config.Account{ID: "acc-1"}
+	ok := failoverResult{Account: account}
+
+	first := s.Route("k")
+	s.Bind(first, ok, sessionPayload("conv-1"))
+
+	r1 := s.Route("k")
+	r2 := s.Route("k")
+	if r1.ConversationID != "conv-1" || r1.Concurrent {
+		t.Fatalf("first in-flight request: got (%q, %v), want (conv-1, false)", r1.ConversationID, r1.Concurrent)
+	}
+	if r2.ConversationID != "" || r2.AccountID != "" || !r2.Concurrent {
+		t.Fatalf("concurrent request reused binding: %+v", r2)
+	}
+
+	// 并发请求不改写绑定
+	s.Bind(r2, ok, sessionPayload("conv-2"))
+	s.Bind(r1, failoverResult{Err: errors.New("upstream failed")}, sessionPayload("conv-1"))
+	if next := s.Route("k"); next.ConversationID != "conv-1" || next.Concurrent {
+		t.Fatalf("after concurrent requests: got (%q, %v), want (conv-1, false)", next.ConversationID, next.Concurrent)
+	}
+	if n := len(s.inflight); n != 1 {
+		t.Fatalf("inflight entries = %d, want 1", n)
+	}
+}
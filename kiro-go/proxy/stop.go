@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"kiro-api-proxy/tokenizer"
+	"strings"
+	"unicode/utf8"
+)
+
+// outputLimiter 在输出文本上应用 stop sequences 与 max_tokens
+// 为避免 stop sequence 跨分片，会暂存末尾可能构成匹配前缀的文本
+type outputLimiter struct {
+	sequences []string
+	holdback  int // 最长 stop sequence 的字节数 - 1
+	maxTokens int // 0 表示不限制
+	pending   string
+	emitted   tokenizer.Counter // 已输出文本的估算 token
+
+	StopReason   string // "" | "stop_sequence" | "max_tokens"
+	StopSequence string
+}
+
+func newOutputLimiter(sequences []string, maxTokens int) *outputLimiter {
+	l := &outputLimiter{maxTokens: maxTokens}
+	for _, seq := range sequences {
+		if seq == "" {
+			continue
+		}
+		l.sequences = append(l.sequences, seq)
+		if len(seq)-1 > l.holdback {
+			l.holdback = len(seq) - 1
+		}
+	}
+	return l
+}
+
+// Stopped 是否已触发停止，之后的上游事件应被忽略
+func (l *outputLimiter) Stopped() bool {
+	return l.StopReason != ""
+}
+
+// Text 处理一段输出文本，返回现在可以安全输出的部分
+func (l *outputLimiter) Text(text string) string {
+	if l.Stopped() {
+		return ""
+	}
+	l.pending += text
+
+	// 查找最早出现的 stop sequence
+	cut, matched := -1, ""
+	for _, seq := range l.sequences {
+		if idx := strings.Index(l.pending, seq); idx != -1 && (cut == -1 || idx < cut) {
+			cut, matched = idx, seq
+		}
+	}
+	if cut != -1 {
+		out := l.pending[:cut]
+		l.pending = ""
+		l.StopReason, l.StopSequence = "stop_sequence", matched
+		return l.limitTokens(out)
+	}
+
+	// 保留可能构成 stop sequence 前缀的尾部
+	safe := len(l.pending) - l.holdback
+	for safe > 0 && safe < len(l.pending) && !utf8.RuneStart(l.pending[safe]) {
+		safe--
+	}
+	if safe <= 0 {
+		return ""
+	}
+	out := l.pending[:safe]
+	l.pending = l.pending[safe:]
+	return l.limitTokens(out)
+}
+
+// Flush 上游结束时输出剩余暂存文本
+func (l *outputLimiter) Flush() string {
+	if l.Stopped() {
+		return ""
+	}
+	out := l.pending
+	l.pending = ""
+	return l.limitTokens(out)
+}
+
+// limitTokens 按 max_tokens 截断输出
+// 按已输出文本整体计数，避免跨分片的单词被重复计数
+func (l *outputLimiter) limitTokens(out string) string {
+	if l.maxTokens <= 0 {
+		return out
+	}
+	if l.emitted.TotalWith(out) <= l.maxTokens {
+		l.emitted.Add(out)
+		return out
+	}
+	out = l.emitted.Truncate(out, l.maxTokens)
+	l.emitted.Add(out)
+	l.pending = ""
+	l.StopReason, l.StopSequence = "max_tokens", ""
+	return out
+}
+
+// ClaudeStopReason 返回 Claude stop_reason
+// 上游输出 token 达到 max_tokens 也视为被截断
+func (l *outputLimiter) ClaudeStopReason(hasToolUse bool, outputTokens int) string {
+	switch {
+	case l.Stopped():
+		return l.StopReason
+	case hasToolUse:
+		return "tool_use"
+	case l.maxTokens > 0 && outputTokens >= l.maxTokens:
+		return "max_tokens"
+	}
+	return "end_turn"
+}
+
+// OpenAIFinishReason 返回 OpenAI finish_reason
+func (l *outputLimiter) OpenAIFinishReason(hasToolUse bool, outputTokens int) string {
+	switch l.ClaudeStopReason(hasToolUse, outputTokens) {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+// stopSequenceValue 返回 Claude stop_sequence 字段值（未命中时为 null）
+func (l *outputLimiter) stopSequenceValue() *string {
+	if l.StopReason != "stop_sequence" {
+		return nil
+	}
+	seq := l.StopSequence
+	return &seq
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"kiro-api-proxy/tokenizer"
+	"strings"
+	"testing"
+)
+
+// feedChunks 按固定字节数切分 text 依次送入 limiter，返回输出文本
+func feedChunks(l *outputLimiter, text string, size int) string {
+	var sb strings.Builder
+	for i := 0; i < len(text) && !l.Stopped(); i += size {
+		sb.WriteString(l.Text(text[i:min(i+size, len(text))]))
+	}
+	sb.WriteString(l.Flush())
+	return sb.String()
+}
+
+func TestOutputLimiterChunks(t *testing.T) {
+	sentence := "The quick brown fox jumps over the lazy dog while counting tokens carefully."
+	tokens := tokenizer.Count(sentence)
+
+	tests := []struct {
+		name       string
+		text       string
+		sequences  []string
+		maxTokens  int
+		chunk      int
+		want       string
+		wantReason string
+		wantSeq    string
+	}{
+		{name: "no limits", text: sentence, chunk: 3, want: sentence},
+		{name: "max_tokens equal to length is not truncated", text: sentence, maxTokens: tokens, chunk: 3, want: sentence},
+		{name: "max_tokens equal to length with 1-byte chunks", text: sentence, maxTokens: tokens, chunk: 1, want: sentence},
+		{name: "max_tokens truncates", text: sentence, maxTokens: 4, chunk: 3, want: "The quick brown fox", wantReason: "max_tokens"},
+		{name: "stop sequence split across chunks", text: "Answer: 42\n###\nignored", sequences: []string{"###"}, chunk: 2, want: "Answer: 42\n", wantReason: "stop_sequence", wantSeq: "###"},
+		{name: "stop sequence in a single byte stream", text: "alpha STOP beta", sequences: []string{"STOP"}, chunk: 1, want: "alpha ", wantReason: "stop_sequence", wantSeq: "STOP"},
+		{name: "earliest stop sequence wins", text: "one two three", sequences: []string{"three", "two"}, chunk: 4, want: "one ", wantReason: "stop_sequence", wantSeq: "two"},
+		{name: "partial stop sequence prefix is flushed", text: "ends with ##", sequences: []string{"###"}, chunk: 3, want: "ends with ##"},
+		{name: "stop sequence before max_tokens", text: sentence + " END more words here", sequences: []string{" END"}, maxTokens: tokens, chunk: 5, want: sentence, wantReason: "stop_sequence", wantSeq: " END"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newOutputLimiter(tt.sequences, tt.maxTokens)
+			got := feedChunks(l, tt.text, tt.chunk)
+			if got != tt.want {
+				t.Fatalf("output = %q, want %q", got, tt.want)
+			}
+			if l.StopReason != tt.wantReason || l.StopSequence != tt.wantSeq {
+				t.Fatalf("stop = (%q, %q), want (%q, %q)", l.StopReason, l.StopSequence, tt.wantReason, tt.wantSeq)
+			}
+		})
+	}
+}
+
+func TestOutputLimiterChunkingDoesNotInflateCount(t *testing.T) {
+	text := strings.Repeat("Streaming deltas split words across chunk boundaries. ", 20)
+	maxTokens := tokenizer.Count(text)
+	for _, chunk := range []int{1, 2, 3, 7} {
+		l := newOutputLimiter(nil, maxTokens)
+		if got := feedChunks(l, text, chunk); got != text {
+			t.Fatalf("chunk %d: output truncated to %d of %d bytes", chunk, len(got), len(text))
+		}
+		if l.Stopped() {
+			t.Fatalf("chunk %d: unexpected stop %q", chunk, l.StopReason)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"kiro-api-proxy/tokenizer"
+	"strings"
+)
+
+const (
+	// 每条消息的角色与分隔符开销
+	messageOverheadTokens = 3
+	// 每个工具定义的结构开销
+	toolOverheadTokens = 8
+	// 携带工具时上游注入的工具使用系统提示
+	toolSystemPromptTokens = 346
+)
+
+// countClaudeRequestTokens 估算 Claude 请求的输入 token（系统提示、消息、工具定义）
+func countClaudeRequestTokens(req *ClaudeRequest) int {
+	total := tokenizer.Count(extractSystemPrompt(req.System))
+	for _, msg := range req.Messages {
+		total += messageOverheadTokens + countClaudeContent(msg.Content)
+	}
+	if len(req.Tools) > 0 {
+		total += toolSystemPromptTokens
+		for _, tool := range req.Tools {
+			total += countToolTokens(tool.Name, tool.Description, tool.InputSchema)
+		}
+	}
+	return max(1, total)
+}
+
+// countClaudeContent 估算 Claude 消息内容（string 或 []ContentBlock）的 token
+func countClaudeContent(content interface{}) int {
+	switch c := content.(type) {
+	case string:
+		return tokenizer.Count(c)
+	case []interface{}:
+		total := 0
+		for _, part := range c {
+			if block, ok := part.(map[string]interface{}); ok {
+				total += countClaudeBlock(block)
+			}
+		}
+		return total
+	}
+	return 0
+}
+
+func countClaudeBlock(block map[string]interface{}) int {
+	switch block["type"] {
+	case "text":
+		text, _ := block["text"].(string)
+		return tokenizer.Count(text)
+	case "thinking":
+		thinking, _ := block["thinking"].(string)
+		return tokenizer.Count(thinking)
+	case "tool_use":
+		name, _ := block["name"].(string)
+		return tokenizer.Count(name) + tokenizer.CountJSON(block["input"])
+	case "tool_result":
+		return countClaudeContent(block["content"])
+	case "image":
+		source, _ := block["source"].(map[string]interface{})
+		if data, ok := source["data"].(string); ok && source["type"] == "base64" {
+			return tokenizer.ImageTokensBase64(data)
+		}
+		return tokenizer.DefaultImageTokens
+	case "document":
+		source, _ := block["source"].(map[string]interface{})
+		data, _ := source["data"].(string)
+		switch source["type"] {
+		case "base64":
+			return tokenizer.PDFTokensBase64(data)
+		case "text":
+			return tokenizer.Count(data)
+		case "content":
+			return countClaudeContent(source["content"])
+		}
+	}
+	return 0
+}
+
+func countToolTokens(name, description string, schema interface{}) int {
+	return toolOverheadTokens + tokenizer.Count(name) + tokenizer.Count(description) + tokenizer.CountJSON(schema)
+}
+
+// countUserInputTokens 估算 Kiro user 消息的 token（文本、图片、工具定义与工具结果）
+func countUserInputTokens(msg *KiroUserInputMessage) int {
+	total := messageOverheadTokens + tokenizer.Count(msg.Content)
+	for _, img := range msg.Images {
+		total += tokenizer.ImageTokensBase64(img.Source.Bytes)
+	}
+	if ctx := msg.UserInputMessageContext; ctx != nil {
+		if len(ctx.Tools) > 0 {
+			total += toolSystemPromptTokens
+		}
+		for _, tool := range ctx.Tools {
+			spec := tool.ToolSpecification
+			total += countToolTokens(spec.Name, spec.Description, spec.InputSchema.JSON)
+		}
+		for _, result := range ctx.ToolResults {
+			total += messageOverheadTokens
+			for _, c := range result.Content {
+				total += tokenizer.Count(c.Text)
+			}
+		}
+	}
+	return total
+}
+
+// countAssistantTokens 估算 Kiro assistant 消息的 token（文本与工具调用）
+func countAssistantTokens(msg *KiroAssistantResponseMessage) int {
+	total := messageOverheadTokens + tokenizer.Count(msg.Content)
+	for _, tu := range msg.ToolUses {
+		total += tokenizer.Count(tu.Name) + tokenizer.CountJSON(tu.Input)
+	}
+	return total
+}
+
+// countPayloadTokens 估算 Kiro payload 的输入 token
+func countPayloadTokens(payload *KiroPayload) int {
+	total := countUserInputTokens(&payload.ConversationState.CurrentMessage.UserInputMessage)
+	for _, msg := range payload.ConversationState.History {
+		total += historyMessageTokens(msg)
+	}
+	return max(1, total)
+}
+
+func historyMessageTokens(msg KiroHistoryMessage) int {
+	total := 0
+	if msg.UserInputMessage != nil {
+		total += countUserInputTokens(msg.UserInputMessage)
+	}
+	if msg.AssistantResponseMessage != nil {
+		total += countAssistantTokens(msg.AssistantResponseMessage)
+	}
+	return total
+}
+
+// outputTokenCounter 累计流式输出的 token，分片在空白处对齐以减少切分误差
+type outputTokenCounter struct {
+	pending strings.Builder
+	tokens  int
+}
+
+func (c *outputTokenCounter) Add(text string) {
+	c.pending.WriteString(text)
+	s := c.pending.String()
+	idx := strings.LastIndexAny(s, " \n\t")
+	if idx <= 0 {
+		return
+	}
+	c.tokens += tokenizer.Count(s[:idx])
+	c.pending.Reset()
+	c.pending.WriteString(s[idx:])
+}
+
+func (c *outputTokenCounter) Total() int {
+	return c.tokens + tokenizer.Count(c.pending.String())
+}
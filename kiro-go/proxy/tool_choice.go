@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errToolChoiceUnsatisfied = errors.New("tool_choice requires a tool call but the model returned none")
+
+// ToolChoice 归一化后的 tool_choice
+// Mode: "auto" | "none" | "any"（至少调用一个工具）| "tool"（必须调用 Name）
+type ToolChoice struct {
+	Mode string
+	Name string
+}
+
+// parseClaudeToolChoice 解析 Claude tool_choice：{"type":"auto|any|tool|none","name":...}
+func parseClaudeToolChoice(v interface{}) ToolChoice {
+	switch tc := v.(type) {
+	case string:
+		return normalizeToolChoice(tc, "")
+	case map[string]interface{}:
+		mode, _ := tc["type"].(string)
+		name, _ := tc["name"].(string)
+		return normalizeToolChoice(mode, name)
+	}
+	return ToolChoice{Mode: "auto"}
+}
+
+// parseOpenAIToolChoice 解析 OpenAI tool_choice："none|auto|required" 或 {"type":"function","function":{"name":...}}
+func parseOpenAIToolChoice(v interface{}) ToolChoice {
+	switch tc := v.(type) {
+	case string:
+		return normalizeToolChoice(tc, "")
+	case map[string]interface{}:
+		if fn, ok := tc["function"].(map[string]interface{}); ok {
+			name, _ := fn["name"].(string)
+			return normalizeToolChoice("tool", name)
+		}
+		mode, _ := tc["type"].(string)
+		return normalizeToolChoice(mode, "")
+	}
+	return ToolChoice{Mode: "auto"}
+}
+
+func normalizeToolChoice(mode, name string) ToolChoice {
+	switch strings.ToLower(mode) {
+	case "none":
+		return ToolChoice{Mode: "none"}
+	case "any", "required":
+		return ToolChoice{Mode: "any"}
+	case "tool", "function":
+		if name != "" {
+			return ToolChoice{Mode: "tool", Name: name}
+		}
+		return ToolChoice{Mode: "any"}
+	}
+	return ToolChoice{Mode: "auto"}
+}
+
+// Required 是否要求本次响应必须包含工具调用
+func (tc ToolChoice) Required() bool {
+	return tc.Mode == "any" || tc.Mode == "tool"
+}
+
+// allowsTool 工具是否保留在传给上游的工具列表中
+// 历史中已调用过的工具始终保留，否则上游会拒绝对应的 toolUse/toolResult
+func (tc ToolChoice) allowsTool(name string, referenced map[string]bool) bool {
+	switch tc.Mode {
+	case "none":
+		return referenced[name]
+	case "tool":
+		return name == tc.Name || referenced[name]
+	}
+	return true
+}
+
+// accepts 上游返回的工具调用是否符合 tool_choice
+func (tc ToolChoice) accepts(tu KiroToolUse) bool {
+	switch tc.Mode {
+	case "none":
+		return false
+	case "tool":
+		return tu.Name == tc.Name
+	}
+	return true
+}
+
+// directive 注入到当前消息末尾的工具调用指令
+func (tc ToolChoice) directive(names *toolNameMap) string {
+	switch tc.Mode {
+	case "none":
+		return "<tool_choice>Do not call any tools in this response. Answer with text only.</tool_choice>"
+	case "any":
+		return "<tool_choice>You MUST call at least one of the available tools in this response. Do not answer with text only.</tool_choice>"
+	case "tool":
+		return fmt.Sprintf("<tool_choice>You MUST call the tool `%s` in this response. Do not answer with text only.</tool_choice>", names.Short(tc.Name))
+	}
+	return ""
+}
+
+func filterClaudeTools(tools []ClaudeTool, tc ToolChoice, referenced map[string]bool) []ClaudeTool {
+	if tc.Mode == "auto" || tc.Mode == "any" {
+		return tools
+	}
+	result := make([]ClaudeTool, 0, len(tools))
+	for _, tool := range tools {
+		if tc.allowsTool(tool.Name, referenced) {
+			result = append(result, tool)
+		}
+	}
+	return result
+}
+
+func filterOpenAITools(tools []OpenAITool, tc ToolChoice, referenced map[string]bool) []OpenAITool {
+	if tc.Mode == "auto" || tc.Mode == "any" {
+		return tools
+	}
+	result := make([]OpenAITool, 0, len(tools))
+	for _, tool := range tools {
+		if tc.allowsTool(tool.Function.Name, referenced) {
+			result = append(result, tool)
+		}
+	}
+	return result
+}
+
+// historyToolNames 收集历史消息中调用过的工具名
+func historyToolNames(history []KiroHistoryMessage) map[string]bool {
+	names := make(map[string]bool)
+	for _, msg := range history {
+		if msg.AssistantResponseMessage == nil {
+			continue
+		}
+		for _, tu := range msg.AssistantResponseMessage.ToolUses {
+			names[tu.Name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+// Kiro 工具名最大长度
+const maxToolNameLen = 64
+
+// toolNameMap 单次请求内的工具名映射
+// 超长工具名在发给 Kiro 时缩短为不冲突的短名，响应与历史回放时再映射回原名
+type toolNameMap struct {
+	toShort    map[string]string
+	toOriginal map[string]string
+}
+
+func newToolNameMap() *toolNameMap {
+	return &toolNameMap{
+		toShort:    make(map[string]string),
+		toOriginal: make(map[string]string),
+	}
+}
+
+// Register 预先登记请求中的全部工具名，保证短名不会与其他原名冲突
+func (m *toolNameMap) Register(names []string) {
+	// 先登记无需缩短的名字，占用其原名
+	for _, name := range names {
+		if len(name) <= maxToolNameLen {
+			m.Short(name)
+		}
+	}
+	for _, name := range names {
+		m.Short(name)
+	}
+}
+
+// Short 返回发给 Kiro 的工具名
+func (m *toolNameMap) Short(name string) string {
+	if m == nil || name == "" {
+		return name
+	}
+	if short, ok := m.toShort[name]; ok {
+		return short
+	}
+
+	short := name
+	if len(name) > maxToolNameLen {
+		short = readableShortName(name)
+		if owner, taken := m.toOriginal[short]; (taken && owner != name) || len(short) > maxToolNameLen {
+			short = hashedShortName(name)
+		}
+	}
+	// 未缩短的原名与已分配的短名冲突时同样改用哈希短名
+	if owner, taken := m.toOriginal[short]; taken && owner != name {
+		short = hashedShortName(name)
+	}
+
+	m.toShort[name] = short
+	m.toOriginal[short] = name
+	return short
+}
+
+// Original 将 Kiro 返回的工具名映射回客户端原名
+func (m *toolNameMap) Original(short string) string {
+	if m == nil {
+		return short
+	}
+	if name, ok := m.toOriginal[short]; ok {
+		return name
+	}
+	return short
+}
+
+// readableShortName 优先保留可读性：mcp__server__tool -> mcp__tool
+func readableShortName(name string) string {
+	if strings.HasPrefix(name, "mcp__") {
+		if lastIdx := strings.LastIndex(name, "__"); lastIdx > 5 {
+			return "mcp__" + name[lastIdx+2:]
+		}
+	}
+	return name[:maxToolNameLen]
+}
+
+// hashedShortName 截断并追加原名哈希，保证不同原名得到不同短名
+func hashedShortName(name string) string {
+	sum := sha1.Sum([]byte(name))
+	suffix := "_" + hex.EncodeToString(sum[:])[:8]
+	prefix := name
+	if len(prefix) > maxToolNameLen-len(suffix) {
+		prefix = prefix[:maxToolNameLen-len(suffix)]
+	}
+	return prefix + suffix
+}
+
+// shortenHistory 将历史中的工具调用名替换为短名，与本次发送的工具定义保持一致
+func (m *toolNameMap) shortenHistory(history []KiroHistoryMessage) {
+	for _, msg := range history {
+		if msg.AssistantResponseMessage == nil {
+			continue
+		}
+		for i := range msg.AssistantResponseMessage.ToolUses {
+			tu := &msg.AssistantResponseMessage.ToolUses[i]
+			tu.Name = m.Short(tu.Name)
+		}
+	}
+}
+
+// wrapCallback 返回将工具名映射回原名的回调
+func (m *toolNameMap) wrapCallback(callback *KiroStreamCallback) *KiroStreamCallback {
+	wrapped := *callback
+	if callback.OnToolUseStart != nil {
+		wrapped.OnToolUseStart = func(toolUseID, name string) {
+			callback.OnToolUseStart(toolUseID, m.Original(name))
+		}
+	}
+	if callback.OnToolUse != nil {
+		wrapped.OnToolUse = func(tu KiroToolUse) {
+			tu.Name = m.Original(tu.Name)
+			callback.OnToolUse(tu)
+		}
+	}
+	return &wrapped
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"regexp"
 	"strings"
 	"time"
@@ -10,63 +11,49 @@ import (
 	"github.com/google/uuid"
 )
 
-// 模型映射
-var modelMap = map[string]string{
-	"claude-sonnet-4-6":        "claude-sonnet-4.6",
-	"claude-sonnet-4.6":        "claude-sonnet-4.6",
-	"claude-haiku-4-5":         "claude-haiku-4.5",
-	"claude-haiku-4.5":         "claude-haiku-4.5",
-	"claude-opus-4-6":         "claude-opus-4.6",
-	"claude-opus-4.6":         "claude-opus-4.6",
-	"claude-opus-4-5":          "claude-opus-4.5",
-	"claude-opus-4.5":          "claude-opus-4.5",
-	"claude-sonnet-4":          "claude-sonnet-4",
-	"claude-sonnet-4-20250514": "claude-sonnet-4",
-	"claude-3-5-sonnet":        "claude-sonnet-4.5",
-	"claude-3-opus":            "claude-sonnet-4.5",
-	"claude-3-sonnet":          "claude-sonnet-4",
-	"claude-3-haiku":           "claude-haiku-4.5",
-	"gpt-4":                    "claude-sonnet-4.5",
-	"gpt-4o":                   "claude-sonnet-4.5",
-	"gpt-4-turbo":              "claude-sonnet-4.5",
-	"gpt-3.5-turbo":            "claude-sonnet-4.5",
-}
-
-// Thinking 模式提示
-const ThinkingModePrompt = `<thinking_mode>enabled</thinking_mode>
-<max_thinking_length>200000</max_thinking_length>`
-
-// ParseModelAndThinking 解析模型名称，返回实际模型和是否启用 thinking
-func ParseModelAndThinking(model string, thinkingSuffix string) (string, bool) {
-	lower := strings.ToLower(model)
-	thinking := false
-	
-	// 使用配置的后缀检查
-	suffixLower := strings.ToLower(thinkingSuffix)
-	if strings.HasSuffix(lower, suffixLower) {
-		thinking = true
-		model = model[:len(model)-len(thinkingSuffix)]
-		lower = strings.ToLower(model)
-	}
-	
-	// 映射模型
-	for k, v := range modelMap {
-		if strings.Contains(lower, k) {
-			return v, thinking
-		}
+// Thinking 预算（max_thinking_length）
+const (
+	DefaultThinkingBudget = 200000 // 模型后缀或未指定预算时使用
+	MinThinkingBudget     = 1024
+)
+
+// reasoning_effort 对应的 thinking 预算
+var reasoningEffortBudgets = map[string]int{
+	"minimal": 1024,
+	"low":     4096,
+	"medium":  16384,
+	"high":    65536,
+}
+
+// ThinkingModePrompt 生成 thinking 模式提示
+func ThinkingModePrompt(budget int) string {
+	return fmt.Sprintf("<thinking_mode>enabled</thinking_mode>\n<max_thinking_length>%d</max_thinking_length>", budget)
+}
+
+// ResolveThinkingBudget 合并模型后缀与请求参数，返回 0 表示不启用 thinking
+// 后缀强制开启 thinking（覆盖请求参数中的 disabled），预算优先使用请求参数
+func ResolveThinkingBudget(suffixThinking bool, requested int) int {
+	if requested > 0 {
+		return requested
 	}
-	
-	// 如果已经是有效的 Kiro 模型，直接返回
-	if strings.HasPrefix(lower, "claude-") {
-		return model, thinking
+	if suffixThinking {
+		return DefaultThinkingBudget
 	}
-	
-	return "claude-sonnet-4.5", thinking
+	return 0
 }
 
-func MapModel(model string) string {
-	mapped, _ := ParseModelAndThinking(model, "-thinking")
-	return mapped
+// clampThinkingBudget 将预算限制在 [MinThinkingBudget, DefaultThinkingBudget]
+func clampThinkingBudget(budget int) int {
+	if budget <= 0 {
+		return DefaultThinkingBudget
+	}
+	if budget < MinThinkingBudget {
+		return MinThinkingBudget
+	}
+	if budget > DefaultThinkingBudget {
+		return DefaultThinkingBudget
+	}
+	return budget
 }
 
 // ==================== Claude API 类型 ====================
@@ -75,12 +62,43 @@ type ClaudeRequest struct {
 	Model       string          `json:"model"`
 	Messages    []ClaudeMessage `json:"messages"`
 	MaxTokens   int             `json:"max_tokens"`
-	Temperature float64         `json:"temperature,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"`
 	TopP        float64         `json:"top_p,omitempty"`
 	Stream      bool            `json:"stream,omitempty"`
 	System      interface{}     `json:"system,omitempty"` // string or []SystemBlock
 	Tools       []ClaudeTool    `json:"tools,omitempty"`
 	ToolChoice  interface{}     `json:"tool_choice,omitempty"`
+	Thinking    *ClaudeThinking `json:"thinking,omitempty"`
+
+	StopSequences []string        `json:"stop_sequences,omitempty"`
+	Metadata      *ClaudeMetadata `json:"metadata,omitempty"`
+}
+
+// ClaudeMetadata 请求元数据，user_id 用于会话粘性
+type ClaudeMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+// ClaudeThinking extended thinking 参数
+type ClaudeThinking struct {
+	Type         string `json:"type"` // "enabled" | "disabled"
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// ParsedToolChoice 返回归一化的 tool_choice，未提供工具时视为 auto
+func (req *ClaudeRequest) ParsedToolChoice() ToolChoice {
+	if len(req.Tools) == 0 {
+		return ToolChoice{Mode: "auto"}
+	}
+	return parseClaudeToolChoice(req.ToolChoice)
+}
+
+// ThinkingBudget 返回请求的 thinking 预算，0 表示未启用
+func (req *ClaudeRequest) ThinkingBudget() int {
+	if req.Thinking == nil || req.Thinking.Type == "disabled" {
+		return 0
+	}
+	return clampThinkingBudget(req.Thinking.BudgetTokens)
 }
 
 type ClaudeMessage struct {
@@ -97,6 +115,8 @@ type ClaudeContentBlock struct {
 	ToolUseID string      `json:"tool_use_id,omitempty"`
 	Content   interface{} `json:"content,omitempty"` // for tool_result
 	Source    *ImageSource `json:"source,omitempty"`
+	Thinking  string      `json:"thinking,omitempty"`  // for thinking
+	Signature string      `json:"signature,omitempty"` // for thinking
 }
 
 type ImageSource struct {
@@ -123,24 +143,27 @@ type ClaudeResponse struct {
 }
 
 type ClaudeUsage struct {
-	InputTokens  int `json:"input_tokens"`
-	OutputTokens int `json:"output_tokens"`
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
 }
 
 // ==================== Claude -> Kiro 转换 ====================
 
 const maxToolDescLen = 10237
 
-func ClaudeToKiro(req *ClaudeRequest, thinking bool) *KiroPayload {
-	modelID := MapModel(req.Model)
+// req.Model 须为已解析的 Kiro 模型，thinkingBudget 为 0 时不启用 thinking
+func ClaudeToKiro(req *ClaudeRequest, thinkingBudget int) *KiroPayload {
+	modelID := req.Model
 	origin := "AI_EDITOR"
 
 	// 提取系统提示
 	systemPrompt := extractSystemPrompt(req.System)
 	
 	// 如果启用 thinking 模式，注入 thinking 提示
-	if thinking {
-		systemPrompt = ThinkingModePrompt + "\n\n" + systemPrompt
+	if thinkingBudget > 0 {
+		systemPrompt = ThinkingModePrompt(thinkingBudget) + "\n\n" + systemPrompt
 	}
 	
 	// 注入时间戳
@@ -230,11 +253,27 @@ func ClaudeToKiro(req *ClaudeRequest, thinking bool) *KiroPayload {
 		finalContent += "Continue"
 	}
 
+	// 工具名映射：超长工具名缩短后发给 Kiro
+	toolNames := newToolNameMap()
+	names := make([]string, 0, len(req.Tools))
+	for _, tool := range req.Tools {
+		names = append(names, tool.Name)
+	}
+	toolNames.Register(names)
+	referenced := historyToolNames(history)
+	toolNames.shortenHistory(history)
+
+	// 应用 tool_choice：过滤工具列表并追加调用指令
+	toolChoice := req.ParsedToolChoice()
+	if directive := toolChoice.directive(toolNames); directive != "" {
+		finalContent += "\n\n" + directive
+	}
+
 	// 转换工具
-	kiroTools := convertClaudeTools(req.Tools)
+	kiroTools := convertClaudeTools(filterClaudeTools(req.Tools, toolChoice, referenced), toolNames)
 
 	// 构建 payload
-	payload := &KiroPayload{}
+	payload := &KiroPayload{toolNames: toolNames}
 	payload.ConversationState.ChatTriggerType = "MANUAL"
 	payload.ConversationState.ConversationID = uuid.New().String()
 	payload.ConversationState.CurrentMessage.UserInputMessage = KiroUserInputMessage{
@@ -255,7 +294,7 @@ func ClaudeToKiro(req *ClaudeRequest, thinking bool) *KiroPayload {
 		payload.ConversationState.History = history
 	}
 
-	if req.MaxTokens > 0 || req.Temperature > 0 || req.TopP > 0 {
+	if req.MaxTokens > 0 || req.Temperature != nil || req.TopP > 0 {
 		payload.InferenceConfig = &InferenceConfig{
 			MaxTokens:   req.MaxTokens,
 			Temperature: req.Temperature,
@@ -401,7 +440,7 @@ func extractClaudeAssistantContent(content interface{}) (string, []KiroToolUse)
 	return text, toolUses
 }
 
-func convertClaudeTools(tools []ClaudeTool) []KiroToolWrapper {
+func convertClaudeTools(tools []ClaudeTool, names *toolNameMap) []KiroToolWrapper {
 	if len(tools) == 0 {
 		return nil
 	}
@@ -413,35 +452,27 @@ func convertClaudeTools(tools []ClaudeTool) []KiroToolWrapper {
 			desc = desc[:maxToolDescLen] + "..."
 		}
 		result[i] = KiroToolWrapper{}
-		result[i].ToolSpecification.Name = shortenToolName(tool.Name)
+		result[i].ToolSpecification.Name = names.Short(tool.Name)
 		result[i].ToolSpecification.Description = desc
 		result[i].ToolSpecification.InputSchema = InputSchema{JSON: tool.InputSchema}
 	}
 	return result
 }
 
-func shortenToolName(name string) string {
-	if len(name) <= 64 {
-		return name
-	}
-	// MCP tools: mcp__server__tool -> mcp__tool
-	if strings.HasPrefix(name, "mcp__") {
-		lastIdx := strings.LastIndex(name, "__")
-		if lastIdx > 5 {
-			shortened := "mcp__" + name[lastIdx+2:]
-			if len(shortened) <= 64 {
-				return shortened
-			}
-		}
-	}
-	return name[:64]
-}
-
 // ==================== Kiro -> Claude 转换 ====================
 
-func KiroToClaudeResponse(content string, toolUses []KiroToolUse, inputTokens, outputTokens int, model string) *ClaudeResponse {
+// thinking 非空时输出原生 thinking 内容块（位于 text 与 tool_use 之前）
+func KiroToClaudeResponse(content, thinking string, toolUses []KiroToolUse, inputTokens, outputTokens int, model string) *ClaudeResponse {
 	blocks := make([]ClaudeContentBlock, 0)
 
+	if thinking != "" {
+		blocks = append(blocks, ClaudeContentBlock{
+			Type:      "thinking",
+			Thinking:  thinking,
+			Signature: thinkingSignature(thinking),
+		})
+	}
+
 	if content != "" {
 		blocks = append(blocks, ClaudeContentBlock{
 			Type: "text",
@@ -483,10 +514,58 @@ type OpenAIRequest struct {
 	Model       string          `json:"model"`
 	Messages    []OpenAIMessage `json:"messages"`
 	MaxTokens   int             `json:"max_tokens,omitempty"`
-	Temperature float64         `json:"temperature,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"`
 	TopP        float64         `json:"top_p,omitempty"`
 	Stream      bool            `json:"stream,omitempty"`
 	Tools       []OpenAITool    `json:"tools,omitempty"`
+	ToolChoice  interface{}     `json:"tool_choice,omitempty"`
+	Stop        interface{}     `json:"stop,omitempty"` // string or []string
+
+	ReasoningEffort string                `json:"reasoning_effort,omitempty"` // minimal/low/medium/high
+	ResponseFormat  *OpenAIResponseFormat `json:"response_format,omitempty"`
+}
+
+// ParsedStop 返回 stop 参数中的 stop sequences
+func (req *OpenAIRequest) ParsedStop() []string {
+	switch v := req.Stop.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// OpenAIResponseFormat 结构化输出参数：text / json_object / json_schema
+type OpenAIResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *OpenAIJSONSchema `json:"json_schema,omitempty"`
+}
+
+type OpenAIJSONSchema struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Schema      map[string]interface{} `json:"schema,omitempty"`
+	Strict      bool                   `json:"strict,omitempty"`
+}
+
+// ParsedToolChoice 返回归一化的 tool_choice，未提供工具时视为 auto
+func (req *OpenAIRequest) ParsedToolChoice() ToolChoice {
+	if len(req.Tools) == 0 {
+		return ToolChoice{Mode: "auto"}
+	}
+	return parseOpenAIToolChoice(req.ToolChoice)
+}
+
+// ThinkingBudget 根据 reasoning_effort 返回 thinking 预算，0 表示未启用
+func (req *OpenAIRequest) ThinkingBudget() int {
+	return reasoningEffortBudgets[strings.ToLower(req.ReasoningEffort)]
 }
 
 type OpenAIMessage struct {
@@ -537,8 +616,9 @@ type OpenAIUsage struct {
 
 // ==================== OpenAI -> Kiro 转换 ====================
 
-func OpenAIToKiro(req *OpenAIRequest, thinking bool) *KiroPayload {
-	modelID := MapModel(req.Model)
+// req.Model 须为已解析的 Kiro 模型，thinkingBudget 为 0 时不启用 thinking
+func OpenAIToKiro(req *OpenAIRequest, thinkingBudget int) *KiroPayload {
+	modelID := req.Model
 	origin := "AI_EDITOR"
 
 	// 提取系统提示
@@ -556,8 +636,8 @@ func OpenAIToKiro(req *OpenAIRequest, thinking bool) *KiroPayload {
 	}
 
 	// 如果启用 thinking 模式，注入 thinking 提示
-	if thinking {
-		systemPrompt = ThinkingModePrompt + "\n\n" + systemPrompt
+	if thinkingBudget > 0 {
+		systemPrompt = ThinkingModePrompt(thinkingBudget) + "\n\n" + systemPrompt
 	}
 
 	// 注入时间戳
@@ -583,6 +663,7 @@ func OpenAIToKiro(req *OpenAIRequest, thinking bool) *KiroPayload {
 	var currentContent string
 	var currentImages []KiroImage
 	var currentToolResults []KiroToolResult
+	var pinnedPrefix string
 	systemMerged := false
 
 	for i, msg := range nonSystemMessages {
@@ -596,6 +677,9 @@ func OpenAIToKiro(req *OpenAIRequest, thinking bool) *KiroPayload {
 			if !systemMerged && systemPrompt != "" {
 				content = systemPrompt + "\n" + content
 				systemMerged = true
+				if !isLast {
+					pinnedPrefix = systemPrompt
+				}
 			}
 
 			if isLast {
@@ -680,11 +764,32 @@ func OpenAIToKiro(req *OpenAIRequest, thinking bool) *KiroPayload {
 		finalContent = systemPrompt + "\n" + finalContent
 	}
 
+	// 工具名映射：超长工具名缩短后发给 Kiro
+	toolNames := newToolNameMap()
+	names := make([]string, 0, len(req.Tools))
+	for _, tool := range req.Tools {
+		names = append(names, tool.Function.Name)
+	}
+	toolNames.Register(names)
+	referenced := historyToolNames(history)
+	toolNames.shortenHistory(history)
+
+	// 应用 tool_choice：过滤工具列表并追加调用指令
+	toolChoice := req.ParsedToolChoice()
+	if directive := toolChoice.directive(toolNames); directive != "" {
+		finalContent += "\n\n" + directive
+	}
+
+	// 结构化输出指令
+	if directive := req.ResponseFormat.directive(); directive != "" {
+		finalContent += "\n\n" + directive
+	}
+
 	// 转换工具
-	kiroTools := convertOpenAITools(req.Tools)
+	kiroTools := convertOpenAITools(filterOpenAITools(req.Tools, toolChoice, referenced), toolNames)
 
 	// 构建 payload
-	payload := &KiroPayload{}
+	payload := &KiroPayload{toolNames: toolNames, pinnedPrefix: pinnedPrefix}
 	payload.ConversationState.ChatTriggerType = "MANUAL"
 	payload.ConversationState.ConversationID = uuid.New().String()
 	payload.ConversationState.CurrentMessage.UserInputMessage = KiroUserInputMessage{
@@ -705,7 +810,7 @@ func OpenAIToKiro(req *OpenAIRequest, thinking bool) *KiroPayload {
 		payload.ConversationState.History = history
 	}
 
-	if req.MaxTokens > 0 || req.Temperature > 0 || req.TopP > 0 {
+	if req.MaxTokens > 0 || req.Temperature != nil || req.TopP > 0 {
 		payload.InferenceConfig = &InferenceConfig{
 			MaxTokens:   req.MaxTokens,
 			Temperature: req.Temperature,
@@ -778,7 +883,7 @@ func parseDataURL(url string) *KiroImage {
 	}
 }
 
-func convertOpenAITools(tools []OpenAITool) []KiroToolWrapper {
+func convertOpenAITools(tools []OpenAITool, names *toolNameMap) []KiroToolWrapper {
 	if len(tools) == 0 {
 		return nil
 	}
@@ -793,7 +898,7 @@ func convertOpenAITools(tools []OpenAITool) []KiroToolWrapper {
 			desc = desc[:maxToolDescLen] + "..."
 		}
 		wrapper := KiroToolWrapper{}
-		wrapper.ToolSpecification.Name = shortenToolName(tool.Function.Name)
+		wrapper.ToolSpecification.Name = names.Short(tool.Function.Name)
 		wrapper.ToolSpecification.Description = desc
 		wrapper.ToolSpecification.InputSchema = InputSchema{JSON: tool.Function.Parameters}
 		result = append(result, wrapper)
@@ -0,0 +1,97 @@
+package tokenizer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultImageTokens 无法解析图片尺寸时的估算值（约为上限）
+	DefaultImageTokens = 1600
+	// 长边超过该值的图片会被上游等比缩放
+	maxImageEdge = 1568
+	// 每页 PDF 的估算 token（文本 + 页面图像）
+	pdfPageTokens = 1500
+)
+
+// ImageTokens 按尺寸估算图片 token：width * height / 750，超大图片先等比缩放
+func ImageTokens(width, height int) int {
+	if width <= 0 || height <= 0 {
+		return DefaultImageTokens
+	}
+	if long := max(width, height); long > maxImageEdge {
+		scale := float64(maxImageEdge) / float64(long)
+		width = int(float64(width) * scale)
+		height = int(float64(height) * scale)
+	}
+	return max(1, min(width*height/750, DefaultImageTokens))
+}
+
+// ImageTokensBase64 解析 base64 图片（支持 data URL）的尺寸并估算 token
+func ImageTokensBase64(data string) int {
+	raw, err := decodeBase64(data)
+	if err != nil {
+		return DefaultImageTokens
+	}
+	return ImageTokensBytes(raw)
+}
+
+// ImageTokensBytes 解析图片字节的尺寸并估算 token（PNG/JPEG/GIF/WebP）
+func ImageTokensBytes(raw []byte) int {
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(raw)); err == nil {
+		return ImageTokens(cfg.Width, cfg.Height)
+	}
+	if w, h, ok := webpSize(raw); ok {
+		return ImageTokens(w, h)
+	}
+	return DefaultImageTokens
+}
+
+var pdfPageRe = regexp.MustCompile(`/Type\s*/Page[^s]`)
+
+// PDFTokensBase64 按页数估算 base64 PDF 文档的 token
+func PDFTokensBase64(data string) int {
+	raw, err := decodeBase64(data)
+	if err != nil {
+		return pdfPageTokens
+	}
+	pages := len(pdfPageRe.FindAll(raw, -1))
+	return max(1, pages) * pdfPageTokens
+}
+
+func decodeBase64(data string) ([]byte, error) {
+	if strings.HasPrefix(data, "data:") {
+		if idx := strings.Index(data, ","); idx != -1 {
+			data = data[idx+1:]
+		}
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// webpSize 解析 WebP 头部尺寸（VP8 / VP8L / VP8X）
+func webpSize(b []byte) (int, int, bool) {
+	if len(b) < 30 || string(b[0:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return 0, 0, false
+	}
+	switch string(b[12:16]) {
+	case "VP8 ":
+		w := int(binary.LittleEndian.Uint16(b[26:28]) & 0x3fff)
+		h := int(binary.LittleEndian.Uint16(b[28:30]) & 0x3fff)
+		return w, h, true
+	case "VP8L":
+		bits := binary.LittleEndian.Uint32(b[21:25])
+		return int(bits&0x3fff) + 1, int((bits>>14)&0x3fff) + 1, true
+	case "VP8X":
+		w := int(b[24]) | int(b[25])<<8 | int(b[26])<<16
+		h := int(b[27]) | int(b[28])<<8 | int(b[29])<<16
+		return w + 1, h + 1, true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,223 @@
+// Package tokenizer 近似 Claude BPE 分词的 token 计数
+// 不携带词表，按 BPE 预分词规则切分文本后按片段类型估算 token 数：
+// 英文单词按长度与大小写边界、数字每 3 位、CJK 按字、标点与空白按常见合并规则计数
+package tokenizer
+
+import (
+	"encoding/json"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Count 估算文本的 token 数
+func Count(text string) int {
+	n := 0
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case r == ' ' && i+size < len(text) && isWordStart(text[i+size:]):
+			// 单个前导空格与后续单词合并为一个 token
+			i += size
+		case r == '\n' || r == '\r':
+			j := i
+			for j < len(text) && (text[j] == '\n' || text[j] == '\r') {
+				j++
+			}
+			n += (j - i + 1) / 2
+			i = j
+		case unicode.IsSpace(r):
+			j := i
+			for j < len(text) && (text[j] == ' ' || text[j] == '\t') {
+				j++
+			}
+			if j == i {
+				j = i + size
+			}
+			n += (j - i + 3) / 4
+			i = j
+		case isCJK(r):
+			n++
+			i += size
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(text) {
+				d, ds := utf8.DecodeRuneInString(text[j:])
+				if !unicode.IsDigit(d) {
+					break
+				}
+				j += ds
+			}
+			n += (utf8.RuneCountInString(text[i:j]) + 2) / 3
+			i = j
+		case unicode.IsLetter(r):
+			j := wordEnd(text, i)
+			n += wordTokens(text[i:j])
+			i = j
+		case r < utf8.RuneSelf:
+			// ASCII 标点：常见组合（如 `{"`、`":`、`//`）通常合并为一个 token
+			j := i
+			for j < len(text) && text[j] < utf8.RuneSelf && isPunct(text[j]) {
+				j++
+			}
+			if j == i {
+				j = i + 1
+			}
+			n += (j - i + 1) / 2
+			i = j
+		default:
+			// emoji 与其他符号按 UTF-8 字节计
+			n += (size + 2) / 3
+			i += size
+		}
+	}
+	return n
+}
+
+// CountJSON 估算值序列化为 JSON 后的 token 数
+func CountJSON(v interface{}) int {
+	if v == nil {
+		return 0
+	}
+	if s, ok := v.(string); ok {
+		return Count(s)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return Count(string(data))
+}
+
+// Truncate 截断文本使其不超过 maxTokens，返回截断后的文本
+func Truncate(text string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+	if Count(text) <= maxTokens {
+		return text
+	}
+	// 二分查找不超过 maxTokens 的最长前缀（按字符边界）
+	lo, hi := 0, len(text)
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		for mid > lo && !utf8.RuneStart(text[mid]) {
+			mid--
+		}
+		if mid == lo {
+			break
+		}
+		if Count(text[:mid]) <= maxTokens {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return text[:lo]
+}
+
+// Counter 增量统计流式文本的 token 数，结果与对完整文本调用 Count 一致
+// 分片单独计数会重复计算跨分片的单词，因此只在分词边界处结算，边界之后的尾部文本随下一个分片一起计数
+type Counter struct {
+	counted int    // 尾部之前文本的 token 数
+	tail    string // 最后一个分词边界之后的文本
+}
+
+// Add 追加文本
+func (c *Counter) Add(text string) {
+	s := c.tail + text
+	b := lastBoundary(s)
+	c.counted += Count(s[:b])
+	c.tail = s[b:]
+}
+
+// Total 已追加文本的 token 数
+func (c *Counter) Total() int {
+	return c.counted + Count(c.tail)
+}
+
+// TotalWith 追加 text 后的 token 数（不追加）
+func (c *Counter) TotalWith(text string) int {
+	return c.counted + Count(c.tail+text)
+}
+
+// Truncate 返回 text 的最长前缀，使追加后的总 token 数不超过 maxTokens
+func (c *Counter) Truncate(text string, maxTokens int) string {
+	keep := Truncate(c.tail+text, maxTokens-c.counted)
+	if len(keep) <= len(c.tail) {
+		return ""
+	}
+	return keep[len(c.tail):]
+}
+
+// lastBoundary 返回最后一个分词边界的位置：在该位置切分时两侧分别计数与整体计数相同，没有时返回 0
+// 边界为非空白字符后的空格或换行，以及 CJK 字符之前
+func lastBoundary(s string) int {
+	for i := len(s) - 1; i > 0; i-- {
+		if !utf8.RuneStart(s[i]) {
+			continue
+		}
+		r, _ := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == ' ' || r == '\n':
+			if prev := s[i-1]; prev != ' ' && prev != '\t' && prev != '\n' && prev != '\r' {
+				return i
+			}
+		case isCJK(r):
+			return i
+		}
+	}
+	return 0
+}
+
+// wordEnd 返回单词结束位置：字母与撇号缩写，遇到 camelCase 边界时切分
+func wordEnd(text string, start int) int {
+	prevLower := false
+	j := start
+	for j < len(text) {
+		r, size := utf8.DecodeRuneInString(text[j:])
+		if !unicode.IsLetter(r) || isCJK(r) {
+			if r == '\'' && j > start && j+size < len(text) {
+				// 英文缩写：don't / it's
+				next, _ := utf8.DecodeRuneInString(text[j+size:])
+				if unicode.IsLower(next) {
+					j += size
+					continue
+				}
+			}
+			break
+		}
+		if j > start && prevLower && unicode.IsUpper(r) {
+			break
+		}
+		prevLower = unicode.IsLower(r)
+		j += size
+	}
+	return j
+}
+
+// wordTokens 单词的 token 数：常见短词为 1 个，长词约每 5 个字符增加 1 个
+func wordTokens(word string) int {
+	runes := utf8.RuneCountInString(word)
+	if runes == len(word) {
+		if runes <= 7 {
+			return 1
+		}
+		return 1 + (runes-7+4)/5
+	}
+	// 非 ASCII 字母（西里尔、希腊等）词表覆盖较少
+	return 1 + runes/3
+}
+
+func isWordStart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsLetter(r) && !isCJK(r) || unicode.IsDigit(r)
+}
+
+func isPunct(b byte) bool {
+	return b > ' ' && b < 0x7f && !('a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9')
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
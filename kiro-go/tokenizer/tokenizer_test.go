@@ -0,0 +1,54 @@
+package tokenizer
+
+import "testing"
+
+func TestCounterMatchesCount(t *testing.T) {
+	texts := []string{
+		"The quick brown fox jumps over the lazy dog, doesn't it? Yes: 12345 times.",
+		"func main() {\n\tfmt.Println(\"hello\")\n}\n\n// camelCaseIdentifier handles it",
+		"混合中文和 English 文本，包含标点。还有数字 2024 年。",
+		"  leading spaces\t\ttabs   and   runs  \r\n\r\n end",
+		`{"key": "value", "list": [1, 2, 3], "nested": {"a": null}}`,
+	}
+	for _, text := range texts {
+		want := Count(text)
+		for _, size := range []int{1, 2, 3, 5, 8, 13} {
+			var c Counter
+			for i := 0; i < len(text); i += size {
+				c.Add(text[i:min(i+size, len(text))])
+			}
+			if got := c.Total(); got != want {
+				t.Errorf("chunk size %d: Total() = %d, Count = %d for %q", size, got, want, text)
+			}
+		}
+	}
+}
+
+func TestCounterTruncate(t *testing.T) {
+	var c Counter
+	c.Add("one two three")
+	base := c.Total()
+
+	tests := []struct {
+		name      string
+		text      string
+		maxTokens int
+		want      string
+	}{
+		{name: "fits", text: " four five", maxTokens: base + 2, want: " four five"},
+		{name: "partial", text: " four five six", maxTokens: base + 2, want: " four five"},
+		{name: "no room", text: " four", maxTokens: base, want: ""},
+		{name: "below counted", text: " four", maxTokens: base - 1, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := c.Truncate(tt.text, tt.maxTokens)
+			if got != tt.want {
+				t.Fatalf("Truncate(%q, %d) = %q, want %q", tt.text, tt.maxTokens, got, tt.want)
+			}
+			if n := c.TotalWith(got); n > tt.maxTokens && got != "" {
+				t.Fatalf("truncated total %d exceeds %d", n, tt.maxTokens)
+			}
+		})
+	}
+}